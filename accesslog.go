@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// accessLogEntry is one line of the JSON access log.
+type accessLogEntry struct {
+	Origin     string  `json:"origin"`
+	Timestamp  string  `json:"timestamp"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Status     int     `json:"status"` // 0 if the backend did not answer
+	DurationMS float64 `json:"duration_ms"`
+	Host       string  `json:"host"`
+	URI        string  `json:"uri"`
+	RequestID  string  `json:"request_id,omitempty"`
+}
+
+// logAccess writes the verbose log line for the response of origin to req,
+// which was sent to host. A nil response stands for a failed request.
+func logAccess(origin string, req *http.Request, response *http.Response, duration time.Duration, host string) {
+	now := time.Now().UTC()
+	if *logFormat == "json" {
+		entry := accessLogEntry{
+			Origin:     origin,
+			Timestamp:  now.Format(time.RFC3339Nano),
+			RemoteAddr: req.RemoteAddr,
+			Method:     req.Method,
+			DurationMS: float64(duration) / float64(time.Millisecond),
+			Host:       host,
+			URI:        req.RequestURI,
+			RequestID:  req.Header.Get(REQUEST_ID_HEADER),
+		}
+		if response != nil {
+			entry.Status = response.StatusCode
+		}
+		line, _ := json.Marshal(entry)
+		// Bypass the log prefix, so that every line is valid JSON.
+		accessLogger().Writer().Write(append(line, '\n'))
+		return
+	}
+
+	var status interface{} = "failed"
+	if response != nil {
+		status = response.StatusCode
+	}
+	line := fmt.Sprintf("[%v] %v %v %v %v %v %v %v", origin, now, req.RemoteAddr, req.Method, status, duration, host, req.RequestURI)
+	if id := req.Header.Get(REQUEST_ID_HEADER); id != "" {
+		line += " " + id
+	}
+	accessLogger().Println(line)
+}
+
+// accessLogger returns the logger of the access log: the one of
+// -access-log-file, or the std logger.
+func accessLogger() *log.Logger {
+	if accessLog != nil {
+		return accessLog.Logger
+	}
+	return log.Default()
+}
+
+// logRequestHeaders logs the headers of request, as sent by origin, if
+// -log-headers and -debug are set.
+func logRequestHeaders(origin string, request *http.Request) {
+	if !*logHeaders || !*debug {
+		return
+	}
+	log.Printf("[%v] %v Request headers of %v %v (Host %v):%v", origin, time.Now().UTC(), request.Method, request.URL, request.Host, formatHeaders(request.Header))
+}
+
+// logResponseHeaders logs the headers of response, as received by origin, if
+// -log-headers and -debug are set.
+func logResponseHeaders(origin string, response *http.Response) {
+	if !*logHeaders || !*debug || response == nil {
+		return
+	}
+	log.Printf("[%v] %v Response headers of %v:%v", origin, time.Now().UTC(), response.Status, formatHeaders(response.Header))
+}
+
+// formatHeaders puts each header on a line of its own, sorted by name, with
+// the values of -redact-headers replaced.
+func formatHeaders(header http.Header) string {
+	redacted := make(map[string]bool)
+	for _, name := range splitList(*redactHeaders) {
+		redacted[http.CanonicalHeaderKey(name)] = true
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if redacted[http.CanonicalHeaderKey(name)] {
+				value = "[REDACTED]"
+			}
+			fmt.Fprintf(&lines, "\n    %s: %s", name, value)
+		}
+	}
+	return lines.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	output := new(bytes.Buffer)
+	log.SetOutput(output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return output
+}
+
+func TestTextAccessLog(t *testing.T) {
+	output := captureLog(t)
+	req := httptest.NewRequest("GET", "/path?q=1", nil)
+	logAccess("B2", req, &http.Response{StatusCode: 404}, 1500*time.Millisecond, "backend:80")
+	if expectation := " 192.0.2.1:1234 GET 404 1.5s backend:80 /path?q=1\n"; !strings.HasSuffix(output.String(), expectation) || !strings.Contains(output.String(), "[B2] ") {
+		t.Errorf("Expected '%s', but received '%s'", expectation, output)
+	}
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	defer func(format string) { *logFormat = format }(*logFormat)
+	*logFormat = "json"
+	output := captureLog(t)
+
+	req := httptest.NewRequest("POST", "/path?q=1", nil)
+	logAccess("A", req, &http.Response{StatusCode: 201}, 1500*time.Microsecond, "backend:80")
+	logAccess("B", req, nil, time.Second, "backend:81")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, but received '%s'", output)
+	}
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := (accessLogEntry{"A", entry.Timestamp, "192.0.2.1:1234", "POST", 201, 1.5, "backend:80", "/path?q=1", ""}); entry != expectation {
+		t.Errorf("Expected '%+v', but received '%+v'", expectation, entry)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry.Status != 0 || entry.Origin != "B" {
+		t.Errorf("Expected a failed B entry, but received '%s'", lines[1])
+	}
+}
+
+func TestLogHeadersRedacts(t *testing.T) {
+	defer func(enabled, logging bool, redacted string) {
+		*debug, *logHeaders, *redactHeaders = enabled, logging, redacted
+	}(*debug, *logHeaders, *redactHeaders)
+	*debug, *logHeaders, *redactHeaders = true, true, "authorization, X-Api-Key"
+	production := newTestBackend(t, http.StatusOK, "")
+	output := captureLog(t)
+	req := httptest.NewRequest("GET", "/path", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("X-Visible", "shown")
+	serve(t, newTestHandler(production), req)
+
+	if strings.Contains(output.String(), "secret") {
+		t.Errorf("Expected the credentials to be redacted, but received '%s'", output)
+	}
+	for _, expectation := range []string{"Request headers of GET", "    Authorization: [REDACTED]\n", "    X-Api-Key: [REDACTED]\n", "    X-Visible: shown\n", "Response headers of 200 OK:"} {
+		if !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected '%s' in '%s'", expectation, output)
+		}
+	}
+}
+
+func TestLogHeadersNeedsDebug(t *testing.T) {
+	defer func(enabled, logging bool) { *debug, *logHeaders = enabled, logging }(*debug, *logHeaders)
+	*debug, *logHeaders = false, true
+	production := newTestBackend(t, http.StatusOK, "")
+	output := captureLog(t)
+	serve(t, newTestHandler(production), httptest.NewRequest("GET", "/path", nil))
+	if strings.Contains(output.String(), "headers of") {
+		t.Errorf("Expected no headers without -debug, but received '%s'", output)
+	}
+}
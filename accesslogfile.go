@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogFlushInterval is how often the buffered access log is written to
+// its file.
+const accessLogFlushInterval = time.Second
+
+// accessLog receives the access log instead of stderr, if -access-log-file
+// is set.
+var accessLog *rotatingFile
+
+// rotatingFile is a buffered log file that is rotated once it would grow
+// beyond MaxSize bytes: the file is renamed to Path.1, the older ones to
+// Path.2 and so on, and only MaxFiles of them are kept. A MaxSize of 0
+// never rotates.
+type rotatingFile struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	Logger   *log.Logger // writes to the file, with the flags of the std logger
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+	closed bool
+	done   chan struct{}
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{Path: path, MaxSize: maxSize, MaxFiles: maxFiles, done: make(chan struct{})}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.Logger = log.New(f, "", log.Flags())
+	go f.flushEvery(accessLogFlushInterval)
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.w, f.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p does not fit. The log
+// package writes each line at once, so lines are never split.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.w.Flush()
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.Path, f.MaxFiles))
+	for i := f.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+	}
+	if f.MaxFiles > 0 {
+		os.Rename(f.Path, f.Path+".1")
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			if err := f.w.Flush(); err != nil && !f.closed {
+				log.Printf("[%v] %v Failed to write the access log: %v", "X", time.Now().UTC(), err)
+			}
+			f.mu.Unlock()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// Close writes the buffered lines and closes the file. Lines after Close
+// are discarded.
+func (f *rotatingFile) Close() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	if err := f.w.Flush(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expectation := range map[string]string{"access.log": "fourth\n", "access.log.1": "third\n", "access.log.2": "second\n"} {
+		if content, err := os.ReadFile(filepath.Join(filepath.Dir(path), name)); string(content) != expectation {
+			t.Errorf("Expected '%s' in %s, but received '%s': %v", expectation, name, content, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected no more than 2 rotated files, but received %v", err)
+	}
+}
+
+func TestAccessLogFileIsBuffered(t *testing.T) {
+	defer func(format string) { *logFormat = format }(*logFormat)
+	*logFormat = "json"
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog = f
+	defer func() { accessLog = nil }()
+	output := captureLog(t)
+
+	logAccess("A", httptest.NewRequest("GET", "/path", nil), &http.Response{StatusCode: 200}, time.Millisecond, "backend:80")
+	if content, _ := os.ReadFile(path); len(content) != 0 {
+		t.Errorf("Expected the line to be buffered, but received '%s'", content)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(path)
+	if expectation := `"uri":"/path"`; !strings.Contains(string(content), expectation) || strings.Count(string(content), "\n") != 1 {
+		t.Errorf("Expected one line with '%s', but received '%s'", expectation, content)
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected nothing on stderr, but received '%s'", output)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// atomicPercent is a percentage flag.Value that can be read and changed
+// safely while requests are served.
+type atomicPercent struct {
+	bits atomic.Uint64
+}
+
+func percentFlag(name string, value float64, usage string) *atomicPercent {
+	p := &atomicPercent{}
+	p.Store(value)
+	flag.Var(p, name, usage)
+	return p
+}
+
+func (p *atomicPercent) Load() float64 {
+	return math.Float64frombits(p.bits.Load())
+}
+
+func (p *atomicPercent) Store(value float64) {
+	p.bits.Store(math.Float64bits(value))
+}
+
+func (p *atomicPercent) String() string {
+	if p == nil {
+		return ""
+	}
+	return strconv.FormatFloat(p.Load(), 'g', -1, 64)
+}
+
+func (p *atomicPercent) Set(value string) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 || parsed > 100 {
+		return fmt.Errorf("expected a percentage from 0 to 100, but found %q", value)
+	}
+	p.Store(parsed)
+	return nil
+}
+
+// adminHandler serves /admin/percent, which returns the sampling percentage
+// on GET and changes it on POST. Every request has to carry the token as
+// "Authorization: Bearer <token>".
+type adminHandler struct {
+	Token string
+}
+
+// authorized reports whether req carries token as a bearer token, and
+// answers 401 if it does not.
+func authorized(w http.ResponseWriter, req *http.Request, token string) bool {
+	expected := []byte("Bearer " + token)
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req, a.Token) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		previous := percent.String()
+		if err := percent.Set(req.FormValue("percent")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[%v] %v Sampling percentage changed from %v to %v", "X", time.Now().UTC(), previous, percent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, percent)
+}
+
+// secretFlags are the flags whose values /admin/config does not show.
+var secretFlags = map[string]bool{
+	"admin-token":      true,
+	"a.basic-auth":     true,
+	"b.basic-auth":     true,
+	"key.file":         true,
+	"backend-key.file": true,
+}
+
+// configSetting is the value of a flag in effect and where it came from:
+// "command-line", "config" for the -config file, or "default".
+type configSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// configHandler serves /admin/config, which returns the value of every flag
+// of Flags as JSON, by name, with secrets and the values of the
+// -redact-headers in added headers replaced. CommandLine names the flags
+// given on the command line, before the config file was applied. Every
+// request has to carry the token, as for /admin/percent.
+type configHandler struct {
+	Token       string
+	Flags       *flag.FlagSet
+	CommandLine map[string]bool
+}
+
+func (c *configHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !authorized(w, req, c.Token) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(c.settings())
+}
+
+// settings returns the setting of each flag.
+func (c *configHandler) settings() map[string]configSetting {
+	set := make(map[string]bool)
+	c.Flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	settings := make(map[string]configSetting)
+	c.Flags.VisitAll(func(f *flag.Flag) {
+		setting := configSetting{Value: f.Value.String(), Source: "default"}
+		switch {
+		case c.CommandLine[f.Name]:
+			setting.Source = "command-line"
+		case set[f.Name]:
+			setting.Source = "config"
+		}
+		if headers, ok := f.Value.(headerList); ok {
+			setting.Value = redactedHeaderList(headers).String()
+		} else if secretFlags[f.Name] && setting.Value != "" {
+			setting.Value = "[REDACTED]"
+		}
+		settings[f.Name] = setting
+	})
+	return settings
+}
+
+// redactedHeaderList returns a copy of headers with the values of the
+// -redact-headers replaced.
+func redactedHeaderList(headers headerList) headerList {
+	redacted := make(headerList)
+	for name, values := range headers {
+		redacted[name] = values
+	}
+	for _, name := range splitList(*redactHeaders) {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := redacted[name]; ok {
+			redacted[name] = make([]string, len(values))
+			for i := range values {
+				redacted[name][i] = "[REDACTED]"
+			}
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func adminRequest(method, token string, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, "/admin/percent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestAdminChangesPercent(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(10)
+	captureLog(t)
+	admin := &adminHandler{Token: "secret"}
+
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, adminRequest("GET", "secret", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "10\n" {
+		t.Errorf("Expected 10, but received %d '%s'", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, adminRequest("POST", "secret", url.Values{"percent": {"25.5"}}))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "25.5\n" || percent.Load() != 25.5 {
+		t.Errorf("Expected 25.5, but received %d '%s'", recorder.Code, recorder.Body.String())
+	}
+
+	for _, value := range []string{"", "101", "-1", "many"} {
+		recorder = httptest.NewRecorder()
+		admin.ServeHTTP(recorder, adminRequest("POST", "secret", url.Values{"percent": {value}}))
+		if recorder.Code != http.StatusBadRequest || percent.Load() != 25.5 {
+			t.Errorf("Expected status %d for '%s', but received %d", http.StatusBadRequest, value, recorder.Code)
+		}
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(10)
+	admin := &adminHandler{Token: "secret"}
+
+	for _, token := range []string{"", "wrong"} {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, adminRequest("POST", token, url.Values{"percent": {"50"}}))
+		if recorder.Code != http.StatusUnauthorized || percent.Load() != 10 {
+			t.Errorf("Expected status %d for token '%s', but received %d", http.StatusUnauthorized, token, recorder.Code)
+		}
+	}
+}
+
+func TestAdminConfigRedactsSecrets(t *testing.T) {
+	flags := flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+	flags.String("a.basic-auth", "", "")
+	flags.String("a", "localhost:8080", "")
+	flags.String("b", "localhost:8081", "")
+	flags.Duration("b.lag", 0, "")
+	headers := make(headerList)
+	flags.Var(headers, "a.add-header", "")
+	flags.Parse([]string{"-a.basic-auth", "user:secret", "-a", "localhost:9000", "-a.add-header", "Authorization:Bearer secret", "-a.add-header", "X-Env:test"})
+	commandLine := map[string]bool{"a.basic-auth": true, "a": true, "a.add-header": true}
+	flags.Set("b", "localhost:9001")
+	config := &configHandler{Token: "token", Flags: flags, CommandLine: commandLine}
+
+	recorder := httptest.NewRecorder()
+	config.ServeHTTP(recorder, adminRequest("GET", "token", nil))
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), "secret") {
+		t.Fatalf("Expected the config without secrets, but received %d '%s'", recorder.Code, recorder.Body.String())
+	}
+	var settings map[string]configSetting
+	if err := json.Unmarshal(recorder.Body.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]configSetting{
+		"a.basic-auth": {Value: "[REDACTED]", Source: "command-line"},
+		"a":            {Value: "localhost:9000", Source: "command-line"},
+		"b":            {Value: "localhost:9001", Source: "config"},
+		"b.lag":        {Value: "0s", Source: "default"},
+		"a.add-header": {Value: "Authorization:[REDACTED],X-Env:test", Source: "command-line"},
+	}
+	for name, setting := range expected {
+		if settings[name] != setting {
+			t.Errorf("Expected %s to be %+v, but received %+v", name, setting, settings[name])
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	config.ServeHTTP(recorder, adminRequest("GET", "wrong", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, but received %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
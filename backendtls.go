@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// The TLS configs used for HTTPS connections to production and to the
+// alternates. They are set in main, and nil means the defaults.
+var productionTLSConfig, alternateTLSConfig *tls.Config
+
+// loadBackendTLSConfig builds the TLS config for the backends from a client
+// certificate and key, and a file of PEM encoded CA certificates that
+// replaces the system roots. Any of the paths may be empty.
+func loadBackendTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate %s and key %s: %s", certFile, keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+// insecureTLSConfig returns a copy of config, which may be nil, that does not
+// verify certificates.
+func insecureTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.InsecureSkipVerify = true
+	return config
+}
+
+// serverNameTLSConfig returns a copy of config, which may be nil, that
+// verifies and asks for name via SNI, rather than the host of the target.
+func serverNameTLSConfig(config *tls.Config, name string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.ServerName = name
+	return config
+}
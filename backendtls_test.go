@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePEM writes one PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, bytes []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newClientCertificate creates a CA and a client certificate signed by it,
+// and writes the client certificate and key to files.
+func newClientCertificate(t *testing.T) (ca *x509.CertPool, certFile, keyFile string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "teeproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCertificate, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "teeproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCertificate, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(clientKey)
+
+	dir := t.TempDir()
+	ca = x509.NewCertPool()
+	ca.AddCert(caCertificate)
+	return ca, writePEM(t, dir, "client.crt", "CERTIFICATE", clientDER), writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestBackendClientCertificate(t *testing.T) {
+	ca, certFile, keyFile := newClientCertificate(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: ca}
+	backend.StartTLS()
+	defer backend.Close()
+	caFile := writePEM(t, t.TempDir(), "ca.crt", "CERTIFICATE", backend.Certificate().Raw)
+
+	config, err := loadBackendTLSConfig("", "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	if response := handleRequest("A", request, newTransport(time.Second, config, nil), 0, false); response != nil {
+		t.Errorf("Expected the backend to reject a request without client certificate, but received %d", response.StatusCode)
+	}
+
+	if config, err = loadBackendTLSConfig(certFile, keyFile, caFile); err != nil {
+		t.Fatal(err)
+	}
+	request, _ = http.NewRequest("GET", backend.URL, nil)
+	response := handleRequest("A", request, newTransport(time.Second, config, nil), 0, false)
+	if response == nil || response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d with client certificate, but received %v", http.StatusNoContent, response)
+	}
+	response.Body.Close()
+}
+
+func TestInvalidBackendTLSFiles(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, nil, 0o600)
+	for _, files := range [][3]string{
+		{"missing.crt", "missing.key", ""},
+		{"", "", "missing.crt"},
+		{"", "", empty},
+	} {
+		if _, err := loadBackendTLSConfig(files[0], files[1], files[2]); err == nil {
+			t.Errorf("Expected an error for %v", files)
+		}
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	if response := handleRequest("A", request, newTransport(time.Second, nil, nil), 0, false); response != nil {
+		t.Errorf("Expected an unknown certificate to be rejected, but received %d", response.StatusCode)
+	}
+
+	config := insecureTLSConfig(nil)
+	request, _ = http.NewRequest("GET", backend.URL, nil)
+	response := handleRequest("A", request, newTransport(time.Second, config, nil), 0, false)
+	if response == nil || response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d without verification, but received %v", http.StatusNoContent, response)
+	}
+	response.Body.Close()
+}
+
+func TestBackendServerName(t *testing.T) {
+	certFile, keyFile := newServerCertificate(t, "backend.internal")
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Server-Name", req.TLS.ServerName)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	backend.StartTLS()
+	defer backend.Close()
+	config, err := loadBackendTLSConfig("", "", certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is not valid for 127.0.0.1, the host of the target.
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	request.Host = "public.example.com"
+	if response := handleRequest("A", request, newTransport(time.Second, config, nil), 0, false); response != nil {
+		t.Errorf("Expected the certificate of backend.internal to be rejected, but received %d", response.StatusCode)
+	}
+	request, _ = http.NewRequest("GET", backend.URL, nil)
+	request.Host = "public.example.com"
+	response := handleRequest("A", request, newTransport(time.Second, serverNameTLSConfig(config, "backend.internal"), nil), 0, false)
+	if response == nil || response.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d with the server name, but received %v", http.StatusNoContent, response)
+	}
+	response.Body.Close()
+	if name := response.Header.Get("X-Server-Name"); name != "backend.internal" {
+		t.Errorf("Expected SNI '%s', but received '%s'", "backend.internal", name)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// bodyWithinLimit reports whether the body of req has at most max bytes. It
+// reads no more than max+1 bytes to find out and puts them back in front of
+// the rest of the body, so that req can still be sent on as it is.
+func bodyWithinLimit(req *http.Request, max int64) bool {
+	if req.ContentLength > max {
+		return false
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if expectsContinue(req) && req.ContentLength >= 0 {
+		// Reading would ask the client for the body. The server stops at
+		// the announced length anyway.
+		return true
+	}
+	prefix, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), req.Body), req.Body}
+	return err == nil && int64(len(prefix)) <= max
+}
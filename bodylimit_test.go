@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimit(t *testing.T) {
+	defer func(max int64, action string) { *maxBodyBytes, *maxBodyAction = max, action }(*maxBodyBytes, *maxBodyAction)
+	*maxBodyBytes = 10
+	large := strings.Repeat("x", 100)
+
+	for _, c := range []struct {
+		action            string
+		body              string
+		chunked           bool
+		status            int
+		productionBody    string
+		alternateRequests int
+	}{
+		{"stream", "small", false, http.StatusOK, "small", 1},
+		{"stream", large[:10], false, http.StatusOK, large[:10], 1},
+		{"stream", large[:10], true, http.StatusOK, large[:10], 1},
+		{"stream", large[:11], false, http.StatusOK, large[:11], 0},
+		{"stream", large[:11], true, http.StatusOK, large[:11], 0},
+		{"stream", large, false, http.StatusOK, large, 0},
+		{"stream", large, true, http.StatusOK, large, 0},
+		{"reject", "small", false, http.StatusOK, "small", 1},
+		{"reject", large, true, http.StatusRequestEntityTooLarge, "", 0},
+	} {
+		*maxBodyAction = c.action
+		production := newTestBackend(t, http.StatusOK, "")
+		alternate := newTestBackend(t, http.StatusOK, "")
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(c.body))
+		if c.chunked {
+			req.ContentLength = -1
+		}
+
+		recorder := serve(t, newTestHandler(production, alternate), req)
+		if recorder.Code != c.status {
+			t.Errorf("Expected status %d for %d bytes with %s, but received %d", c.status, len(c.body), c.action, recorder.Code)
+		}
+		if bodies := production.Bodies(); c.productionBody != "" && (len(bodies) != 1 || bodies[0] != c.productionBody) {
+			t.Errorf("Expected production to receive %d bytes with %s, but received %v", len(c.productionBody), c.action, bodies)
+		}
+		if requests := alternate.Requests(); len(requests) != c.alternateRequests {
+			t.Errorf("Expected %d alternate requests for %d bytes with %s, but received %d", c.alternateRequests, len(c.body), c.action, len(requests))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // requests pass
+	breakerOpen                         // requests are skipped
+	breakerHalfOpen                     // one request probes for recovery
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// circuitBreaker stops requests to an alternate that keeps failing. After
+// Threshold consecutive failures within Window it opens, and skips all
+// requests for Cooldown. Then it lets a single request through, and closes
+// again if that one succeeds.
+type circuitBreaker struct {
+	Name      string
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+
+	mu           sync.Mutex
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	now          func() time.Time // for tests
+}
+
+func newCircuitBreaker(name string, threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{Name: name, Threshold: threshold, Window: window, Cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a request may be sent. A nil breaker allows all.
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.openedAt = b.now()
+		b.transition(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// Wait for the probe, unless it got lost without being recorded.
+		if b.now().Sub(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.openedAt = b.now()
+		return true
+	}
+	return true
+}
+
+// Record takes the outcome of an allowed request into account.
+func (b *circuitBreaker) Record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+	if b.state == breakerHalfOpen {
+		b.openedAt = now
+		b.transition(breakerOpen)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.Window {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.Threshold {
+		b.openedAt = now
+		b.transition(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) transition(state breakerState) {
+	log.Printf("[%v] %v Circuit breaker %v -> %v", b.Name, time.Now().UTC(), b.state, state)
+	b.state = state
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(now *time.Time) *circuitBreaker {
+	b := newCircuitBreaker("B", 3, time.Minute, 10*time.Second)
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	b.Record(false)
+	b.Record(false)
+	b.Record(true)
+	b.Record(false)
+	b.Record(false)
+	if !b.Allow() {
+		t.Fatalf("Expected a success to reset the failures")
+	}
+	b.Record(false)
+	if b.Allow() {
+		t.Errorf("Expected the breaker to be open after 3 consecutive failures")
+	}
+}
+
+func TestBreakerFailuresOutsideWindowDoNotCount(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	b.Record(false)
+	b.Record(false)
+	now = now.Add(2 * time.Minute)
+	b.Record(false)
+	if !b.Allow() {
+		t.Errorf("Expected failures outside the window not to open the breaker")
+	}
+}
+
+func TestBreakerHalfOpens(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 3; i++ {
+		b.Record(false)
+	}
+	now = now.Add(5 * time.Second)
+	if b.Allow() {
+		t.Fatalf("Expected the breaker to stay open during the cooldown")
+	}
+
+	now = now.Add(5 * time.Second)
+	if !b.Allow() {
+		t.Fatalf("Expected a probe after the cooldown")
+	}
+	if b.Allow() {
+		t.Errorf("Expected a single probe while half-open")
+	}
+	b.Record(false)
+	if b.Allow() {
+		t.Fatalf("Expected a failed probe to open the breaker again")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.Allow() {
+		t.Fatalf("Expected another probe after the cooldown")
+	}
+	b.Record(true)
+	if !b.Allow() || !b.Allow() {
+		t.Errorf("Expected a successful probe to close the breaker")
+	}
+}
+
+func TestNilBreakerAllows(t *testing.T) {
+	var b *circuitBreaker
+	b.Record(false)
+	if !b.Allow() {
+		t.Errorf("Expected a nil breaker to allow requests")
+	}
+}
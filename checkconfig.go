@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// flagErrors returns the problems of the flags that can be found without
+// reading any file. Each error names its flag.
+func flagErrors() []error {
+	var errs []error
+	if *logFormat != "text" && *logFormat != "json" {
+		errs = append(errs, fmt.Errorf("-log-format %s: expected text or json", *logFormat))
+	}
+	if *maxBodyAction != "stream" && *maxBodyAction != "reject" {
+		errs = append(errs, fmt.Errorf("-max-body-action %s: expected stream or reject", *maxBodyAction))
+	}
+	if *alternateFaultType != "abort" && *alternateFaultType != "delay" {
+		errs = append(errs, fmt.Errorf("-b.fault-type %s: expected abort or delay", *alternateFaultType))
+	}
+	if *alternateFaultRate < 0 || *alternateFaultRate > 100 {
+		errs = append(errs, fmt.Errorf("-b.fault-rate %v: expected a percentage between 0 and 100", *alternateFaultRate))
+	}
+	if *alternateServePercent < 0 || *alternateServePercent > 100 {
+		errs = append(errs, fmt.Errorf("-b.serve-percent %v: expected a percentage between 0 and 100", *alternateServePercent))
+	}
+	if *kafkaBufferSize < 1 {
+		errs = append(errs, fmt.Errorf("-kafka-buffer %d: expected at least 1", *kafkaBufferSize))
+	}
+	if *kafkaBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("-kafka-batch-size %d: expected at least 1", *kafkaBatchSize))
+	}
+	if *adminListen != "" && *adminToken == "" {
+		errs = append(errs, fmt.Errorf("-admin-listen %s: -admin-token is required", *adminListen))
+	}
+	if *alternateLocalAddr != "" && net.ParseIP(*alternateLocalAddr) == nil {
+		errs = append(errs, fmt.Errorf("-b.local-addr %s: expected an IP address", *alternateLocalAddr))
+	}
+	// Without echoing the credentials.
+	if *productionBasicAuth != "" && !strings.Contains(*productionBasicAuth, ":") {
+		errs = append(errs, fmt.Errorf("-a.basic-auth: expected user:pass"))
+	}
+	if *alternateBasicAuth != "" && !strings.Contains(*alternateBasicAuth, ":") {
+		errs = append(errs, fmt.Errorf("-b.basic-auth: expected user:pass"))
+	}
+	return errs
+}
+
+// configErrors returns the problems -check-config finds: those of
+// flagErrors, and those of the targets, regular expressions, rule files and
+// TLS files. Nothing is listened on, dialed or written.
+func configErrors() []error {
+	errs := flagErrors()
+	production, routes, err := productionRoutes(targetProduction)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-a %s: %s", targetProduction, err))
+	}
+	if *backendCertificate != "" || *backendPrivateKey != "" || *backendCA != "" {
+		if _, err := loadBackendTLSConfig(*backendCertificate, *backendPrivateKey, *backendCA); err != nil {
+			errs = append(errs, fmt.Errorf("backend TLS files: %s", err))
+		}
+	}
+	certificates := len(*tlsPrivateKeys) > 0
+	if certificates {
+		loaded, err := loadCertificates(*tlsCertificates, *tlsPrivateKeys)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := listenerTLSConfig(loaded); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, spec := range *listen {
+		if _, err := parseListenAddress(spec, certificates); err != nil {
+			errs = append(errs, fmt.Errorf("-l %s", err))
+		}
+	}
+	if err := new(handler).parseConfig(handlerConfigFromFlags(production, routes)); err != nil {
+		errs = append(errs, err)
+	}
+	for _, file := range []struct{ flag, path string }{
+		{"-record-file", *recordFile},
+		{"-access-log-file", *accessLogFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		// The files are created when teeproxy starts, in a directory
+		// that has to exist.
+		if _, err := os.Stat(filepath.Dir(file.path)); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %s", file.flag, file.path, err))
+		}
+	}
+	return errs
+}
+
+// checkConfig logs the problems of the configuration for -check-config and
+// returns the exit status: 0 if there are none.
+func checkConfig() int {
+	errs := configErrors()
+	for _, err := range errs {
+		log.Printf("Invalid %s", err)
+	}
+	if len(errs) > 0 {
+		log.Printf("Found %d problems in the configuration", len(errs))
+		return 1
+	}
+	log.Printf("The configuration is valid")
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if errs := configErrors(); len(errs) != 0 {
+		t.Errorf("Expected no problems, but received %v", errs)
+	}
+	captureLog(t)
+	if status := checkConfig(); status != 0 {
+		t.Errorf("Expected exit status 0, but received %d", status)
+	}
+}
+
+func TestConfigErrorsReportsEveryProblem(t *testing.T) {
+	defer func(v string) { *alternateInclude = v }(*alternateInclude)
+	defer func(v float64) { *alternateFaultRate = v }(*alternateFaultRate)
+	defer func(v string) { *recordFile = v }(*recordFile)
+	defer func(v []string) { *tlsCertificates = v }(*tlsCertificates)
+	defer func(v []string) { *tlsPrivateKeys = v }(*tlsPrivateKeys)
+	defer func(v string) { *alternateLocalAddr = v }(*alternateLocalAddr)
+	*alternateInclude = "^/api/("
+	*alternateFaultRate = 150
+	*recordFile = filepath.Join(t.TempDir(), "missing", "record.jsonl")
+	*tlsCertificates = []string{filepath.Join(t.TempDir(), "cert.pem")}
+	*tlsPrivateKeys = []string{filepath.Join(t.TempDir(), "key.pem")}
+	*alternateLocalAddr = "10.0.0.300"
+
+	errs := configErrors()
+	for _, flag := range []string{"-b.fault-rate", "-b.include", "-b.local-addr", "-record-file", "cert.pem"} {
+		found := false
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), flag)
+		}
+		if !found {
+			t.Errorf("Expected a problem with %s, but received %v", flag, errs)
+		}
+	}
+	captureLog(t)
+	if status := checkConfig(); status != 1 {
+		t.Errorf("Expected exit status 1, but received %d", status)
+	}
+}
+
+func TestFlagErrorsHideCredentials(t *testing.T) {
+	defer func(v string) { *productionBasicAuth = v }(*productionBasicAuth)
+	*productionBasicAuth = "secret"
+
+	errs := flagErrors()
+	if len(errs) != 1 || strings.Contains(errs[0].Error(), "secret") {
+		t.Errorf("Expected one problem without the credentials, but received %v", errs)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the smallest response body, in bytes, that -compress
+// compresses. Below it gzip saves too little to pay for its header.
+const compressMinSize = 1024
+
+// acceptsGzip reports whether the Accept-Encoding header of req allows
+// gzip, by name or as *, with a q-value above 0.
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether -compress gzips resp to the client of req:
+// the client accepts gzip, and resp has a body the backend did not encode,
+// of at least compressMinSize bytes if its length is known. Server-sent
+// events are passed on as they are, so that each event arrives when it is
+// sent.
+func compressible(req *http.Request, resp *http.Response) bool {
+	if !*compressResponses || req.Method == "HEAD" || !acceptsGzip(req) {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < compressMinSize {
+		return false
+	}
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) == "text/event-stream" {
+		return false
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	return encoding == "" || encoding == "identity"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, expectation := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"deflate, GZIP;q=0.5":    true,
+		"*":                      true,
+		"gzip;q=0, deflate":      false,
+		"br, deflate":            false,
+		"identity, gzip ; q=0.1": true,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			req.Header.Set("Accept-Encoding", value)
+		}
+		if accepts := acceptsGzip(req); accepts != expectation {
+			t.Errorf("Expected %v for '%s', but received %v", expectation, value, accepts)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	defer func(enabled bool) { *compressResponses = enabled }(*compressResponses)
+	*compressResponses = true
+	body := strings.Repeat("uncompressed ", 200)
+	production := newTestBackend(t, http.StatusOK, body)
+	h := newTestHandler(production)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := serve(t, h, req)
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Expected Content-Encoding 'gzip', but received '%s'", encoding)
+	}
+	if length := recorder.Header().Get("Content-Length"); length != "" {
+		t.Errorf("Expected no Content-Length, but received '%s'", length)
+	}
+	reader, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, _ := io.ReadAll(reader); string(received) != body {
+		t.Errorf("Expected the body after decompressing, but received '%s'", received)
+	}
+
+	for name, accept := range map[string]string{"without gzip": "br", "to HEAD": "gzip"} {
+		method := "GET"
+		if name == "to HEAD" {
+			method = "HEAD"
+		}
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if encoding := serve(t, h, req).Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("Expected no compression %s, but received '%s'", name, encoding)
+		}
+	}
+}
+
+func TestCompressSkipsSmallAndCompressedResponses(t *testing.T) {
+	defer func(enabled bool) { *compressResponses = enabled }(*compressResponses)
+	*compressResponses = true
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	writer.Write([]byte(strings.Repeat("compressed ", 200)))
+	writer.Close()
+	compressed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped.Bytes())
+	}))
+	defer compressed.Close()
+	small := newTestBackend(t, http.StatusOK, "small")
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(strings.Repeat("data: event\n\n", 200)))
+	}))
+	defer events.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := serve(t, newTestHandlerFor(strings.TrimPrefix(compressed.URL, "http://")), req)
+	if !bytes.Equal(recorder.Body.Bytes(), gzipped.Bytes()) || recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the gzipped body of the backend to pass through, but received %d bytes", recorder.Body.Len())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder = serve(t, newTestHandler(small), req)
+	if recorder.Body.String() != "small" || recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected '%s' uncompressed, but received '%s'", "small", recorder.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder = serve(t, newTestHandlerFor(strings.TrimPrefix(events.URL, "http://")), req)
+	if !strings.HasPrefix(recorder.Body.String(), "data: event") || recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected server-sent events uncompressed, but received %d bytes", recorder.Body.Len())
+	}
+}
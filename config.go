@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config mirrors the command line flags. Each field is tagged with the name
+// of its flag, and a nil field means the file does not set it.
+type Config struct {
+	Listen                    stringOrList    `json:"l"`
+	TargetProduction          stringOrList    `json:"a"`
+	AltTargets                []string        `json:"b"`
+	Debug                     *bool           `json:"debug"`
+	Verbose                   *bool           `json:"verbose"`
+	OTelEndpoint              *string         `json:"otel-endpoint"`
+	StatsInterval             *string         `json:"stats-interval"`
+	SummaryOnExit             *bool           `json:"summary-on-exit"`
+	Compress                  *bool           `json:"compress"`
+	RequestID                 *bool           `json:"request-id"`
+	LogFormat                 *string         `json:"log-format"`
+	AccessLogFile             *string         `json:"access-log-file"`
+	AccessLogMaxSize          *int64          `json:"access-log-max-size"`
+	AccessLogMaxFiles         *int            `json:"access-log-max-files"`
+	LogHeaders                *bool           `json:"log-headers"`
+	RedactHeaders             *string         `json:"redact-headers"`
+	ProductionTimeout         *timeoutSetting `json:"a.timeout"`
+	AlternateTimeout          *timeoutSetting `json:"b.timeout"`
+	ProductionRetries         *int            `json:"a.retries"`
+	AlternateRetries          *int            `json:"b.retries"`
+	AlternateDelayMin         *string         `json:"b.delay-min"`
+	AlternateDelayMax         *string         `json:"b.delay-max"`
+	AlternateLag              *string         `json:"b.lag"`
+	AlternateFaultRate        *float64        `json:"b.fault-rate"`
+	AlternateFaultType        *string         `json:"b.fault-type"`
+	AlternateFaultDelay       *string         `json:"b.fault-delay"`
+	ErrorStatus               *int            `json:"error-status"`
+	ErrorBody                 *string         `json:"error-body"`
+	ProductionDeadline        *string         `json:"a.deadline"`
+	ProductionRetryOn503      *bool           `json:"a.retry-on-503"`
+	RetryBackoff              *string         `json:"retry-backoff"`
+	RetryNonIdempotent        *bool           `json:"retry-non-idempotent"`
+	ProductionBasicAuth       *string         `json:"a.basic-auth"`
+	AlternateBasicAuth        *string         `json:"b.basic-auth"`
+	ProductionPathPrefix      *string         `json:"a.path-prefix"`
+	AlternatePathPrefix       *string         `json:"b.path-prefix"`
+	RewriteRules              *string         `json:"rewrite-rules"`
+	ProductionHostRewrite     *bool           `json:"a.rewrite"`
+	AlternateHostRewrite      *bool           `json:"b.rewrite"`
+	ProductionHostSchemeHTTPS *bool           `json:"a.https"`
+	AlternateHostSchemeHTTPS  *bool           `json:"b.https"`
+	Percent                   *float64        `json:"p"`
+	EveryN                    *int            `json:"every-n"`
+	SampleBy                  *string         `json:"sample-by"`
+	AltHashBy                 *string         `json:"b.hash-by"`
+	ForceShadowParam          *string         `json:"force-shadow-param"`
+	TLSPrivateKeys            stringOrList    `json:"key.file"`
+	TLSCertificates           stringOrList    `json:"cert.file"`
+	TLSMinVersion             *string         `json:"tls-min-version"`
+	TLSCiphers                *string         `json:"tls-ciphers"`
+	TLSFailOpen               *bool           `json:"tls-fail-open"`
+	BackendCertificate        *string         `json:"backend-cert.file"`
+	BackendPrivateKey         *string         `json:"backend-key.file"`
+	BackendCA                 *string         `json:"backend-ca.file"`
+	BackendInsecure           *bool           `json:"backend-insecure-skip-verify"`
+	ProductionInsecure        *bool           `json:"a.insecure"`
+	AlternateInsecure         *bool           `json:"b.insecure"`
+	ProductionSNI             *string         `json:"a.sni"`
+	AlternateSNI              *string         `json:"b.sni"`
+	AlternateLocalAddr        *string         `json:"b.local-addr"`
+	Preflight                 *bool           `json:"preflight"`
+	PreflightMethod           *string         `json:"preflight-method"`
+	PreflightPath             *string         `json:"preflight-path"`
+	PreflightFatal            *bool           `json:"preflight-fatal"`
+	DryRun                    *bool           `json:"dry-run"`
+	RateLimit                 *float64        `json:"rate-limit"`
+	RateLimitBurst            *float64        `json:"rate-limit-burst"`
+	RateLimitPerIP            *bool           `json:"rate-limit-per-ip"`
+	ForwardProtoHost          *bool           `json:"forward-proto-host"`
+	ForwardProtoHostTrust     *bool           `json:"forward-proto-host.trust"`
+	AddVia                    *bool           `json:"add-via"`
+	ViaName                   *string         `json:"via-name"`
+	ForwardClientIP           *bool           `json:"forward-client-ip"`
+	ProxyProtocol             *bool           `json:"proxy-protocol"`
+	CloseConnections          *bool           `json:"close-connections"`
+	AllowConnect              *bool           `json:"allow-connect"`
+	MaxIdleConnsPerHost       *int            `json:"max-idle-conns-per-host"`
+	DNSCacheTTL               *string         `json:"dns-cache-ttl"`
+	TCPKeepAlive              *string         `json:"tcp-keepalive"`
+	IdleConnTimeout           *timeoutSetting `json:"idle-conn-timeout"`
+	DiffResponses             *bool           `json:"diff"`
+	DiffHeaders               *string         `json:"diff-headers"`
+	ReplayFile                *string         `json:"replay-file"`
+	ReplayTo                  *string         `json:"replay-to"`
+	ReplayRate                *float64        `json:"replay-rate"`
+	RecordFile                *string         `json:"record-file"`
+	RecordMaxBody             *int            `json:"record-max-body"`
+	KafkaBufferSize           *int            `json:"kafka-buffer"`
+	KafkaBatchSize            *int            `json:"kafka-batch-size"`
+	KafkaLinger               *string         `json:"kafka-linger"`
+	DiffDir                   *string         `json:"diff-dir"`
+	DiffMaxFiles              *int            `json:"diff-max-files"`
+	DiffMaxBody               *int            `json:"diff-max-body"`
+	AlternateHeaderMatches    []string        `json:"b.header-match"`
+	ProductionAddHeaders      []string        `json:"a.add-header"`
+	AlternateAddHeaders       []string        `json:"b.add-header"`
+	StripResponseHeaders      *string         `json:"strip-response-headers"`
+	SetResponseHeaders        []string        `json:"set-response-headers"`
+	AlternateUASuffix         *string         `json:"b.ua-suffix"`
+	AlternateInclude          *string         `json:"b.include"`
+	AlternateExclude          *string         `json:"b.exclude"`
+	AlternateWorkers          *int            `json:"b.workers"`
+	AlternateQueueSize        *int            `json:"b.queue-size"`
+	AlternateServePercent     *float64        `json:"b.serve-percent"`
+	AlternateMaxConcurrency   *int            `json:"b.max-concurrency"`
+	MaxBodyBytes              *int64          `json:"max-body-bytes"`
+	MaxBodyAction             *string         `json:"max-body-action"`
+	AlternateNoBody           *bool           `json:"b.no-body"`
+	StreamBodies              *bool           `json:"stream-bodies"`
+	StreamBuffer              *int            `json:"stream-buffer"`
+	BreakerThreshold          *int            `json:"b.breaker-threshold"`
+	BreakerWindow             *string         `json:"b.breaker-window"`
+	BreakerCooldown           *string         `json:"b.breaker-cooldown"`
+	AlternateMethodMap        *string         `json:"b.method-map"`
+	IgnoreMethods             *string         `json:"ignore-methods"`
+	AlternateMethods          *string         `json:"b.methods"`
+	ReadHeaderTimeout         *timeoutSetting `json:"read-header-timeout"`
+	ReadTimeout               *timeoutSetting `json:"read-timeout"`
+	WriteTimeout              *timeoutSetting `json:"write-timeout"`
+	ShutdownTimeout           *timeoutSetting `json:"shutdown-timeout"`
+	MetricsListen             *string         `json:"metrics-listen"`
+	AdminListen               *string         `json:"admin-listen"`
+	AdminToken                *string         `json:"admin-token"`
+	HealthListen              *string         `json:"health-listen"`
+	PprofListen               *string         `json:"pprof-listen"`
+	HealthProbePath           *string         `json:"health-probe-path"`
+	HealthInterval            *string         `json:"health-interval"`
+	HealthTimeout             *timeoutSetting `json:"health-timeout"`
+	ProductionHealthInterval  *string         `json:"a.health-interval"`
+	ProductionHealthThreshold *int            `json:"a.health-threshold"`
+}
+
+// loadConfig reads a JSON or, for .yaml and .yml files, YAML config file.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+
+	config := &Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) {
+			return nil, fmt.Errorf("field %q: expected %v but found %v", typeError.Field, typeError.Type, typeError.Value)
+		}
+		return nil, err
+	}
+	return config, config.Validate()
+}
+
+// Validate checks the values that the flags themselves would accept but
+// teeproxy cannot work with.
+func (c *Config) Validate() error {
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		timeout, ok := value.Field(i).Interface().(*timeoutSetting)
+		if !ok || timeout == nil {
+			continue
+		}
+		if _, err := parseTimeout(string(*timeout)); err != nil {
+			return fmt.Errorf("field %q: %s", value.Type().Field(i).Tag.Get("json"), err)
+		}
+	}
+	if c.Percent != nil && (*c.Percent < 0 || *c.Percent > 100) {
+		return fmt.Errorf("field %q: must be between 0 and 100, but is %v", "p", *c.Percent)
+	}
+	if c.ProductionTimeout != nil && c.ProductionTimeout.Duration() <= 0 {
+		return fmt.Errorf("field %q: must be positive, but is %v", "a.timeout", *c.ProductionTimeout)
+	}
+	if c.AlternateTimeout != nil && c.AlternateTimeout.Duration() <= 0 {
+		return fmt.Errorf("field %q: must be positive, but is %v", "b.timeout", *c.AlternateTimeout)
+	}
+	if len(c.TLSPrivateKeys) != len(c.TLSCertificates) {
+		return fmt.Errorf("fields %q and %q: must be given together", "key.file", "cert.file")
+	}
+	return nil
+}
+
+// timeoutSetting is a timeout in the config, given like its flag as a
+// duration string or as a number of milliseconds. Validate checks that it
+// parses.
+type timeoutSetting string
+
+func (s *timeoutSetting) UnmarshalJSON(data []byte) error {
+	// A number is taken as it is written, so that 2500 stays 2500.
+	setting := string(data)
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		if err := json.Unmarshal(data, &setting); err != nil {
+			return err
+		}
+	}
+	*s = timeoutSetting(setting)
+	return nil
+}
+
+// Duration returns the timeout, 0 if it does not parse.
+func (s timeoutSetting) Duration() time.Duration {
+	timeout, _ := parseTimeout(string(s))
+	return timeout
+}
+
+// stringOrList is a list of strings in the config, which may also be given
+// as a single string, as for flags that became repeatable.
+type stringOrList []string
+
+func (l *stringOrList) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*l = stringOrList{value}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// Apply sets the flags of flags to the values of the config, except for the
+// ones given on the command line, which take precedence.
+func (c *Config) Apply(flags *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("json")
+		field := value.Field(i)
+		if field.IsNil() || explicit[name] {
+			continue
+		}
+		settings := []string{}
+		if field.Kind() == reflect.Slice {
+			// Repeatable flags get one Set per entry.
+			settings = field.Convert(reflect.TypeOf(settings)).Interface().([]string)
+		} else {
+			settings = append(settings, fmt.Sprint(field.Elem().Interface()))
+		}
+		for _, setting := range settings {
+			if err := flags.Set(name, setting); err != nil {
+				return fmt.Errorf("field %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// yamlToJSON converts the subset of YAML used for config files to JSON: a
+// flat mapping of keys to scalars or to lists of scalars, written either as
+// "[a, b]" or as "- a" items on the following lines.
+func yamlToJSON(data []byte) ([]byte, error) {
+	mapping := make(map[string]interface{})
+	var listKey string
+	for number, line := range strings.Split(string(data), "\n") {
+		line = stripYAMLComment(line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") && listKey != "" {
+			list, _ := mapping[listKey].([]interface{})
+			mapping[listKey] = append(list, yamlScalar(strings.TrimPrefix(trimmed, "- ")))
+			continue
+		}
+		colon := strings.Index(trimmed, ":")
+		if colon <= 0 || line != strings.TrimLeft(line, " \t") {
+			return nil, fmt.Errorf("line %d: expected \"key: value\", but found %q", number+1, trimmed)
+		}
+		key, rest := strings.TrimSpace(trimmed[:colon]), strings.TrimSpace(trimmed[colon+1:])
+		listKey = ""
+		switch {
+		case rest == "":
+			listKey = key
+			mapping[key] = []interface{}{}
+		case strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]"):
+			list := []interface{}{}
+			for _, item := range splitList(rest[1 : len(rest)-1]) {
+				list = append(list, yamlScalar(item))
+			}
+			mapping[key] = list
+		default:
+			mapping[key] = yamlScalar(rest)
+		}
+	}
+	return json.Marshal(mapping)
+}
+
+// stripYAMLComment removes a " #" comment from line, unless the '#' is in a
+// quoted value. As in YAML, only a quote that starts a value opens one, so
+// the apostrophe of "it's" does not.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[,", line[i-1]) >= 0):
+			quote = c
+		case c == '#' && i > 0 && (line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i-1]
+		}
+	}
+	return line
+}
+
+// yamlScalar converts an unquoted YAML boolean or number to its JSON type.
+func yamlScalar(value string) interface{} {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	switch value {
+	case "true", "false":
+		return value == "true"
+	case "null", "~":
+		return nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return value
+}
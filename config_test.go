@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "teeproxy.json", `{"a": "prod:80", "b": ["alt1:80", "alt2:80"], "a.timeout": 500, "p": 12.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(config.TargetProduction, ",") != "prod:80" || len(config.AltTargets) != 2 || *config.ProductionTimeout != "500" || *config.Percent != 12.5 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "teeproxy.yaml", `
+# production
+a: "prod:80"
+b:
+  - alt1:80
+  - alt2:80
+a.timeout: 500
+a.rewrite: true
+p: 12.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(config.TargetProduction, ",") != "prod:80" || strings.Join(config.AltTargets, ",") != "alt1:80,alt2:80" ||
+		*config.ProductionTimeout != "500" || !*config.ProductionHostRewrite || *config.Percent != 12.5 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+}
+
+func TestYAMLCommentsSkipQuotedValues(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "teeproxy.yaml", `
+a.add-header:
+  - "X-Tag: build #1" # the release
+  - 'X-Note: it is #2'
+b.add-header: [X-Owner: it's mine] # not #3
+p: 12.5 # percent
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers := strings.Join(config.ProductionAddHeaders, "|"); headers != "X-Tag: build #1|X-Note: it is #2" {
+		t.Errorf("Expected the quoted '#' to be kept, but received '%s'", headers)
+	}
+	if headers := strings.Join(config.AlternateAddHeaders, "|"); headers != "X-Owner: it's mine" || *config.Percent != 12.5 {
+		t.Errorf("Expected the comments to be stripped, but received '%s' and %v", headers, *config.Percent)
+	}
+}
+
+func TestConfigTimeoutsTakeBothForms(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "teeproxy.json", `{"a.timeout": "2s", "b.timeout": 750, "health-timeout": "500ms"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ProductionTimeout.Duration() != 2*time.Second || config.AlternateTimeout.Duration() != 750*time.Millisecond || config.HealthTimeout.Duration() != 500*time.Millisecond {
+		t.Errorf("Unexpected timeouts %v, %v and %v", *config.ProductionTimeout, *config.AlternateTimeout, *config.HealthTimeout)
+	}
+}
+
+func TestInvalidConfigNamesField(t *testing.T) {
+	for content, expectation := range map[string]string{
+		`{"a.timeout": "fast"}`: `field "a.timeout"`,
+		`{"p": 150}`:            `field "p"`,
+		`{"a.timout": 5}`:       `"a.timout"`,
+	} {
+		_, err := loadConfig(writeConfig(t, "teeproxy.json", content))
+		if err == nil || !strings.Contains(err.Error(), expectation) {
+			t.Errorf("Expected an error mentioning '%s' for %s, but received '%v'", expectation, content, err)
+		}
+	}
+}
+
+func TestFlagsOverrideConfig(t *testing.T) {
+	flags := flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+	production := flags.String("a", "localhost:8080", "")
+	timeout := flags.Int("a.timeout", 2500, "")
+	if err := flags.Parse([]string{"-a", "cli:80"}); err != nil {
+		t.Fatal(err)
+	}
+	address, milliseconds := "file:80", timeoutSetting("500")
+	config := &Config{TargetProduction: stringOrList{address}, ProductionTimeout: &milliseconds}
+	if err := config.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *production != "cli:80" {
+		t.Errorf("Expected '%s', but received '%s'", "cli:80", *production)
+	}
+	if *timeout != 500 {
+		t.Errorf("Expected %d, but received %d", 500, *timeout)
+	}
+}
+
+func TestSingleCertificateInConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, "teeproxy.json", `{"cert.file": "server.crt", "key.file": ["server.key"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.TLSCertificates) != 1 || config.TLSCertificates[0] != "server.crt" || len(config.TLSPrivateKeys) != 1 {
+		t.Errorf("Expected one certificate and key, but received %v and %v", config.TLSCertificates, config.TLSPrivateKeys)
+	}
+
+	flags := flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+	certificates := &stringList{}
+	flags.Var(certificates, "cert.file", "")
+	flags.Var(&stringList{}, "key.file", "")
+	if err := config.Apply(flags); err != nil {
+		t.Fatal(err)
+	}
+	if certificates.String() != "server.crt" {
+		t.Errorf("Expected '%s', but received '%s'", "server.crt", certificates)
+	}
+}
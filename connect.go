@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveConnect tunnels a CONNECT request of a client that uses teeproxy as
+// a forward proxy: it connects to the host:port the request names, answers
+// 200 and copies bytes in both directions until either side closes. The
+// tunnel bypasses production and the alternates alike, since its bytes,
+// usually TLS, cannot be duplicated. Without -allow-connect, CONNECT is
+// refused.
+func serveConnect(w http.ResponseWriter, req *http.Request) {
+	if !*allowConnect {
+		http.Error(w, "CONNECT is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+
+	dialer := &net.Dialer{Timeout: *productionTimeout}
+	upstream, err := dialer.DialContext(req.Context(), "tcp", req.Host)
+	if err != nil {
+		log.Printf("[%v] CONNECT to %v failed: [%v]", "X", req.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("[%v] CONNECT to %v failed: [%v]", "X", req.Host, err)
+		return
+	}
+	defer client.Close()
+	// The tunnel may stay open for longer than -read-timeout and
+	// -write-timeout.
+	client.SetDeadline(time.Time{})
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if *debug {
+		log.Printf("[%v] %v Tunneling %v to %v", "X", time.Now().UTC(), req.RemoteAddr, req.Host)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Bytes the client sent after the request may already be buffered.
+		io.Copy(upstream, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
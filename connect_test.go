@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// connectThrough sends a CONNECT request for target to proxy, and returns
+// the connection and the response.
+func connectThrough(t *testing.T, proxy *httptest.Server, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestConnectIsTunneled(t *testing.T) {
+	defer func(enabled bool) { *allowConnect = enabled }(*allowConnect)
+	*allowConnect = true
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}
+	}()
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	proxy := httptest.NewServer(newTestHandler(production, alternate))
+	defer proxy.Close()
+
+	conn, reader, resp := connectThrough(t, proxy, echo.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, but received %d", http.StatusOK, resp.StatusCode)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Errorf("Expected the echo 'hello', but received '%s' (%v)", line, err)
+	}
+	if requests := len(production.Requests()) + len(alternate.Requests()); requests != 0 {
+		t.Errorf("Expected no requests to the backends, but received %d", requests)
+	}
+}
+
+func TestConnectIsRefusedByDefault(t *testing.T) {
+	proxy := httptest.NewServer(newTestHandlerFor(closedAddress(t)))
+	defer proxy.Close()
+
+	if _, _, resp := connectThrough(t, proxy, "example.com:443"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, but received %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
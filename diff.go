@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// capturedResponse is the part of a backend response compared in diff mode.
+// A nil *capturedResponse stands for a backend that did not answer at all.
+type capturedResponse struct {
+	Origin    string
+	Status    int
+	Header    http.Header
+	Body      bytes.Buffer
+	Truncated bool
+}
+
+func newCapturedResponse(origin string, response *http.Response) *capturedResponse {
+	return &capturedResponse{
+		Origin: origin,
+		Status: response.StatusCode,
+		Header: response.Header,
+	}
+}
+
+// Write buffers up to diffMaxBody bytes and silently drops the rest, so it
+// can sit next to the client in an io.MultiWriter.
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	if room := *diffMaxBody - c.Body.Len(); len(p) > room {
+		c.Body.Write(p[:room])
+		c.Truncated = true
+	} else {
+		c.Body.Write(p)
+	}
+	return len(p), nil
+}
+
+// alternateResult is what an alternate request sends to the comparison: its
+// origin, and its captured response, nil if the request failed.
+type alternateResult struct {
+	Origin   string
+	Response *capturedResponse
+}
+
+// diffWait returns how long the comparison waits for the alternates: the
+// alternate timeout, plus the time -b.lag, -b.delay-max or -b.delay-min and
+// delay faults hold them back on purpose.
+func diffWait() time.Duration {
+	wait := *alternateTimeout + *alternateLag + max(*alternateDelayMin, *alternateDelayMax)
+	if *alternateFaultRate > 0 && *alternateFaultType == "delay" {
+		wait += *alternateFaultDelay
+	}
+	return wait
+}
+
+// captureResponse reads the capped body of response. The caller still owns
+// response and has to close its body.
+func captureResponse(origin string, response *http.Response) *capturedResponse {
+	if response == nil {
+		return nil
+	}
+	captured := newCapturedResponse(origin, response)
+	io.Copy(captured, response.Body)
+	return captured
+}
+
+// compareResponses waits for count alternate results and logs how each one
+// differs from production. Alternates that do not answer within diffWait
+// are skipped. The ones that differ are saved to mismatches, with the body
+// of req from getBody.
+func compareResponses(req *http.Request, getBody func() (io.ReadCloser, error), production *capturedResponse, alternates <-chan alternateResult, count int, mismatches *mismatchStore) {
+	timeout := time.After(diffWait())
+	headers := splitList(*diffHeaders)
+	differing := make(map[string]*capturedResponse)
+	defer func() { mismatches.Save(req, getBody, production, differing) }()
+	for i := 0; i < count; i++ {
+		select {
+		case alternate := <-alternates:
+			if differences := diffCapturedResponses(production, alternate.Response, headers); len(differences) > 0 {
+				log.Printf("[%v] %v DIFF %v %v %v", alternate.Origin, time.Now().UTC(), req.Method, req.RequestURI, strings.Join(differences, " "))
+				differing[alternate.Origin] = alternate.Response
+			}
+		case <-timeout:
+			if *debug {
+				log.Printf("[%v] %v Gave up waiting for %d alternate response(s) to diff", "X", time.Now().UTC(), count-i)
+			}
+			return
+		}
+	}
+}
+
+// diffCapturedResponses lists the differences between production and
+// alternate as key=production/alternate pairs. Only the given headers are
+// compared.
+func diffCapturedResponses(production, alternate *capturedResponse, headers []string) []string {
+	if alternate == nil {
+		return []string{"response=ok/failed"}
+	}
+	var differences []string
+	if production.Status != alternate.Status {
+		differences = append(differences, fmt.Sprintf("status=%d/%d", production.Status, alternate.Status))
+	}
+	for _, header := range headers {
+		a, b := production.Header.Get(header), alternate.Header.Get(header)
+		if a != b {
+			differences = append(differences, fmt.Sprintf("header.%s=%q/%q", http.CanonicalHeaderKey(header), a, b))
+		}
+	}
+	a, errA := production.DecodedBody()
+	b, errB := alternate.DecodedBody()
+	if errA != nil || errB != nil {
+		log.Printf("[%v] %v Not comparing bodies: %v", alternate.Origin, time.Now().UTC(), errors.Join(errA, errB))
+		return differences
+	}
+	if !bytes.Equal(a, b) {
+		difference := fmt.Sprintf("body=%d/%d", len(a), len(b))
+		if production.Truncated || alternate.Truncated {
+			difference += "(truncated)"
+		}
+		differences = append(differences, difference)
+	}
+	return differences
+}
+
+// DecodedBody returns the captured body with its Content-Encoding, gzip or
+// deflate, undone, and capped at diffMaxBody bytes. A truncated body is
+// decoded as far as it goes.
+func (c *capturedResponse) DecodedBody() ([]byte, error) {
+	var decoder io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(c.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return c.Body.Bytes(), nil
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(c.Body.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s body of %s: %s", encoding, c.Origin, err)
+		}
+		decoder = reader
+	case "deflate":
+		// Servers send deflate both with and without the zlib wrapper.
+		if reader, err := zlib.NewReader(bytes.NewReader(c.Body.Bytes())); err == nil {
+			decoder = reader
+		} else {
+			decoder = flate.NewReader(bytes.NewReader(c.Body.Bytes()))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q of %s", encoding, c.Origin)
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(decoder, int64(*diffMaxBody)))
+	if err != nil && !(c.Truncated && err == io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("invalid %s body of %s: %s", c.Header.Get("Content-Encoding"), c.Origin, err)
+	}
+	return decoded, nil
+}
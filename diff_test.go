@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffIdenticalResponses(t *testing.T) {
+	production := &capturedResponse{Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+	production.Write([]byte("hello"))
+	alternate := &capturedResponse{Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+	alternate.Write([]byte("hello"))
+	if differences := diffCapturedResponses(production, alternate, []string{"content-type"}); len(differences) != 0 {
+		t.Errorf("Expected no differences, but received '%s'", differences)
+	}
+}
+
+func TestDiffDifferentResponses(t *testing.T) {
+	production := &capturedResponse{Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+	production.Write([]byte("hello"))
+	alternate := &capturedResponse{Status: 500, Header: http.Header{"Content-Type": {"text/html"}}}
+	alternate.Write([]byte("oops!!"))
+	differences := strings.Join(diffCapturedResponses(production, alternate, []string{"Content-Type"}), " ")
+	if expectation := `status=200/500 header.Content-Type="text/plain"/"text/html" body=5/6`; differences != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, differences)
+	}
+}
+
+func TestDiffMissingAlternate(t *testing.T) {
+	production := &capturedResponse{Status: 200}
+	differences := strings.Join(diffCapturedResponses(production, nil, nil), " ")
+	if expectation := "response=ok/failed"; differences != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, differences)
+	}
+}
+
+func TestDiffOfEveryAlternateCarriesItsOrigin(t *testing.T) {
+	output := captureLog(t)
+	alternates := make(chan alternateResult, 2)
+	alternates <- alternateResult{Origin: "B2", Response: capturedBody("B2", "second")}
+	alternates <- alternateResult{Origin: "B1", Response: capturedBody("B1", "first!")}
+	compareResponses(httptest.NewRequest("GET", "/path", nil), nil, capturedBody("A", "production"), alternates, 2, nil)
+
+	for _, expectation := range []string{"[B1] ", "[B2] "} {
+		if !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected a DIFF line starting with '%s', but received '%s'", expectation, output)
+		}
+	}
+	if lines := strings.Count(output.String(), " DIFF GET /path body=10/6"); lines != 2 {
+		t.Errorf("Expected 2 DIFF lines, but received %d in '%s'", lines, output)
+	}
+}
+
+func TestDiffWaitsForLaggingAlternates(t *testing.T) {
+	defer func(timeout, lag time.Duration) { *alternateTimeout, *alternateLag = timeout, lag }(*alternateTimeout, *alternateLag)
+	*alternateTimeout, *alternateLag = 50*time.Millisecond, 200*time.Millisecond
+	output := captureLog(t)
+	alternates := make(chan alternateResult, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		alternates <- alternateResult{Origin: "B", Response: capturedBody("B", "late")}
+	}()
+	compareResponses(httptest.NewRequest("GET", "/path", nil), nil, capturedBody("A", "production"), alternates, 1, nil)
+
+	if expectation := "[B] "; !strings.Contains(output.String(), expectation) || strings.Contains(output.String(), "Gave up") {
+		t.Errorf("Expected the lagging alternate to be diffed, but received '%s'", output)
+	}
+}
+
+func TestCapturedBodyIsCapped(t *testing.T) {
+	defer func(max int) { *diffMaxBody = max }(*diffMaxBody)
+	*diffMaxBody = 4
+	captured := &capturedResponse{}
+	if n, err := captured.Write([]byte("hello world")); n != 11 || err != nil {
+		t.Errorf("Expected the whole write to be accepted, but received %d, %v", n, err)
+	}
+	if expectation := "hell"; captured.Body.String() != expectation || !captured.Truncated {
+		t.Errorf("Expected truncated '%s', but received '%s'", expectation, captured.Body.String())
+	}
+}
+
+// encodedResponse returns a captured response with body compressed by
+// encoding, gzip or deflate.
+func encodedResponse(t *testing.T, encoding, body string) *capturedResponse {
+	captured := &capturedResponse{Status: 200, Header: http.Header{"Content-Encoding": {encoding}}}
+	var writer io.WriteCloser = gzip.NewWriter(captured)
+	if encoding == "deflate" {
+		writer = zlib.NewWriter(captured)
+	}
+	if _, err := io.WriteString(writer, body); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	return captured
+}
+
+func TestDiffDecodesBodies(t *testing.T) {
+	output := captureLog(t)
+	plain := &capturedResponse{Status: 200}
+	plain.Write([]byte("hello"))
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if differences := diffCapturedResponses(encodedResponse(t, encoding, "hello"), plain, nil); len(differences) != 0 {
+			t.Errorf("Expected no differences for %s, but received '%s'", encoding, differences)
+		}
+		differences := strings.Join(diffCapturedResponses(encodedResponse(t, encoding, "hello"), encodedResponse(t, encoding, "oops!!"), nil), " ")
+		if expectation := "body=5/6"; differences != expectation {
+			t.Errorf("Expected '%s' for %s, but received '%s'", expectation, encoding, differences)
+		}
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected no notes, but received '%s'", output.String())
+	}
+}
+
+func TestDiffSkipsUnknownEncoding(t *testing.T) {
+	output := captureLog(t)
+	production := &capturedResponse{Status: 200, Header: http.Header{"Content-Encoding": {"br"}}}
+	production.Write([]byte("compressed"))
+	alternate := &capturedResponse{Origin: "B", Status: 200}
+	alternate.Write([]byte("hello"))
+
+	if differences := diffCapturedResponses(production, alternate, nil); len(differences) != 0 {
+		t.Errorf("Expected no differences, but received '%s'", differences)
+	}
+	if expectation := `Not comparing bodies: unsupported Content-Encoding "br"`; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+	}
+}
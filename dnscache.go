@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsRefreshTimeout bounds a background refresh of a cached host.
+const dnsRefreshTimeout = 5 * time.Second
+
+// backendDNS caches the addresses of backend host names for the dialers, if
+// -dns-cache-ttl is set.
+var backendDNS *dnsCache
+
+// dnsCache resolves host names at most once per TTL. An expired entry is
+// still used while it is refreshed in the background, and kept for another
+// TTL if the refresh fails, so that a short resolver outage does not fail
+// any request. A nil *dnsCache resolves nothing.
+type dnsCache struct {
+	TTL    time.Duration
+	Lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addresses  []string
+	expires    time.Time
+	refreshing bool
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		TTL:     ttl,
+		Lookup:  net.DefaultResolver.LookupHost,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// LookupHost returns the addresses of host, from the cache if it has them.
+func (c *dnsCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	if entry := c.entries[host]; entry != nil {
+		if time.Now().After(entry.expires) && !entry.refreshing {
+			entry.refreshing = true
+			go c.refresh(host)
+		}
+		addresses := entry.addresses
+		c.mu.Unlock()
+		return addresses, nil
+	}
+	c.mu.Unlock()
+
+	addresses, err := c.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = &dnsEntry{addresses: addresses, expires: time.Now().Add(c.TTL)}
+	return addresses, nil
+}
+
+func (c *dnsCache) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+	defer cancel()
+	addresses, err := c.Lookup(ctx, host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[host]
+	if err == nil {
+		entry.addresses = addresses
+	} else if *debug {
+		log.Printf("[%v] %v Failed to refresh %s, keeping %v: %v", "X", time.Now().UTC(), host, entry.addresses, err)
+	}
+	entry.expires = time.Now().Add(c.TTL)
+	entry.refreshing = false
+}
+
+// Dialer wraps dial, which dials as net.Dialer does, to connect to the
+// cached addresses of the host, one after the other until one answers. IP
+// addresses and Unix sockets are dialed directly.
+func (c *dnsCache) Dialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if c == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if _, ok := unixSocketPath(address); ok || err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+		addresses, err := c.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addresses {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups with its addresses, or its error, and counts
+// them.
+type fakeResolver struct {
+	mu        sync.Mutex
+	addresses []string
+	err       error
+	lookups   int
+}
+
+func (r *fakeResolver) Lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addresses, r.err
+}
+
+func (r *fakeResolver) Set(addresses []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addresses, r.err = addresses, err
+}
+
+func (r *fakeResolver) Lookups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// lookupEventually looks up host until it gets expectation, or fails.
+func lookupEventually(t *testing.T, cache *dnsCache, host string, expectation []string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		addresses, err := cache.LookupHost(context.Background(), host)
+		if err == nil && reflect.DeepEqual(addresses, expectation) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v, but received %v: %v", expectation, addresses, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDNSCacheHitAndExpiry(t *testing.T) {
+	resolver := &fakeResolver{addresses: []string{"192.0.2.1"}}
+	cache := newDNSCache(50 * time.Millisecond)
+	cache.Lookup = resolver.Lookup
+
+	for i := 0; i < 3; i++ {
+		lookupEventually(t, cache, "backend.example", []string{"192.0.2.1"})
+	}
+	if lookups := resolver.Lookups(); lookups != 1 {
+		t.Errorf("Expected 1 lookup within the TTL, but received %d", lookups)
+	}
+
+	resolver.Set([]string{"192.0.2.2"}, nil)
+	time.Sleep(60 * time.Millisecond)
+	// The expired entry is served while it is refreshed.
+	if addresses, _ := cache.LookupHost(context.Background(), "backend.example"); !reflect.DeepEqual(addresses, []string{"192.0.2.1"}) {
+		t.Errorf("Expected the stale address during the refresh, but received %v", addresses)
+	}
+	lookupEventually(t, cache, "backend.example", []string{"192.0.2.2"})
+	if lookups := resolver.Lookups(); lookups != 2 {
+		t.Errorf("Expected 2 lookups after the TTL, but received %d", lookups)
+	}
+}
+
+func TestDNSCacheKeepsAddressesOnFailure(t *testing.T) {
+	resolver := &fakeResolver{addresses: []string{"192.0.2.1"}}
+	cache := newDNSCache(20 * time.Millisecond)
+	cache.Lookup = resolver.Lookup
+	lookupEventually(t, cache, "backend.example", []string{"192.0.2.1"})
+
+	resolver.Set(nil, errors.New("resolver down"))
+	time.Sleep(30 * time.Millisecond)
+	cache.LookupHost(context.Background(), "backend.example")
+	for resolver.Lookups() < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	lookupEventually(t, cache, "backend.example", []string{"192.0.2.1"})
+
+	if _, err := cache.LookupHost(context.Background(), "other.example"); err == nil {
+		t.Errorf("Expected an error for a host that never resolved")
+	}
+}
+
+func TestDNSCacheDialer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	// The backend only listens on the second address.
+	resolver := &fakeResolver{addresses: []string{"127.0.0.2", "127.0.0.1"}}
+	cache := newDNSCache(time.Minute)
+	cache.Lookup = resolver.Lookup
+	var dialed []string
+	dial := cache.Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	for _, address := range []string{net.JoinHostPort("backend.example", port), backend.Listener.Addr().String()} {
+		conn, err := dial(context.Background(), "tcp", address)
+		if err != nil {
+			t.Fatalf("Expected to connect to %s, but received %v", address, err)
+		}
+		conn.Close()
+	}
+	if expectation := []string{"127.0.0.2:" + port, "127.0.0.1:" + port, "127.0.0.1:" + port}; !reflect.DeepEqual(dialed, expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, dialed)
+	}
+	if lookups := resolver.Lookups(); lookups != 1 {
+		t.Errorf("Expected 1 lookup, but received %d", lookups)
+	}
+}
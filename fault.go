@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// alternateFault draws whether an alternate request gets the fault of
+// -b.fault-type, at -b.fault-rate percent. It returns "" for none.
+func (h *handler) alternateFault() string {
+	if *alternateFaultRate <= 0 || h.Randomizer.Float64()*100 >= *alternateFaultRate {
+		return ""
+	}
+	return *alternateFaultType
+}
+
+// injectFault makes request to the alternate site misbehave as fault says:
+// with "abort", the request is canceled as soon as it has been written, so
+// that the alternate sees its client go away before it can answer; with
+// "delay", it is sent -b.fault-delay late. The returned function releases
+// the request.
+func injectFault(origin string, request *http.Request, fault string) (*http.Request, context.CancelFunc) {
+	if fault == "" {
+		return request, func() {}
+	}
+	if *debug {
+		log.Printf("[%v] %v Injecting a %s fault into %v %v", origin, time.Now().UTC(), fault, request.Method, request.URL)
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	switch fault {
+	case "abort":
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) { cancel() },
+		})
+	case "delay":
+		time.Sleep(*alternateFaultDelay)
+	}
+	return request.WithContext(ctx), cancel
+}
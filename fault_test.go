@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAbortFault(t *testing.T) {
+	defer func(rate float64, fault string) { *alternateFaultRate, *alternateFaultType = rate, fault }(*alternateFaultRate, *alternateFaultType)
+	*alternateFaultRate, *alternateFaultType = 100, "abort"
+	aborted := make(chan bool, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		select {
+		case <-req.Context().Done():
+			aborted <- true
+		case <-time.After(2 * time.Second):
+			aborted <- false
+		}
+	}))
+	defer alternate.Close()
+	production := newTestBackend(t, http.StatusOK, "production")
+	h := newTestHandlerFor(production.Address(), strings.TrimPrefix(alternate.URL, "http://"))
+
+	recorder := serve(t, h, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "production" {
+		t.Errorf("Expected production to be untouched, but received %d '%s'", recorder.Code, recorder.Body.String())
+	}
+	if !<-aborted {
+		t.Errorf("Expected the alternate request to be aborted")
+	}
+	if bodies := production.Bodies(); len(bodies) != 1 || bodies[0] != "body" {
+		t.Errorf("Expected the body on production, but received %q", bodies)
+	}
+}
+
+func TestDelayFault(t *testing.T) {
+	defer func(rate float64, fault string, delay time.Duration) {
+		*alternateFaultRate, *alternateFaultType, *alternateFaultDelay = rate, fault, delay
+	}(*alternateFaultRate, *alternateFaultType, *alternateFaultDelay)
+	*alternateFaultRate, *alternateFaultType, *alternateFaultDelay = 100, "delay", 150*time.Millisecond
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected production not to be delayed, but took %v", elapsed)
+	}
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the alternate to be delayed by %v, but took %v", *alternateFaultDelay, elapsed)
+	}
+	if requests := alternate.Requests(); len(requests) != 2 {
+		t.Errorf("Expected 2 delayed requests to the alternate, but received %d", len(requests))
+	}
+}
+
+func TestFaultRate(t *testing.T) {
+	defer func(rate float64) { *alternateFaultRate = rate }(*alternateFaultRate)
+	h := newTestHandlerFor("localhost:0")
+	for rate, bounds := range map[float64][2]int{0: {0, 0}, 30: {200, 400}, 100: {1000, 1000}} {
+		*alternateFaultRate = rate
+		faults := 0
+		for i := 0; i < 1000; i++ {
+			if h.alternateFault() != "" {
+				faults++
+			}
+		}
+		if faults < bounds[0] || faults > bounds[1] {
+			t.Errorf("Expected %d to %d faults of 1000 at %v%%, but received %d", bounds[0], bounds[1], rate, faults)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedProtoHost(t *testing.T) {
+	for proto, state := range map[string]*tls.ConnectionState{"http": nil, "https": {}} {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Host = "example.com"
+		request.TLS = state
+		insertXForwardedProtoHost(request, false)
+		if value := request.Header.Get("X-Forwarded-Proto"); value != proto {
+			t.Errorf("Expected '%s', but received '%s'", proto, value)
+		}
+		if value := request.Header.Get("X-Forwarded-Host"); value != "example.com" {
+			t.Errorf("Expected '%s', but received '%s'", "example.com", value)
+		}
+	}
+}
+
+func TestForwardedProtoHostOfClientIsReplaced(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "example.com"
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "admin.example.com")
+	insertXForwardedProtoHost(request, false)
+	if value := request.Header.Get("X-Forwarded-Proto"); value != "http" {
+		t.Errorf("Expected '%s', but received '%s'", "http", value)
+	}
+	if values := request.Header.Values("X-Forwarded-Host"); len(values) != 1 || values[0] != "example.com" {
+		t.Errorf("Expected '%s', but received %q", "example.com", values)
+	}
+}
+
+func TestForwardedProtoHostOfTrustedProxyIsKept(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-Forwarded-Proto", "https")
+	request.Header.Set("X-Forwarded-Host", "public.example.com")
+	insertXForwardedProtoHost(request, true)
+	if value := request.Header.Get("X-Forwarded-Proto"); value != "https" {
+		t.Errorf("Expected '%s', but received '%s'", "https", value)
+	}
+	if value := request.Header.Get("X-Forwarded-Host"); value != "public.example.com" {
+		t.Errorf("Expected '%s', but received '%s'", "public.example.com", value)
+	}
+}
+
+func TestForwardedHostIsSetBeforeRewrite(t *testing.T) {
+	defer func(enabled, rewrite bool) { *forwardProtoHost, *productionHostRewrite = enabled, rewrite }(*forwardProtoHost, *productionHostRewrite)
+	*forwardProtoHost, *productionHostRewrite = true, true
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "example.com"
+	request.TLS = &tls.ConnectionState{}
+	serve(t, h, request)
+	for origin, backend := range map[string]*testBackend{"A": production, "B": alternate} {
+		forwarded := backend.Requests()[0]
+		if forwarded.Header.Get("X-Forwarded-Host") != "example.com" || forwarded.Header.Get("X-Forwarded-Proto") != "https" {
+			t.Errorf("Expected %s to receive https://example.com, but received %s://%s", origin, forwarded.Header.Get("X-Forwarded-Proto"), forwarded.Header.Get("X-Forwarded-Host"))
+		}
+	}
+	if host := production.Requests()[0].Host; host != production.Address() {
+		t.Errorf("Expected the rewritten host '%s', but received '%s'", production.Address(), host)
+	}
+}
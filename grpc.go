@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isGRPC reports whether req is a gRPC call, with a content type of
+// application/grpc or application/grpc+proto and the like, but not gRPC-Web.
+func isGRPC(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	rest, ok := strings.CutPrefix(contentType, "application/grpc")
+	return ok && (rest == "" || rest[0] == '+' || rest[0] == ';')
+}
+
+// newGRPCTransport returns a transport that only speaks HTTP/2 to
+// production: over TLS with tlsConfig for https, whether from an https://
+// target or -a.https, and with prior knowledge for http. It has no deadline
+// beyond the response headers, since streaming calls may stay open for a
+// long time.
+func newGRPCTransport(timeout time.Duration, tlsConfig *tls.Config) *http.Transport {
+	transport := newTransport(timeout, tlsConfig, nil)
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// serveGRPC forwards the gRPC call req to production only. Messages are
+// streamed in both directions as they arrive, and the trailers carrying the
+// grpc-status are passed on. The call is never retried, since its body is
+// not buffered.
+func (h *handler) serveGRPC(w http.ResponseWriter, req *http.Request) {
+	// The client request itself stays as received, for the access log.
+	productionRequest := h.productionRequest(req.Clone(req.Context()), req)
+	backendSpan := h.Tracer.StartBackend(req, productionRequest, "A", h.productionTarget(req))
+	h.observeRequest("A", productionRequest)
+	startReq := time.Now()
+	logRequestHeaders("A", productionRequest)
+	resp, err := h.GRPCTransport.RoundTrip(productionRequest)
+	if err != nil {
+		log.Printf("[%v] Request failed: [%v]", "A", err)
+		resp = nil
+	}
+	logResponseHeaders("A", resp)
+	backendSpan.SetResponse(resp)
+	h.Tracer.End(backendSpan)
+	backendMetrics.Observe("A", resp, time.Since(startReq))
+	h.Stats.Observe("A", resp, time.Since(startReq))
+	h.Summary.Observe("A", resp, time.Since(startReq))
+	h.observeResponse("A", req, productionRequest, resp, time.Since(startReq))
+	if resp == nil {
+		productionError(w)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	filterResponseHeaders(w.Header())
+	w.WriteHeader(resp.StatusCode)
+	client := newFlushWriter(w)
+	// Clients of server streaming calls wait for the headers.
+	client.Flush()
+
+	if _, err := io.Copy(client, resp.Body); err != nil {
+		if *debug {
+			log.Printf("[%v] %v Failed to forward the response to %v: %v", "A", time.Now().UTC(), req.RemoteAddr, err)
+		}
+		return
+	}
+	forwardTrailers(w, resp)
+}
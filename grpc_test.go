@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcFrame frames message like gRPC: uncompressed, with its length.
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// grpcEcho answers every message of a call with the same message, as soon
+// as it arrives, like a bidirectional streaming echo service.
+var grpcEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(r.Body, header); err != nil {
+			break
+		}
+		message := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(r.Body, message); err != nil {
+			break
+		}
+		w.Write(grpcFrame(string(message)))
+		w.(http.Flusher).Flush()
+	}
+	w.Header().Set("Grpc-Status", "0")
+})
+
+// newGRPCEchoServer serves grpcEcho over HTTP/2 with prior knowledge.
+func newGRPCEchoServer(t *testing.T) *httptest.Server {
+	server := httptest.NewUnstartedServer(grpcEcho)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGRPCStreamsToProductionOnly(t *testing.T) {
+	production := newGRPCEchoServer(t)
+	alternate := newTestBackend(t, http.StatusOK, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, newTestHandlerFor(production.Listener.Addr().String(), alternate.Address()), listener)
+
+	client := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	client.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+	body, messages := io.Pipe()
+	req, _ := http.NewRequest("POST", "http://"+listener.Addr().String()+"/echo.Echo/Stream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	// Send the second message only after the echo of the first, which
+	// would hang if either direction were buffered.
+	go messages.Write(grpcFrame("first"))
+	response, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	for _, message := range []string{"first", "second"} {
+		echo := make([]byte, 5+len(message))
+		if _, err := io.ReadFull(response.Body, echo); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(echo, grpcFrame(message)) {
+			t.Errorf("Expected '%s', but received '%s'", message, echo[5:])
+		}
+		if message == "first" {
+			go messages.Write(grpcFrame("second"))
+		}
+	}
+	messages.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected the trailer '%s', but received '%s'", "0", status)
+	}
+	if requests := alternate.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no requests to the alternate, but received %d", len(requests))
+	}
+}
+
+func TestGRPCKeepsTheInboundRequest(t *testing.T) {
+	defer func(prefix string) { *productionPathPrefix = prefix }(*productionPathPrefix)
+	*productionPathPrefix = "/v1"
+	production := newGRPCEchoServer(t)
+	req := httptest.NewRequest("POST", "/echo.Echo/Unary", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	recorder := serve(t, newTestHandlerFor(production.Listener.Addr().String()), req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but received %d", http.StatusOK, recorder.Code)
+	}
+	if req.URL.Path != "/echo.Echo/Unary" || req.URL.Host != "" {
+		t.Errorf("Expected the inbound request to stay /echo.Echo/Unary, but received %s", req.URL)
+	}
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	production := httptest.NewUnstartedServer(grpcEcho)
+	production.EnableHTTP2 = true
+	production.StartTLS()
+	defer production.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(production.Certificate())
+	h, err := NewHandler(HandlerConfig{Production: production.URL, ProductionTLS: &tls.Config{RootCAs: roots}, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/echo.Echo/Unary", bytes.NewReader(grpcFrame("hello")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	recorder := serve(t, h, req)
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), grpcFrame("hello")) {
+		t.Errorf("Expected the echo of 'hello' over HTTP/2, but received %d with '%s'", recorder.Code, recorder.Body)
+	}
+}
+
+func TestGRPCIsNotDuplicated(t *testing.T) {
+	req := httptest.NewRequest("POST", "/echo.Echo/Unary", nil)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	if duplicate, reason := newTestHandlerFor("localhost:0", "localhost:1").routing(req); duplicate || reason != "grpc" {
+		t.Errorf("Expected '%s', but received '%s'", "grpc", reason)
+	}
+	req.Header.Set("Content-Type", "application/grpc-web")
+	if isGRPC(req) {
+		t.Errorf("Expected gRPC-Web to be forwarded like other requests")
+	}
+}
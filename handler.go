@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HandlerConfig is what NewHandler builds a handler from. main fills it in
+// from the flags with handlerConfigFromFlags; tests can fill in only what
+// they need. Settings that apply per request, like -diff or -p, are still
+// read from the flags by the handler.
+type HandlerConfig struct {
+	Production   string      // the default production target
+	Routes       []hostRoute // production targets by Host header
+	Alternatives []string
+	AltHosts     []string  // Host patterns of the Alternatives, empty for all hosts
+	Weights      []float64 // of the Alternatives; if set, each request goes to one of them
+
+	ProductionTimeout time.Duration // 0 for -a.timeout
+	AlternateTimeout  time.Duration // 0 for -b.timeout
+	ProductionTLS     *tls.Config   // nil for the defaults
+	AlternateTLS      *tls.Config
+	AltLocalAddr      net.IP // as in -b.local-addr, nil for any
+
+	AddHeaders    headerList
+	AltAddHeaders headerList
+	HeaderMatches []headerMatch
+	IgnoreMethods []string
+	Methods       []string // as in -b.methods, empty for all methods
+	MethodMap     string   // as in -b.method-map
+	SampleBy      string   // as in -sample-by
+	HashBy        string   // as in -b.hash-by
+	Include       string   // regular expression, as in -b.include
+	Exclude       string   // regular expression, as in -b.exclude
+	RewriteRules  string   // file, as in -rewrite-rules
+
+	RateLimit      float64 // requests per second, 0 for no limit
+	RateLimitBurst float64
+	RateLimitPerIP bool
+
+	BreakerThreshold int // 0 for no circuit breakers
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+
+	HealthInterval  time.Duration // of the production targets, 0 for none
+	HealthThreshold int
+	HealthPath      string        // as in -health-probe-path
+	HealthTimeout   time.Duration // 0 for -health-timeout
+
+	Workers        int // 0 for one goroutine per alternate request
+	QueueSize      int
+	MaxConcurrency int // 0 for no limit
+
+	RecordFile    string // empty for no record file
+	DiffDir       string // empty to only log differences
+	DiffMaxFiles  int
+	OTelEndpoint  string        // empty for no tracing
+	StatsInterval time.Duration // 0 for no stats
+	Summary       bool          // as in -summary-on-exit
+
+	RequestObservers  []RequestObserver
+	ResponseObservers []ResponseObserver // nil for the access log of -verbose
+
+	Seed int64 // of the Randomizer, 0 for the current time
+}
+
+// handlerConfigFromFlags returns the config of the handler given by the
+// flags, for the production target and routes parsed from -a.
+func handlerConfigFromFlags(production string, routes []hostRoute) HandlerConfig {
+	cfg := HandlerConfig{
+		Production:        production,
+		Routes:            routes,
+		Alternatives:      altTargets.targets,
+		AltHosts:          altTargets.Hosts(),
+		Weights:           altTargets.Weights(),
+		ProductionTimeout: *productionTimeout,
+		AlternateTimeout:  *alternateTimeout,
+		ProductionTLS:     productionTLSConfig,
+		AlternateTLS:      alternateTLSConfig,
+		AltLocalAddr:      net.ParseIP(*alternateLocalAddr),
+		AddHeaders:        productionAddHeaders,
+		AltAddHeaders:     alternateAddHeaders,
+		HeaderMatches:     *alternateHeaderMatches,
+		IgnoreMethods:     splitList(*ignoreMethods),
+		Methods:           splitList(*alternateMethods),
+		MethodMap:         *alternateMethodMap,
+		SampleBy:          *sampleByKey,
+		HashBy:            *alternateHashBy,
+		Include:           *alternateInclude,
+		Exclude:           *alternateExclude,
+		RewriteRules:      *rewriteRulesFile,
+		RateLimit:         *rateLimit,
+		RateLimitBurst:    *rateLimitBurst,
+		RateLimitPerIP:    *rateLimitPerIP,
+		BreakerThreshold:  *breakerThreshold,
+		BreakerWindow:     *breakerWindow,
+		BreakerCooldown:   *breakerCooldown,
+		HealthInterval:    *productionHealthInterval,
+		HealthThreshold:   *productionHealthThreshold,
+		HealthPath:        *healthProbePath,
+		HealthTimeout:     *healthTimeout,
+		Workers:           *alternateWorkers,
+		QueueSize:         *alternateQueueSize,
+		MaxConcurrency:    *alternateMaxConcurrency,
+		RecordFile:        *recordFile,
+		DiffMaxFiles:      *diffMaxFiles,
+		OTelEndpoint:      *otelEndpoint,
+		StatsInterval:     *statsInterval,
+		Summary:           *summaryOnExit,
+	}
+	if *diffResponses {
+		cfg.DiffDir = *diffDir
+	}
+	return cfg
+}
+
+// NewHandler returns a handler for cfg, with its background work, like the
+// stats and the recorder, started. Errors name the flag of the invalid
+// setting, and leave nothing running.
+func NewHandler(cfg HandlerConfig) (*handler, error) {
+	if cfg.ProductionTimeout == 0 {
+		cfg.ProductionTimeout = *productionTimeout
+	}
+	if cfg.AlternateTimeout == 0 {
+		cfg.AlternateTimeout = *alternateTimeout
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	h := &handler{
+		Target:         cfg.Production,
+		Routes:         cfg.Routes,
+		Alternatives:   cfg.Alternatives,
+		AltHosts:       cfg.AltHosts,
+		Weights:        cfg.Weights,
+		HashBy:         cfg.HashBy,
+		Randomizer:     newLockedRand(seed),
+		IgnoredMethods: make(map[string]bool),
+		HeaderMatches:  cfg.HeaderMatches,
+		AddHeaders:     cfg.AddHeaders,
+		AltAddHeaders:  cfg.AltAddHeaders,
+		Transport:      withDeadline(newTransport(cfg.ProductionTimeout, cfg.ProductionTLS, nil), cfg.ProductionTimeout),
+		AltTransport:   withDeadline(newTransport(cfg.AlternateTimeout, cfg.AlternateTLS, cfg.AltLocalAddr), cfg.AlternateTimeout),
+		GRPCTransport:  newGRPCTransport(cfg.ProductionTimeout, cfg.ProductionTLS),
+
+		RequestObservers:  cfg.RequestObservers,
+		ResponseObservers: cfg.ResponseObservers,
+	}
+	if h.ResponseObservers == nil {
+		h.ResponseObservers = []ResponseObserver{accessLogObserver{}}
+	}
+	// Like -b.method-map, the methods may be given in any case.
+	for _, method := range cfg.IgnoreMethods {
+		h.IgnoredMethods[strings.ToUpper(method)] = true
+	}
+	if len(cfg.Methods) > 0 {
+		h.AllowedMethods = make(map[string]bool)
+		for _, method := range cfg.Methods {
+			h.AllowedMethods[strings.ToUpper(method)] = true
+		}
+	}
+	if err := h.parseConfig(cfg); err != nil {
+		return nil, err
+	}
+	var err error
+	if cfg.DiffDir != "" {
+		if h.Mismatches, err = newMismatchStore(cfg.DiffDir, cfg.DiffMaxFiles); err != nil {
+			return nil, fmt.Errorf("-diff-dir %s: %s", cfg.DiffDir, err)
+		}
+	}
+	if cfg.RecordFile != "" {
+		// Last of the settings that can fail, so that no error leaves the
+		// file open.
+		file, err := os.OpenFile(cfg.RecordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("-record-file %s: %s", cfg.RecordFile, err)
+		}
+		h.Recorder = newRecorder(file)
+	}
+
+	if cfg.RateLimit > 0 {
+		h.RateLimiter = newRateLimiter(cfg.RateLimit, cfg.RateLimitBurst, cfg.RateLimitPerIP)
+	}
+	if cfg.BreakerThreshold > 0 {
+		h.Breakers = make(map[string]*circuitBreaker)
+		for i, alternative := range h.Alternatives {
+			h.Breakers[alternative] = newCircuitBreaker(alternateOrigin(i, len(h.Alternatives)), cfg.BreakerThreshold, cfg.BreakerWindow, cfg.BreakerCooldown)
+		}
+	}
+	if cfg.OTelEndpoint != "" {
+		h.Tracer = newTracer(cfg.OTelEndpoint)
+	}
+	if cfg.HealthInterval > 0 {
+		if cfg.HealthTimeout == 0 {
+			cfg.HealthTimeout = *healthTimeout
+		}
+		checker := &healthChecker{Path: cfg.HealthPath, Timeout: cfg.HealthTimeout}
+		h.Health = newTargetHealth(cfg.HealthThreshold, checker.probe)
+		go h.Health.run(productionTargets(cfg.Production, cfg.Routes), cfg.HealthInterval)
+	}
+	if cfg.StatsInterval > 0 {
+		h.Stats = newBackendStats()
+		go h.Stats.report(cfg.StatsInterval)
+	}
+	if cfg.Summary {
+		h.Summary = newLatencySummary()
+	}
+	if cfg.Workers > 0 {
+		h.Queue = newAlternateQueue(cfg.Workers, cfg.QueueSize)
+		go h.Queue.reportDrops(queueReportInterval)
+	}
+	for i, alternative := range h.Alternatives {
+		if isKafkaTarget(alternative) {
+			if h.Publishers == nil {
+				h.Publishers = make(map[string]*kafkaPublisher)
+			}
+			broker, topic, _ := parseKafkaTarget(alternative)
+			h.Publishers[alternative] = newKafkaPublisher(alternateOrigin(i, len(h.Alternatives)), broker, topic)
+		}
+	}
+	if cfg.MaxConcurrency > 0 {
+		h.Limit = newAlternateLimit(cfg.MaxConcurrency)
+		go h.Limit.reportDrops(queueReportInterval)
+	}
+	backendMetrics.Track(&h.production, &h.alternates)
+	return h, nil
+}
+
+// parseConfig sets the fields of h that are parsed from the settings of cfg,
+// like its regular expressions and rewrite rules, without starting anything.
+func (h *handler) parseConfig(cfg HandlerConfig) error {
+	if cfg.Weights != nil {
+		total := 0.0
+		for _, weight := range cfg.Weights {
+			total += weight
+		}
+		if total == 0 {
+			return fmt.Errorf("-b: expected at least one weight above 0")
+		}
+	}
+	var err error
+	if cfg.MethodMap != "" {
+		if h.MethodMap, err = parseMethodMap(cfg.MethodMap); err != nil {
+			return fmt.Errorf("-b.method-map: %s", err)
+		}
+	}
+	if cfg.SampleBy != "" {
+		if h.SampleBy, err = parseSampleBy(cfg.SampleBy); err != nil {
+			return fmt.Errorf("-sample-by: %s", err)
+		}
+	}
+	for _, alternative := range cfg.Alternatives {
+		if isKafkaTarget(alternative) {
+			if _, _, err := parseKafkaTarget(alternative); err != nil {
+				return fmt.Errorf("-b: %s", err)
+			}
+		}
+	}
+	if cfg.Include != "" {
+		if h.Include, err = regexp.Compile(cfg.Include); err != nil {
+			return fmt.Errorf("-b.include %s: %s", cfg.Include, err)
+		}
+	}
+	if cfg.Exclude != "" {
+		if h.Exclude, err = regexp.Compile(cfg.Exclude); err != nil {
+			return fmt.Errorf("-b.exclude %s: %s", cfg.Exclude, err)
+		}
+	}
+	if cfg.HealthInterval > 0 && cfg.HealthThreshold < 1 {
+		return fmt.Errorf("-a.health-threshold %d: expected at least 1", cfg.HealthThreshold)
+	}
+	if cfg.RewriteRules != "" {
+		if h.Rewrites, err = loadRewriteRules(cfg.RewriteRules); err != nil {
+			return fmt.Errorf("-rewrite-rules %s: %s", cfg.RewriteRules, err)
+		}
+	}
+	return nil
+}
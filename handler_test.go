@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewHandler(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h, err := NewHandler(HandlerConfig{
+		Production:    production.Address(),
+		Alternatives:  []string{alternate.Address()},
+		MethodMap:     "POST=GET",
+		Exclude:       "^/private",
+		IgnoreMethods: []string{"DELETE"},
+		Seed:          1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/public", strings.NewReader("body")),
+		httptest.NewRequest("GET", "/private", nil),
+		httptest.NewRequest("DELETE", "/public", nil),
+	} {
+		serve(t, h, req)
+	}
+	if requests := production.Requests(); len(requests) != 3 {
+		t.Errorf("Expected 3 requests to production, but received %d", len(requests))
+	}
+	if requests := alternate.Requests(); len(requests) != 1 || requests[0].Method != "GET" || requests[0].URL.Path != "/public" {
+		t.Errorf("Expected only GET /public on the alternate, but received %v", requests)
+	}
+}
+
+func TestIgnoreMethodsInLowerCase(t *testing.T) {
+	defer func(v string) { *ignoreMethods = v }(*ignoreMethods)
+	*ignoreMethods = "head,options"
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	cfg := handlerConfigFromFlags(production.Address(), nil)
+	cfg.Alternatives, cfg.Seed = []string{alternate.Address()}, 1
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"HEAD", "OPTIONS", "GET"} {
+		serve(t, h, httptest.NewRequest(method, "/", nil))
+	}
+	if requests := alternate.Requests(); len(requests) != 1 || requests[0].Method != "GET" {
+		t.Errorf("Expected only GET on the alternate, but received %v", requests)
+	}
+}
+
+func TestMethodsInLowerCase(t *testing.T) {
+	defer func(v string) { *alternateMethods = v }(*alternateMethods)
+	*alternateMethods = "get"
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	cfg := handlerConfigFromFlags(production.Address(), nil)
+	cfg.Alternatives, cfg.Seed = []string{alternate.Address()}, 1
+	h, err := NewHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	serve(t, h, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	if requests := alternate.Requests(); len(requests) != 1 || requests[0].Method != "GET" {
+		t.Errorf("Expected only GET on the alternate, but received %v", requests)
+	}
+}
+
+func TestNewHandlerIsDeterministicWithSeed(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(50)
+	sample := func() []bool {
+		h, err := NewHandler(HandlerConfig{Production: closedAddress(t), Alternatives: []string{closedAddress(t)}, Seed: 42})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decisions []bool
+		for i := 0; i < 20; i++ {
+			decisions = append(decisions, h.duplicates(httptest.NewRequest("GET", "/", nil)))
+		}
+		return decisions
+	}
+	if first, second := sample(), sample(); !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same decisions with the same seed, but received %v and %v", first, second)
+	}
+}
+
+func TestNewHandlerErrors(t *testing.T) {
+	for expectation, cfg := range map[string]HandlerConfig{
+		"-b: expected at least one weight": {Alternatives: []string{"a:80", "b:80"}, Weights: []float64{0, 0}},
+		"-b.method-map":                    {MethodMap: "POST"},
+		"-sample-by":                       {SampleBy: "query:id"},
+		"-b.include (":                     {Include: "("},
+		"-b.exclude (":                     {Exclude: "("},
+		"-record-file":                     {RecordFile: filepath.Join(t.TempDir(), "missing", "record.jsonl")},
+	} {
+		if _, err := NewHandler(cfg); err == nil || !strings.HasPrefix(err.Error(), expectation) {
+			t.Errorf("Expected an error starting with '%s', but received '%v'", expectation, err)
+		}
+	}
+}
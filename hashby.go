@@ -0,0 +1,47 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// hashScore is the rendezvous hashing score of target for key: the target
+// with the highest score among the candidates takes the key. Since each
+// score depends on its target alone, adding a target only moves the keys it
+// wins, and removing one only moves the keys it had. A weight scales the
+// share of keys a target wins.
+func hashScore(key, target string, weight float64) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(target))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	// The splitmix64 finalizer spreads keys that differ in their last
+	// bytes, which FNV-1a leaves close, over the whole range.
+	x := hash.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	// A point in (0, 1), so that its logarithm is finite and negative.
+	point := (float64(x>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(point)
+}
+
+// hashAlternate returns the one of candidates that key is sent to with
+// -b.hash-by, and false if none of them has a weight above 0.
+func (h *handler) hashAlternate(key string, candidates []int) (int, bool) {
+	best, bestScore := 0, 0.0
+	for _, i := range candidates {
+		if score := hashScore(key, h.Alternatives[i], h.weight(i)); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// weight returns the weight of the alternate at index i, 1 without Weights.
+func (h *handler) weight(i int) float64 {
+	if h.Weights == nil {
+		return 1
+	}
+	return h.Weights[i]
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHashByKeepsAKeyOnOneAlternate(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternates := []*testBackend{
+		newTestBackend(t, http.StatusOK, ""),
+		newTestBackend(t, http.StatusOK, ""),
+		newTestBackend(t, http.StatusOK, ""),
+	}
+	h := newTestHandler(production, alternates...)
+	h.HashBy = "X-User-Id"
+
+	for round := 0; round < 3; round++ {
+		for user := 0; user < 20; user++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-User-Id", fmt.Sprint("user-", user))
+			serve(t, h, req)
+		}
+	}
+	owners := make(map[string]int)
+	total := 0
+	for i, alternate := range alternates {
+		for _, req := range alternate.Requests() {
+			user := req.Header.Get("X-User-Id")
+			if owner, ok := owners[user]; ok && owner != i {
+				t.Errorf("Expected %s to stay on alternate %d, but it also reached %d", user, owner, i)
+			}
+			owners[user] = i
+			total++
+		}
+	}
+	if total != 60 {
+		t.Errorf("Expected every request to go to exactly one alternate, but received %d", total)
+	}
+}
+
+func TestHashByMovesOnlyKeysOfAnAddedAlternate(t *testing.T) {
+	before := newTestHandlerFor("production:80", "b1:80", "b2:80", "b3:80")
+	after := newTestHandlerFor("production:80", "b1:80", "b2:80", "b3:80", "b4:80")
+	before.HashBy, after.HashBy = "X-User-Id", "X-User-Id"
+
+	const count = 2000
+	moved := 0
+	for user := 0; user < count; user++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-Id", fmt.Sprint("user-", user))
+		was, is := before.chooseAlternates(req), after.chooseAlternates(req)
+		if len(was) != 1 || len(is) != 1 {
+			t.Fatalf("Expected one alternate, but received %v and %v", was, is)
+		}
+		if was[0] != is[0] {
+			if is[0] != 3 {
+				t.Errorf("Expected user-%d to move to the added alternate, but it moved from %d to %d", user, was[0], is[0])
+			}
+			moved++
+		}
+	}
+	// A quarter of the keys belong to the fourth alternate.
+	if moved < count/4-150 || moved > count/4+150 {
+		t.Errorf("Expected about %d keys to move, but %d did", count/4, moved)
+	}
+}
+
+func TestHashByFallsBackToWeightsWithoutTheHeader(t *testing.T) {
+	h := newTestHandlerFor("production:80", "b1:80", "b2:80")
+	h.HashBy = "X-User-Id"
+	h.Weights = []float64{3, 1}
+
+	counts := make([]int, 2)
+	for i := 0; i < 400; i++ {
+		chosen := h.chooseAlternates(httptest.NewRequest("GET", "/", nil))
+		if len(chosen) != 1 {
+			t.Fatalf("Expected one alternate, but received %v", chosen)
+		}
+		counts[chosen[0]]++
+	}
+	if counts[0] < 250 || counts[0] > 350 {
+		t.Errorf("Expected about 300 requests to the heavy alternate, but received %d", counts[0])
+	}
+}
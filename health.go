@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthChecker probes the backends in the background and reports the
+// result on /healthz. Only production decides readiness, the alternates are
+// informational.
+type healthChecker struct {
+	Production string
+	Alternates []string
+	Path       string // probed with GET if set, otherwise a TCP dial is enough
+	Timeout    time.Duration
+
+	mu     sync.RWMutex
+	errors map[string]error // by target, nil when reachable
+
+	clientOnce sync.Once
+	client     *http.Client // for Path, shared by the probes to reuse connections
+}
+
+// run checks the backends every interval, forever.
+func (c *healthChecker) run(interval time.Duration) {
+	for {
+		c.check()
+		time.Sleep(interval)
+	}
+}
+
+// check probes all backends once.
+func (c *healthChecker) check() {
+	errors := make(map[string]error)
+	for _, target := range append([]string{c.Production}, c.Alternates...) {
+		errors[target] = c.probe(target)
+	}
+	c.mu.Lock()
+	c.errors = errors
+	c.mu.Unlock()
+}
+
+func (c *healthChecker) probe(target string) error {
+	address := targetHost(target)
+	if isKafkaTarget(target) {
+		// A broker does not speak HTTP, it is only connected to.
+		address, _, _ = parseKafkaTarget(target)
+	}
+	if c.Path == "" || isKafkaTarget(target) {
+		conn, err := unixSocketDialer(&net.Dialer{Timeout: c.Timeout})(context.Background(), "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	c.clientOnce.Do(func() {
+		c.client = &http.Client{
+			Timeout:   c.Timeout,
+			Transport: &http.Transport{DialContext: unixSocketDialer(&net.Dialer{})},
+		}
+	})
+	response, err := c.client.Get(targetScheme(target) + "://" + targetHost(target) + c.Path)
+	if err != nil {
+		return err
+	}
+	// Read to the end, so that the connection is reused by the next probe.
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP answers 200 if production was reachable on the last check and
+// 503 otherwise, listing the state of every backend.
+func (c *healthChecker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := http.StatusOK
+	if err, checked := c.errors[c.Production]; err != nil || !checked {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "A %s %s\n", c.Production, healthState(c.errors, c.Production))
+	for i, alternate := range c.Alternates {
+		fmt.Fprintf(w, "%s %s %s\n", alternateOrigin(i, len(c.Alternates)), alternate, healthState(c.errors, alternate))
+	}
+}
+
+func healthState(errors map[string]error, target string) string {
+	err, checked := errors[target]
+	switch {
+	case !checked:
+		return "unknown"
+	case err != nil:
+		return "down: " + err.Error()
+	}
+	return "up"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthReportsProductionReadiness(t *testing.T) {
+	up := newTestBackend(t, http.StatusOK, "")
+	down := closedAddress(t)
+
+	for _, c := range []struct {
+		checker     *healthChecker
+		expectation int
+	}{
+		{&healthChecker{Production: up.Address(), Alternates: []string{down}}, http.StatusOK},
+		{&healthChecker{Production: up.Address(), Path: "/ping"}, http.StatusOK},
+		{&healthChecker{Production: down, Alternates: []string{up.Address()}}, http.StatusServiceUnavailable},
+	} {
+		c.checker.Timeout = time.Second
+		c.checker.check()
+		recorder := httptest.NewRecorder()
+		c.checker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+		if recorder.Code != c.expectation {
+			t.Errorf("Expected status %d, but received %d with '%s'", c.expectation, recorder.Code, recorder.Body)
+		}
+	}
+}
+
+func TestHealthProbesPath(t *testing.T) {
+	failing := newTestBackend(t, http.StatusInternalServerError, "")
+	checker := &healthChecker{Production: failing.Address(), Path: "/ping", Timeout: time.Second}
+	checker.check()
+	recorder := httptest.NewRecorder()
+	checker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "status 500") {
+		t.Errorf("Expected status %d, but received %d with '%s'", http.StatusServiceUnavailable, recorder.Code, recorder.Body)
+	}
+	if requests := failing.Requests(); len(requests) != 1 || requests[0].URL.Path != "/ping" {
+		t.Errorf("Expected one probe of /ping, but received %d", len(requests))
+	}
+}
+
+func TestHealthProbesReuseConnection(t *testing.T) {
+	var connections atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	checker := &healthChecker{Production: backend.Listener.Addr().String(), Path: "/ping", Timeout: time.Second}
+	for i := 0; i < 3; i++ {
+		if err := checker.probe(checker.Production); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("Expected the 3 probes on one connection, but received %d", n)
+	}
+}
+
+func TestHealthBeforeFirstCheck(t *testing.T) {
+	checker := &healthChecker{Production: "localhost:1"}
+	recorder := httptest.NewRecorder()
+	checker.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, but received %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+}
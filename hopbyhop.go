@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders only apply to a single connection, so a proxy must not
+// forward them (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from header, as well
+// as the headers listed in its Connection header. "TE: trailers" is kept,
+// since gRPC backends require it.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, value := range header.Values("Te") {
+		for _, coding := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
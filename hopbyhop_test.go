@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHopByHopHeadersAreRemoved(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"keep-alive, X-Hop"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Te":                {"gzip, trailers"},
+		"X-Hop":             {"1"},
+		"X-End-To-End":      {"1"},
+	}
+	removeHopByHopHeaders(header)
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "X-Hop"} {
+		if value := header.Get(name); value != "" {
+			t.Errorf("Expected no %s header, but received '%s'", name, value)
+		}
+	}
+	if value := header.Get("Te"); value != "trailers" {
+		t.Errorf("Expected 'TE: trailers' to be kept, but received '%s'", value)
+	}
+	if value := header.Get("X-End-To-End"); value != "1" {
+		t.Errorf("Expected X-End-To-End to be kept, but received '%s'", value)
+	}
+}
+
+func TestHopByHopHeadersAreNotForwarded(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range []string{"Keep-Alive", "Proxy-Authorization", "X-Hop"} {
+			if value := req.Header.Get(name); value != "" {
+				t.Errorf("Expected no %s header on the forwarded request, but received '%s'", name, value)
+			}
+		}
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+	}))
+	defer production.Close()
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"), alternate.Address())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	recorder := serve(t, h, req)
+
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if value := recorder.Header().Get(name); value != "" {
+			t.Errorf("Expected no %s header on the response, but received '%s'", name, value)
+		}
+	}
+	requests := alternate.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request to the alternate, but received %d", len(requests))
+	}
+	for _, name := range []string{"Keep-Alive", "Proxy-Authorization", "X-Hop"} {
+		if value := requests[0].Header.Get(name); value != "" {
+			t.Errorf("Expected no %s header on the alternate request, but received '%s'", name, value)
+		}
+	}
+}
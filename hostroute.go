@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostRoute sends the requests for hosts matching Pattern to Target.
+type hostRoute struct {
+	Pattern string // lower case, an exact host or *.domain
+	Target  string
+}
+
+// matchHost reports whether host matches pattern: exactly, or for a pattern
+// like *.example.com any subdomain of example.com, but not example.com
+// itself.
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// requestHost returns the host req was sent to, without port and in lower
+// case.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// productionRoutes returns the routing table of t, the -a targets: the
+// default target, given without host pattern, and the routes in the order
+// given.
+func productionRoutes(t *targetList) (string, []hostRoute, error) {
+	if t.weighted {
+		return "", nil, fmt.Errorf("production targets cannot have weights")
+	}
+	var target string
+	var routes []hostRoute
+	for i, host := range t.hosts {
+		if host != "" {
+			routes = append(routes, hostRoute{Pattern: host, Target: t.targets[i]})
+		} else if target == "" {
+			target = t.targets[i]
+		} else {
+			return "", nil, fmt.Errorf("expected one default target without host pattern, but found %s and %s", target, t.targets[i])
+		}
+	}
+	if target == "" {
+		return "", nil, fmt.Errorf("expected a default target without host pattern")
+	}
+	return target, routes, nil
+}
+
+// productionTarget returns the production target for req: the target of the
+// first route matching its host that is up, or Target if no route matches.
+// It returns "" if all the targets for the host are down.
+func (h *handler) productionTarget(req *http.Request) string {
+	matched := false
+	if len(h.Routes) > 0 {
+		host := requestHost(req)
+		for _, route := range h.Routes {
+			if matchHost(route.Pattern, host) {
+				if h.Health.Up(route.Target) {
+					return route.Target
+				}
+				matched = true
+			}
+		}
+	}
+	if matched || !h.Health.Up(h.Target) {
+		return ""
+	}
+	return h.Target
+}
+
+// alternateMatches reports whether the alternate at index i takes requests
+// for the host of req. Alternates without host pattern take all.
+func (h *handler) alternateMatches(i int, req *http.Request) bool {
+	return len(h.AltHosts) == 0 || h.AltHosts[i] == "" || matchHost(h.AltHosts[i], requestHost(req))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	for _, test := range []struct {
+		pattern, host string
+		matches       bool
+	}{
+		{"api.example.com", "api.example.com", true},
+		{"api.example.com", "www.example.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	} {
+		if matchHost(test.pattern, test.host) != test.matches {
+			t.Errorf("Expected '%s' matching '%s' to be %v", test.host, test.pattern, test.matches)
+		}
+	}
+}
+
+func TestProductionRoutes(t *testing.T) {
+	targets := &targetList{}
+	if err := targets.Set("API.example.com=api:80,default:80,*.example.com=wildcard:80"); err != nil {
+		t.Fatal(err)
+	}
+	target, routes, err := productionRoutes(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "default:80" || len(routes) != 2 || routes[0] != (hostRoute{"api.example.com", "api:80"}) || routes[1] != (hostRoute{"*.example.com", "wildcard:80"}) {
+		t.Errorf("Expected a default and two routes, but received '%s' and %v", target, routes)
+	}
+	if expectation := "api.example.com=api:80,default:80,*.example.com=wildcard:80"; targets.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, targets)
+	}
+
+	for _, spec := range []string{"a.example.com=a:80", "a:80,b:80", "a:80@2"} {
+		targets := &targetList{}
+		targets.Set(spec)
+		if _, _, err := productionRoutes(targets); err == nil {
+			t.Errorf("Expected an error for '%s'", spec)
+		}
+	}
+}
+
+func TestProductionIsSelectedByHost(t *testing.T) {
+	api := newTestBackend(t, http.StatusOK, "api")
+	wildcard := newTestBackend(t, http.StatusOK, "wildcard")
+	fallback := newTestBackend(t, http.StatusOK, "default")
+	h := newTestHandler(fallback)
+	h.Routes = []hostRoute{{"api.example.com", api.Address()}, {"*.example.com", wildcard.Address()}}
+
+	for host, expectation := range map[string]string{
+		"api.example.com":      "api",
+		"API.example.com:8888": "api",
+		"www.example.com":      "wildcard",
+		"example.com":          "default",
+		"other.org":            "default",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		if body := serve(t, h, req).Body.String(); body != expectation {
+			t.Errorf("Expected '%s' for host '%s', but received '%s'", expectation, host, body)
+		}
+	}
+}
+
+func TestAlternatesAreSelectedByHost(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	api := newTestBackend(t, http.StatusOK, "")
+	all := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, api, all)
+	h.AltHosts = []string{"*.example.com", ""}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "other.org"
+	serve(t, h, req)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = "api.example.com"
+	serve(t, h, req)
+
+	if len(api.Requests()) != 1 || api.Requests()[0].Host != "api.example.com" {
+		t.Errorf("Expected the request for api.example.com only, but received %d requests", len(api.Requests()))
+	}
+	if len(all.Requests()) != 2 {
+		t.Errorf("Expected %d requests, but received %d", 2, len(all.Requests()))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveProxy serves h like main does, on listener.
+func serveProxy(t *testing.T, h http.Handler, listener net.Listener) {
+	server := newServer(h)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+}
+
+func TestHTTP2OverTLSIsProxied(t *testing.T) {
+	// Borrow the certificate of an httptest TLS server.
+	certificateOwner := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certificateOwner.Close()
+	certificate := certificateOwner.TLS.Certificates[0]
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: nextProtos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	production := newTestBackend(t, http.StatusOK, "")
+	serveProxy(t, newTestHandler(production), listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificateOwner.Certificate())
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		ForceAttemptHTTP2: true,
+	}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, but received %s", response.Proto)
+	}
+	if requests := production.Requests(); len(requests) != 1 || requests[0].URL.Path != "/resource" {
+		t.Errorf("Expected one request for /resource to production, but received %d", len(requests))
+	}
+}
+
+func TestHTTP2PriorKnowledgeIsProxied(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	serveProxy(t, h, listener)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	response, err := (&http.Client{Transport: transport}).Get("http://" + listener.Addr().String() + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, but received %s", response.Proto)
+	}
+	if requests := production.Requests(); len(requests) != 1 || requests[0].ProtoMajor != 1 {
+		t.Errorf("Expected one HTTP/1.1 request to production, but received %d", len(requests))
+	}
+	h.alternates.Wait(context.Background())
+	if requests := alternate.Requests(); len(requests) != 1 || requests[0].ProtoMajor != 1 {
+		t.Errorf("Expected one HTTP/1.1 request to alternate, but received %d", len(requests))
+	}
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	defer func(timeout time.Duration) { *readHeaderTimeout = timeout }(*readHeaderTimeout)
+	*readHeaderTimeout = 100 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, newTestHandler(newTestBackend(t, http.StatusOK, "")), listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	// Trickle the headers, like a slowloris client.
+	for _, part := range []string{"GET / HTTP/1.1\r\n", "Host: example.com\r\n", "X-A: 1\r\n", "X-B: 2\r\n", "X-C: 3\r\n"} {
+		if _, err := conn.Write([]byte(part)); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the connection to be closed, but received %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the connection to be closed after %v, but it took %v", *readHeaderTimeout, elapsed)
+	}
+}
+
+func TestStreamedResponseIsFlushed(t *testing.T) {
+	next := make(chan struct{})
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 2; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-time.After(2 * time.Second):
+				return
+			}
+		}
+	}))
+	defer production.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, newTestHandlerFor(production.Listener.Addr().String()), listener)
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	events := bufio.NewReader(response.Body)
+	for i := 1; i <= 2; i++ {
+		// The backend only sends the next event once this one arrived.
+		line, err := events.ReadString('\n')
+		if expectation := fmt.Sprintf("data: %d\n", i); err != nil || line != expectation {
+			t.Fatalf("Expected '%s', but received '%s': %v", expectation, line, err)
+		}
+		events.ReadString('\n')
+		select {
+		case next <- struct{}{}:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected event %d before the backend gave up", i)
+		}
+	}
+}
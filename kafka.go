@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isKafkaTarget reports whether target is a kafka://broker/topic alternate,
+// whose requests are published rather than sent.
+func isKafkaTarget(target string) bool {
+	return strings.HasPrefix(target, "kafka://")
+}
+
+// parseKafkaTarget returns the broker, with the default port 9092 if it has
+// none, and the topic of a kafka://broker/topic target.
+func parseKafkaTarget(target string) (string, string, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("expected kafka://broker/topic, but found %q", target)
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" || len(topic) > 249 || strings.Trim(topic, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") != "" {
+		return "", "", fmt.Errorf("%q: expected a topic of letters, digits, '.', '_' and '-'", target)
+	}
+	broker := u.Host
+	if u.Port() == "" {
+		broker = net.JoinHostPort(u.Hostname(), "9092")
+	}
+	return broker, topic, nil
+}
+
+// publishedRequest is the value of each message published to a kafka://
+// alternate. Its fields are those of a record file entry.
+type publishedRequest struct {
+	Timestamp string          `json:"timestamp"`
+	Origin    string          `json:"origin"`
+	Request   recordedMessage `json:"request"`
+}
+
+// kafkaMessage is a message waiting to be published.
+type kafkaMessage struct {
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// kafkaPublisher publishes the requests of a kafka:// alternate in batches,
+// in the background, to partition 0 of the topic on the broker, which has to
+// lead it. Messages that do not fit in the buffer of -kafka-buffer are
+// dropped, like records that do not fit in the record queue.
+type kafkaPublisher struct {
+	Origin string
+	Broker string
+	Topic  string
+
+	mu       sync.Mutex
+	closed   bool
+	dropped  int
+	messages chan kafkaMessage
+	done     chan struct{}
+
+	conn          net.Conn // to Broker, nil until the first batch
+	reader        *bufio.Reader
+	correlationID int32
+}
+
+func newKafkaPublisher(origin, broker, topic string) *kafkaPublisher {
+	p := &kafkaPublisher{
+		Origin:   origin,
+		Broker:   broker,
+		Topic:    topic,
+		messages: make(chan kafkaMessage, *kafkaBufferSize),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues request, with its body capped at -record-max-body, unless
+// the buffer is full or the publisher is closed. The message is keyed by
+// the X-Request-Id of request.
+func (p *kafkaPublisher) Publish(request *http.Request) {
+	published := publishedRequest{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Origin:    p.Origin,
+		Request: recordedMessage{
+			Method: request.Method,
+			URI:    request.URL.RequestURI(),
+			Host:   request.Host,
+			Header: request.Header,
+		},
+	}
+	if request.Body != nil {
+		published.Request.SetBody(readRecordedBody(request.Body))
+		io.Copy(io.Discard, request.Body)
+		request.Body.Close()
+	}
+	value, err := json.Marshal(published)
+	if err != nil {
+		log.Printf("[%v] %v Failed to publish request: %v", p.Origin, time.Now().UTC(), err)
+		return
+	}
+	message := kafkaMessage{Value: value, Timestamp: time.Now()}
+	if id := request.Header.Get(REQUEST_ID_HEADER); id != "" {
+		message.Key = []byte(id)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.messages <- message:
+	default:
+		p.dropped++
+		backendMetrics.Drop()
+	}
+}
+
+// run publishes the messages in batches of up to -kafka-batch-size, each
+// sent once it is full or -kafka-linger after its first message.
+func (p *kafkaPublisher) run() {
+	defer close(p.done)
+	for message := range p.messages {
+		batch := []kafkaMessage{message}
+		linger := time.NewTimer(*kafkaLinger)
+	collect:
+		for len(batch) < *kafkaBatchSize {
+			select {
+			case message, ok := <-p.messages:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, message)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+		if err := p.produce(batch); err != nil {
+			log.Printf("[%v] %v Failed to publish %d requests to %v/%v: %v", p.Origin, time.Now().UTC(), len(batch), p.Broker, p.Topic, err)
+		}
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+// produce sends batch to the broker and waits for the leader to store it.
+// The connection is dropped on any error, to be dialed again for the next
+// batch.
+func (p *kafkaPublisher) produce(batch []kafkaMessage) error {
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.Broker, *alternateTimeout)
+		if err != nil {
+			return err
+		}
+		p.conn, p.reader = conn, bufio.NewReader(conn)
+	}
+	p.correlationID++
+	p.conn.SetDeadline(time.Now().Add(*alternateTimeout))
+	err := p.roundTrip(produceRequest(p.correlationID, p.Topic, encodeRecordBatch(batch), *alternateTimeout))
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *kafkaPublisher) roundTrip(request []byte) error {
+	if _, err := p.conn.Write(request); err != nil {
+		return err
+	}
+	var size int32
+	if err := binary.Read(p.reader, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size < 0 || size > 1<<20 {
+		return fmt.Errorf("invalid response of %d bytes", size)
+	}
+	response := make([]byte, size)
+	if _, err := io.ReadFull(p.reader, response); err != nil {
+		return err
+	}
+	return parseProduceResponse(response, p.correlationID)
+}
+
+// Close publishes the buffered messages and closes the connection. Messages
+// after Close are discarded.
+func (p *kafkaPublisher) Close() {
+	p.mu.Lock()
+	p.closed = true
+	close(p.messages)
+	dropped := p.dropped
+	p.mu.Unlock()
+
+	<-p.done
+	if dropped > 0 {
+		log.Printf("[%v] %v Dropped %d requests because %v/%v could not keep up", p.Origin, time.Now().UTC(), dropped, p.Broker, p.Topic)
+	}
+}
+
+// encodeRecordBatch encodes batch as a Kafka record batch of magic 2,
+// uncompressed, without producer ID or record headers.
+func encodeRecordBatch(batch []kafkaMessage) []byte {
+	first, last := batch[0].Timestamp.UnixMilli(), batch[0].Timestamp.UnixMilli()
+	var records []byte
+	for i, message := range batch {
+		timestamp := message.Timestamp.UnixMilli()
+		last = max(last, timestamp)
+		record := []byte{0} // attributes
+		record = binary.AppendVarint(record, timestamp-first)
+		record = binary.AppendVarint(record, int64(i))
+		record = appendVarintBytes(record, message.Key)
+		record = appendVarintBytes(record, message.Value)
+		record = binary.AppendVarint(record, 0) // headers
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	// The CRC covers the batch from the attributes on.
+	var checked []byte
+	checked = binary.BigEndian.AppendUint16(checked, 0) // attributes
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(batch)-1))
+	checked = binary.BigEndian.AppendUint64(checked, uint64(first))
+	checked = binary.BigEndian.AppendUint64(checked, uint64(last))
+	checked = binary.BigEndian.AppendUint64(checked, ^uint64(0)) // no producer ID
+	checked = binary.BigEndian.AppendUint16(checked, ^uint16(0)) // no producer epoch
+	checked = binary.BigEndian.AppendUint32(checked, ^uint32(0)) // no base sequence
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(batch)))
+	checked = append(checked, records...)
+
+	var encoded []byte
+	encoded = binary.BigEndian.AppendUint64(encoded, 0) // base offset
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(4+1+4+len(checked)))
+	encoded = binary.BigEndian.AppendUint32(encoded, ^uint32(0)) // partition leader epoch
+	encoded = append(encoded, 2)                                 // magic
+	encoded = binary.BigEndian.AppendUint32(encoded, crc32.Checksum(checked, crc32.MakeTable(crc32.Castagnoli)))
+	return append(encoded, checked...)
+}
+
+// appendVarintBytes appends b with its varint length, -1 for nil.
+func appendVarintBytes(dst, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(dst, -1)
+	}
+	return append(binary.AppendVarint(dst, int64(len(b))), b...)
+}
+
+// appendKafkaString appends s with its int16 length.
+func appendKafkaString(dst []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(dst, uint16(len(s))), s...)
+}
+
+// produceRequest frames a Produce request of version 3 with records for
+// partition 0 of topic, acknowledged by the leader within timeout.
+func produceRequest(correlationID int32, topic string, records []byte, timeout time.Duration) []byte {
+	var request []byte
+	request = binary.BigEndian.AppendUint16(request, 0) // Produce
+	request = binary.BigEndian.AppendUint16(request, 3)
+	request = binary.BigEndian.AppendUint32(request, uint32(correlationID))
+	request = appendKafkaString(request, "teeproxy")
+	request = binary.BigEndian.AppendUint16(request, ^uint16(0)) // no transactional ID
+	request = binary.BigEndian.AppendUint16(request, 1)          // acks from the leader
+	request = binary.BigEndian.AppendUint32(request, uint32(timeout.Milliseconds()))
+	request = binary.BigEndian.AppendUint32(request, 1) // topics
+	request = appendKafkaString(request, topic)
+	request = binary.BigEndian.AppendUint32(request, 1) // partitions
+	request = binary.BigEndian.AppendUint32(request, 0)
+	request = binary.BigEndian.AppendUint32(request, uint32(len(records)))
+	request = append(request, records...)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(request))), request...)
+}
+
+// parseProduceResponse returns the error of a Produce response of version
+// 3, if the broker did not store the batch.
+func parseProduceResponse(response []byte, correlationID int32) error {
+	r := &kafkaReader{b: response}
+	if id := r.int32(); id != correlationID {
+		return fmt.Errorf("expected the response to request %d, but received %d", correlationID, id)
+	}
+	for topics := r.int32(); topics > 0 && r.err == nil; topics-- {
+		r.skip(int(r.int16())) // name
+		for partitions := r.int32(); partitions > 0 && r.err == nil; partitions-- {
+			r.int32() // partition
+			code := r.int16()
+			r.skip(16) // base offset and log append time
+			if code != 0 && r.err == nil {
+				return fmt.Errorf("broker error code %d", code)
+			}
+		}
+	}
+	return r.err
+}
+
+// kafkaReader reads the big-endian fields of a response, and remembers when
+// it runs short.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) skip(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errors.New("truncated response")
+		return make([]byte, max(n, 0))
+	}
+	skipped := r.b[:n]
+	r.b = r.b[n:]
+	return skipped
+}
+
+func (r *kafkaReader) int16() int16 {
+	return int16(binary.BigEndian.Uint16(r.skip(2)))
+}
+
+func (r *kafkaReader) int32() int32 {
+	return int32(binary.BigEndian.Uint32(r.skip(4)))
+}
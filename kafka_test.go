@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts Produce requests of version 3, checks their record
+// batches and sends the messages of each batch on Batches.
+type fakeBroker struct {
+	net.Listener
+	Batches   chan []kafkaMessage
+	ErrorCode int16 // answered for every batch
+	Silent    bool  // never answers
+}
+
+// newFakeBroker starts a broker that behaves as broker says.
+func newFakeBroker(t *testing.T, broker fakeBroker) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker
+	b.Listener, b.Batches = listener, make(chan []kafkaMessage, 10)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Closed by the publisher.
+			go b.serve(t, conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(t *testing.T, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		var size int32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+		request := make([]byte, size)
+		if _, err := io.ReadFull(reader, request); err != nil {
+			return
+		}
+		r := &kafkaReader{b: request}
+		if apiKey, version := r.int16(), r.int16(); apiKey != 0 || version != 3 {
+			t.Errorf("Expected Produce version 3, but received API %d version %d", apiKey, version)
+			return
+		}
+		correlationID := r.int32()
+		r.skip(int(r.int16())) // client ID
+		r.int16()              // transactional ID
+		r.int16()              // acks
+		r.int32()              // timeout
+		r.int32()              // topics
+		topic := string(r.skip(int(r.int16())))
+		r.int32() // partitions
+		if partition := r.int32(); partition != 0 || topic != "requests" {
+			t.Errorf("Expected partition 0 of requests, but received %d of %s", partition, topic)
+		}
+		b.Batches <- decodeRecordBatch(t, r.skip(int(r.int32())))
+		if b.Silent {
+			continue
+		}
+
+		var response []byte
+		response = binary.BigEndian.AppendUint32(response, uint32(correlationID))
+		response = binary.BigEndian.AppendUint32(response, 1)
+		response = appendKafkaString(response, topic)
+		response = binary.BigEndian.AppendUint32(response, 1)
+		response = binary.BigEndian.AppendUint32(response, 0)
+		response = binary.BigEndian.AppendUint16(response, uint16(b.ErrorCode))
+		response = binary.BigEndian.AppendUint64(response, 0)
+		response = binary.BigEndian.AppendUint64(response, ^uint64(0))
+		response = binary.BigEndian.AppendUint32(response, 0) // throttle time
+		conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(response))), response...))
+	}
+}
+
+// decodeRecordBatch returns the messages of a record batch of magic 2,
+// after checking its length and CRC.
+func decodeRecordBatch(t *testing.T, batch []byte) []kafkaMessage {
+	if length := int(binary.BigEndian.Uint32(batch[8:])); length != len(batch)-12 || batch[16] != 2 {
+		t.Errorf("Expected a batch of magic 2 and length %d, but received %d and %d", len(batch)-12, length, batch[16])
+		return nil
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("Expected a valid CRC, but received %x", crc)
+	}
+	first := int64(binary.BigEndian.Uint64(batch[27:]))
+	count := int(binary.BigEndian.Uint32(batch[57:]))
+	records := batch[61:]
+	varint := func() int64 {
+		v, n := binary.Varint(records)
+		records = records[n:]
+		return v
+	}
+	bytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		b := records[:n]
+		records = records[n:]
+		return b
+	}
+	var messages []kafkaMessage
+	for i := 0; i < count; i++ {
+		varint()              // length
+		records = records[1:] // attributes
+		timestamp := first + varint()
+		if offset := varint(); offset != int64(i) {
+			t.Errorf("Expected offset delta %d, but received %d", i, offset)
+		}
+		key, value := bytes(), bytes()
+		varint() // headers
+		messages = append(messages, kafkaMessage{Key: key, Value: value, Timestamp: time.UnixMilli(timestamp)})
+	}
+	return messages
+}
+
+// receiveBatch waits for the next batch broker received.
+func receiveBatch(t *testing.T, broker *fakeBroker) []kafkaMessage {
+	select {
+	case batch := <-broker.Batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a batch on the broker")
+		return nil
+	}
+}
+
+func TestKafkaAlternatePublishesRequests(t *testing.T) {
+	broker := newFakeBroker(t, fakeBroker{})
+	production := newTestBackend(t, http.StatusOK, "")
+	target := "kafka://" + broker.Addr().String() + "/requests"
+	h, err := NewHandler(HandlerConfig{Production: production.Address(), Alternatives: []string{target}, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/path?q=1", strings.NewReader("payload"))
+	req.Header.Set(REQUEST_ID_HEADER, "id-1")
+	serve(t, h, req)
+	h.Publishers[target].Close()
+
+	if requests := production.Requests(); len(requests) != 1 {
+		t.Errorf("Expected one request to production, but received %d", len(requests))
+	}
+	batch := receiveBatch(t, broker)
+	if len(batch) != 1 || string(batch[0].Key) != "id-1" {
+		t.Fatalf("Expected one message with the key id-1, but received %v", batch)
+	}
+	var published publishedRequest
+	if err := json.Unmarshal(batch[0].Value, &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Origin != "B" || published.Request.Method != "POST" || published.Request.URI != "/path?q=1" || string(published.Request.Body) != "payload" {
+		t.Errorf("Expected POST /path?q=1 with 'payload' from B, but received '%s'", batch[0].Value)
+	}
+}
+
+func TestKafkaPublisherBatches(t *testing.T) {
+	defer func(size int, linger time.Duration) { *kafkaBatchSize, *kafkaLinger = size, linger }(*kafkaBatchSize, *kafkaLinger)
+	*kafkaBatchSize, *kafkaLinger = 3, time.Minute
+	broker := newFakeBroker(t, fakeBroker{})
+	publisher := newKafkaPublisher("B", broker.Addr().String(), "requests")
+	defer publisher.Close()
+
+	for i := 0; i < 3; i++ {
+		publisher.Publish(httptest.NewRequest("GET", "/", nil))
+	}
+	if batch := receiveBatch(t, broker); len(batch) != 3 {
+		t.Errorf("Expected the 3 requests in one batch, but received %d", len(batch))
+	}
+}
+
+func TestKafkaPublisherDropsWhenFull(t *testing.T) {
+	defer func(buffer, size int, timeout time.Duration) {
+		*kafkaBufferSize, *kafkaBatchSize, *alternateTimeout = buffer, size, timeout
+	}(*kafkaBufferSize, *kafkaBatchSize, *alternateTimeout)
+	*kafkaBufferSize, *kafkaBatchSize, *alternateTimeout = 1, 1, 200*time.Millisecond
+	output := captureLog(t)
+	broker := newFakeBroker(t, fakeBroker{Silent: true})
+	publisher := newKafkaPublisher("B", broker.Addr().String(), "requests")
+
+	publisher.Publish(httptest.NewRequest("GET", "/", nil))
+	// The first request is held up by the broker, one more is buffered.
+	receiveBatch(t, broker)
+	for i := 0; i < 4; i++ {
+		publisher.Publish(httptest.NewRequest("GET", "/", nil))
+	}
+	publisher.Close()
+
+	if expectation := "Dropped 3 requests"; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, output)
+	}
+}
+
+func TestKafkaBrokerError(t *testing.T) {
+	broker := newFakeBroker(t, fakeBroker{ErrorCode: 6})
+	publisher := &kafkaPublisher{Broker: broker.Addr().String(), Topic: "requests"}
+	err := publisher.produce([]kafkaMessage{{Value: []byte("{}"), Timestamp: time.Now()}})
+	if err == nil || !strings.Contains(err.Error(), "code 6") {
+		t.Errorf("Expected the broker error code 6, but received %v", err)
+	}
+	if publisher.conn != nil {
+		t.Errorf("Expected the connection to be dropped")
+	}
+}
+
+func TestParseKafkaTarget(t *testing.T) {
+	broker, topic, err := parseKafkaTarget("kafka://broker/requests.v1")
+	if err != nil || broker != "broker:9092" || topic != "requests.v1" {
+		t.Errorf("Expected broker:9092 and requests.v1, but received %s, %s and %v", broker, topic, err)
+	}
+	for _, target := range []string{"kafka://broker", "kafka:///topic", "kafka://broker/a/b", "kafka://broker/topic?acks=all"} {
+		if _, _, err := parseKafkaTarget(target); err == nil {
+			t.Errorf("Expected an error for '%s'", target)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultListen is the address listened on when -l is not given.
+const defaultListen = ":8888"
+
+// listenAddress is one address of -l and whether it is served with TLS.
+type listenAddress struct {
+	Address string
+	TLS     bool
+}
+
+// parseListenAddress parses an address of -l. An http:// or https:// prefix
+// chooses plain HTTP or TLS explicitly; a bare address gets TLS if
+// certificates are configured, as before -l was repeatable.
+func parseListenAddress(spec string, certificates bool) (listenAddress, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://"):
+		return listenAddress{Address: strings.TrimPrefix(spec, "http://")}, nil
+	case strings.HasPrefix(spec, "https://"):
+		if !certificates {
+			return listenAddress{}, fmt.Errorf("%s: -cert.file and -key.file are required for TLS", spec)
+		}
+		return listenAddress{Address: strings.TrimPrefix(spec, "https://"), TLS: true}, nil
+	case strings.Contains(spec, "://"):
+		return listenAddress{}, fmt.Errorf("%s: expected http:// or https://", spec)
+	}
+	return listenAddress{Address: spec, TLS: certificates}, nil
+}
+
+// listenAll listens on every address of specs, with config for those served
+// with TLS. config is nil without certificates. If one of the addresses
+// fails, the listeners opened so far are closed again.
+func listenAll(specs []string, config *tls.Config) ([]net.Listener, error) {
+	if len(specs) == 0 {
+		specs = []string{defaultListen}
+	}
+	var listeners []net.Listener
+	for _, spec := range specs {
+		address, err := parseListenAddress(spec, config != nil)
+		var listener net.Listener
+		if err == nil {
+			listener, err = net.Listen("tcp", address.Address)
+		}
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		if address.TLS {
+			listener = tls.NewListener(listener, config)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	for _, test := range []struct {
+		spec         string
+		certificates bool
+		expectation  listenAddress
+	}{
+		{":8080", false, listenAddress{Address: ":8080"}},
+		{":8443", true, listenAddress{Address: ":8443", TLS: true}},
+		{"http://:8080", true, listenAddress{Address: ":8080"}},
+		{"https://127.0.0.1:8443", true, listenAddress{Address: "127.0.0.1:8443", TLS: true}},
+	} {
+		if address, err := parseListenAddress(test.spec, test.certificates); err != nil || address != test.expectation {
+			t.Errorf("Expected %+v for '%s', but received %+v: %v", test.expectation, test.spec, address, err)
+		}
+	}
+	for _, spec := range []string{"https://:8443", "unix://teeproxy.sock"} {
+		if _, err := parseListenAddress(spec, false); err == nil {
+			t.Errorf("Expected an error for '%s'", spec)
+		}
+	}
+}
+
+func TestPlainAndTLSListeners(t *testing.T) {
+	certFile, keyFile := newServerCertificate(t, "example.com")
+	certificates, err := loadCertificates([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := listenerTLSConfig(certificates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listenAll([]string{"http://127.0.0.1:0", "https://127.0.0.1:0"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production)
+	var servers []*http.Server
+	for _, listener := range listeners {
+		server := newServer(h)
+		servers = append(servers, server)
+		go server.Serve(listener)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	urls := []string{"http://" + listeners[0].Addr().String() + "/plain", "https://" + listeners[1].Addr().String() + "/tls"}
+	for _, url := range urls {
+		response, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Expected a response from %s, but received %v", url, err)
+		}
+		response.Body.Close()
+	}
+	if requests := production.Requests(); len(requests) != 2 {
+		t.Errorf("Expected 2 requests to production, but received %d", len(requests))
+	}
+
+	client.CloseIdleConnections()
+	shutdown(servers, h, time.Second)
+	for _, url := range urls {
+		if response, err := client.Get(url); err == nil {
+			response.Body.Close()
+			t.Errorf("Expected %s to be shut down", url)
+		}
+	}
+}
+
+func TestTLSListenOnUsedPortFails(t *testing.T) {
+	certFile, keyFile := newServerCertificate(t, "example.com")
+	certificates, err := loadCertificates([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := listenerTLSConfig(certificates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddress := free.Addr().String()
+	free.Close()
+
+	listeners, err := listenAll([]string{"https://" + freeAddress, "https://" + used.Addr().String()}, config)
+	if err == nil || !strings.Contains(err.Error(), used.Addr().String()) {
+		t.Fatalf("Expected an error naming %s, but received %v", used.Addr(), err)
+	}
+	if listeners != nil {
+		t.Errorf("Expected no listeners, but received %d", len(listeners))
+	}
+	// The listener opened before the failure was closed again.
+	again, err := net.Listen("tcp", freeAddress)
+	if err != nil {
+		t.Errorf("Expected %s to be free again, but received %v", freeAddress, err)
+	} else {
+		again.Close()
+	}
+}
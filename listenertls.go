@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// tlsVersions are the values accepted by -tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion turns a version like "1.2" into its tls constant.
+func parseTLSVersion(value string) (uint16, error) {
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("expected 1.0, 1.1, 1.2 or 1.3, but found %q", value)
+	}
+	return version, nil
+}
+
+// parseCipherSuites turns a comma-separated list of cipher suite names, like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, into their IDs.
+func parseCipherSuites(list string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range splitList(list) {
+		id, ok := ids[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// loadCertificates loads each of certFiles with the key in keyFiles at the
+// same position.
+func loadCertificates(certFiles, keyFiles []string) ([]tls.Certificate, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("%d certificates with %d private keys: -cert.file and -key.file have to be given in pairs", len(certFiles), len(keyFiles))
+	}
+	var certificates []tls.Certificate
+	for i, certFile := range certFiles {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("certificate: %s and private key: %s: %s", certFile, keyFiles[i], err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// selectCertificate returns a tls.Config.GetCertificate that picks the first
+// of certificates valid for the server name the client asked for via SNI,
+// or the first one if none is.
+func selectCertificate(certificates []tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	leafs := make([]*x509.Certificate, len(certificates))
+	for i, certificate := range certificates {
+		leafs[i] = certificate.Leaf
+		if leafs[i] == nil && len(certificate.Certificate) > 0 {
+			leafs[i], _ = x509.ParseCertificate(certificate.Certificate[0])
+		}
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" {
+			for i, leaf := range leafs {
+				if leaf != nil && leaf.VerifyHostname(hello.ServerName) == nil {
+					return &certificates[i], nil
+				}
+			}
+		}
+		return &certificates[0], nil
+	}
+}
+
+// listenerTLSConfig builds the TLS config of the listener for certificates,
+// with the protocol versions and cipher suites of -tls-min-version and
+// -tls-ciphers.
+func listenerTLSConfig(certificates []tls.Certificate) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, fmt.Errorf("-tls-min-version %s: %s", *tlsMinVersion, err)
+	}
+	cipherSuites, err := parseCipherSuites(*tlsCiphers)
+	if err != nil {
+		return nil, fmt.Errorf("-tls-ciphers %s: %s", *tlsCiphers, err)
+	}
+	config := &tls.Config{
+		Certificates: certificates,
+		NextProtos:   nextProtos,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	}
+	if len(certificates) > 0 {
+		config.GetCertificate = selectCertificate(certificates)
+	}
+	return config, nil
+}
+
+// loadListenerTLS returns the TLS config of the listeners, made from the
+// certificates of -cert.file and -key.file, or nil without them. If the
+// certificates fail to load, -tls-fail-open logs a warning and returns nil,
+// so that bare -l addresses are served without TLS rather than not at all.
+// Addresses given as https:// still need TLS.
+func loadListenerTLS() (*tls.Config, error) {
+	if len(*tlsPrivateKeys) == 0 {
+		return nil, nil
+	}
+	certificates, err := loadCertificates(*tlsCertificates, *tlsPrivateKeys)
+	if err != nil && *tlsFailOpen {
+		log.Printf("WARNING: Failed to load %s. Serving without TLS, because -tls-fail-open is set.", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return listenerTLSConfig(certificates)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	if version, err := parseTLSVersion("1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, but received %x: %v", version, err)
+	}
+	if _, err := parseTLSVersion("TLS1.2"); err == nil {
+		t.Errorf("Expected an error for an unknown version")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_rsa_with_aes_256_gcm_sha384")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("Expected two suites, but received %v: %v", suites, err)
+	}
+	if _, err := parseCipherSuites("TLS_NONE"); err == nil || !strings.Contains(err.Error(), "TLS_NONE") {
+		t.Errorf("Expected an error naming the unknown suite, but received %v", err)
+	}
+}
+
+func TestOldTLSVersionIsRejected(t *testing.T) {
+	defer func(version string) { *tlsMinVersion = version }(*tlsMinVersion)
+	*tlsMinVersion = "1.2"
+	certificateOwner := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certificateOwner.Close()
+
+	config, err := listenerTLSConfig(certificateOwner.TLS.Certificates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, newTestHandler(newTestBackend(t, http.StatusOK, "")), listener)
+
+	for version, accepted := range map[uint16]bool{tls.VersionTLS11: false, tls.VersionTLS12: true} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: version})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != accepted {
+			t.Errorf("Expected the handshake with version %x to succeed: %v, but received %v", version, accepted, err)
+		}
+	}
+}
+
+// newServerCertificate writes a self-signed certificate for host and its
+// key to files.
+func newServerCertificate(t *testing.T, host string) (certFile, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	return writePEM(t, dir, host+".crt", "CERTIFICATE", der), writePEM(t, dir, host+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestCertificateIsSelectedBySNI(t *testing.T) {
+	certA, keyA := newServerCertificate(t, "a.example.com")
+	certB, keyB := newServerCertificate(t, "b.example.com")
+	certificates, err := loadCertificates([]string{certA, certB}, []string{keyA, keyB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := listenerTLSConfig(certificates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(t, newTestHandler(newTestBackend(t, http.StatusOK, "")), listener)
+
+	for serverName, expectation := range map[string]string{"a.example.com": "a.example.com", "b.example.com": "b.example.com", "other.example.com": "a.example.com", "": "a.example.com"} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; received != expectation {
+			t.Errorf("Expected '%s' for SNI '%s', but received '%s'", expectation, serverName, received)
+		}
+		conn.Close()
+	}
+}
+
+func TestCertificatesNeedKeys(t *testing.T) {
+	certA, keyA := newServerCertificate(t, "a.example.com")
+	if _, err := loadCertificates([]string{certA, certA}, []string{keyA}); err == nil {
+		t.Errorf("Expected an error for a certificate without key")
+	}
+}
+
+func TestBadCertificateFailsOpenOnlyWhenAsked(t *testing.T) {
+	defer func(certs, keys []string, failOpen bool) {
+		*tlsCertificates, *tlsPrivateKeys, *tlsFailOpen = certs, keys, failOpen
+	}(*tlsCertificates, *tlsPrivateKeys, *tlsFailOpen)
+	*tlsCertificates = []string{writeConfig(t, "server.crt", "not a certificate")}
+	*tlsPrivateKeys = []string{writeConfig(t, "server.key", "not a key")}
+
+	*tlsFailOpen = false
+	if config, err := loadListenerTLS(); err == nil || config != nil {
+		t.Errorf("Expected an error for the bad certificate, but received %v", config)
+	}
+
+	*tlsFailOpen = true
+	output := captureLog(t)
+	config, err := loadListenerTLS()
+	if err != nil || config != nil {
+		t.Errorf("Expected no TLS and no error with -tls-fail-open, but received %v: %v", config, err)
+	}
+	if !strings.Contains(output.String(), "WARNING: Failed to load certificate") {
+		t.Errorf("Expected a warning, but received '%s'", output.String())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histogram.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricKey identifies one labelled series.
+type metricKey struct {
+	Origin      string
+	StatusClass string
+}
+
+type histogram struct {
+	Counts []uint64 // one per latency bucket, not cumulative
+	Count  uint64
+	Sum    float64
+}
+
+// metrics collects per-backend request statistics and serves them in the
+// Prometheus text format. A nil *metrics records nothing.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[metricKey]uint64
+	errors   map[string]uint64
+	latency  map[metricKey]*histogram
+	dropped  uint64
+
+	// Requests in progress, exposed as gauges once set by Track.
+	production *tracker
+	alternates *tracker
+}
+
+// backendMetrics is set in main when -metrics-listen is given.
+var backendMetrics *metrics
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[metricKey]uint64),
+		errors:   make(map[string]uint64),
+		latency:  make(map[metricKey]*histogram),
+	}
+}
+
+// statusClass turns a response into a label like "2xx", or "error" when the
+// backend did not answer.
+func statusClass(response *http.Response) string {
+	if response == nil {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", response.StatusCode/100)
+}
+
+// Observe records one request to origin that took duration.
+func (m *metrics) Observe(origin string, response *http.Response, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	key := metricKey{origin, statusClass(response)}
+	seconds := duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[key]++
+	if response == nil {
+		m.errors[origin]++
+	}
+	h := m.latency[key]
+	if h == nil {
+		h = &histogram{Counts: make([]uint64, len(latencyBuckets))}
+		m.latency[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.Counts[i]++
+			break
+		}
+	}
+	h.Count++
+	h.Sum += seconds
+}
+
+// Drop records one alternate request dropped because the queue was full or
+// -b.max-concurrency requests were in progress.
+func (m *metrics) Drop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+// Track exposes the requests in progress of production and alternates as
+// the gauges teeproxy_inflight_a and teeproxy_inflight_b.
+func (m *metrics) Track(production, alternates *tracker) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.production, m.alternates = production, alternates
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Expose(w)
+}
+
+// Expose writes all series in the Prometheus text exposition format.
+func (m *metrics) Expose(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Origin != keys[j].Origin {
+			return keys[i].Origin < keys[j].Origin
+		}
+		return keys[i].StatusClass < keys[j].StatusClass
+	})
+
+	fmt.Fprintln(w, "# HELP teeproxy_backend_requests_total Requests sent to a backend.")
+	fmt.Fprintln(w, "# TYPE teeproxy_backend_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "teeproxy_backend_requests_total{origin=%q,status_class=%q} %d\n", key.Origin, key.StatusClass, m.requests[key])
+	}
+
+	origins := make([]string, 0, len(m.errors))
+	for origin := range m.errors {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	fmt.Fprintln(w, "# HELP teeproxy_backend_errors_total Requests for which a backend returned no response.")
+	fmt.Fprintln(w, "# TYPE teeproxy_backend_errors_total counter")
+	for _, origin := range origins {
+		fmt.Fprintf(w, "teeproxy_backend_errors_total{origin=%q} %d\n", origin, m.errors[origin])
+	}
+
+	fmt.Fprintln(w, "# HELP teeproxy_alternate_dropped_total Alternate requests dropped because the queue or the concurrency limit was full.")
+	fmt.Fprintln(w, "# TYPE teeproxy_alternate_dropped_total counter")
+	fmt.Fprintf(w, "teeproxy_alternate_dropped_total %d\n", m.dropped)
+
+	if m.production != nil {
+		fmt.Fprintln(w, "# HELP teeproxy_inflight_a Inbound requests in progress.")
+		fmt.Fprintln(w, "# TYPE teeproxy_inflight_a gauge")
+		fmt.Fprintf(w, "teeproxy_inflight_a %d\n", m.production.Active())
+		fmt.Fprintln(w, "# HELP teeproxy_inflight_b Alternate requests in progress or queued.")
+		fmt.Fprintln(w, "# TYPE teeproxy_inflight_b gauge")
+		fmt.Fprintf(w, "teeproxy_inflight_b %d\n", m.alternates.Active())
+	}
+
+	fmt.Fprintln(w, "# HELP teeproxy_backend_request_duration_seconds Latency of backend requests.")
+	fmt.Fprintln(w, "# TYPE teeproxy_backend_request_duration_seconds histogram")
+	for _, key := range keys {
+		h := m.latency[key]
+		labels := fmt.Sprintf("origin=%q,status_class=%q", key.Origin, key.StatusClass)
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(w, "teeproxy_backend_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "teeproxy_backend_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.Count)
+		fmt.Fprintf(w, "teeproxy_backend_request_duration_seconds_sum{%s} %g\n", labels, h.Sum)
+		fmt.Fprintf(w, "teeproxy_backend_request_duration_seconds_count{%s} %d\n", labels, h.Count)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetrics()
+	m.Observe("A", &http.Response{StatusCode: 200}, 20*time.Millisecond)
+	m.Observe("A", &http.Response{StatusCode: 204}, 3*time.Millisecond)
+	m.Observe("B", nil, time.Second)
+	m.Drop()
+
+	output := new(bytes.Buffer)
+	m.Expose(output)
+	for _, expectation := range []string{
+		`teeproxy_backend_requests_total{origin="A",status_class="2xx"} 2`,
+		`teeproxy_backend_requests_total{origin="B",status_class="error"} 1`,
+		`teeproxy_backend_errors_total{origin="B"} 1`,
+		`teeproxy_alternate_dropped_total 1`,
+		`teeproxy_backend_request_duration_seconds_bucket{origin="A",status_class="2xx",le="0.005"} 1`,
+		`teeproxy_backend_request_duration_seconds_bucket{origin="A",status_class="2xx",le="0.025"} 2`,
+		`teeproxy_backend_request_duration_seconds_bucket{origin="B",status_class="error",le="0.5"} 0`,
+		`teeproxy_backend_request_duration_seconds_count{origin="B",status_class="error"} 1`,
+	} {
+		if !strings.Contains(output.String(), expectation+"\n") {
+			t.Errorf("Expected '%s' in output, but received '%s'", expectation, output)
+		}
+	}
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var m *metrics
+	m.Observe("A", nil, time.Second)
+}
+
+func TestInflightGauges(t *testing.T) {
+	m := newMetrics()
+	var production, alternates tracker
+	m.Track(&production, &alternates)
+	production.Start()
+	alternates.Start()
+	alternates.Start()
+	alternates.Done()
+
+	output := new(bytes.Buffer)
+	m.Expose(output)
+	for _, expectation := range []string{"teeproxy_inflight_a 1", "teeproxy_inflight_b 1"} {
+		if !strings.Contains(output.String(), expectation+"\n") {
+			t.Errorf("Expected '%s' in output, but received '%s'", expectation, output)
+		}
+	}
+}
+
+func TestInflightGaugesAfterPanic(t *testing.T) {
+	h := newTestHandler(newTestBackend(t, http.StatusOK, ""))
+	func() {
+		defer func() { recover() }()
+		// The writer panics when the production response is forwarded.
+		h.ServeHTTP(panickingWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil))
+	}()
+	if active := h.production.Active(); active != 0 {
+		t.Errorf("Expected no requests in progress, but received %d", active)
+	}
+}
+
+type panickingWriter struct{ http.ResponseWriter }
+
+func (panickingWriter) WriteHeader(int) { panic("write failed") }
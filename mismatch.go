@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mismatch is one file written by -diff-dir: the request and the responses
+// that differed from production.
+type mismatch struct {
+	RequestID  string                      `json:"request_id"`
+	Timestamp  string                      `json:"timestamp"`
+	Request    recordedMessage             `json:"request"`
+	Production *recordedMessage            `json:"production"`
+	Alternates map[string]*recordedMessage `json:"alternates"` // by origin, nil if it did not answer
+}
+
+// mismatchStore writes mismatches to Dir, one file per request, until Max
+// files are there. A nil *mismatchStore stores nothing.
+type mismatchStore struct {
+	Dir string
+	Max int
+
+	mu    sync.Mutex
+	count int
+}
+
+// newMismatchStore creates dir if needed. Files already in it count towards
+// max, so that restarts do not fill the disk either.
+func newMismatchStore(dir string, max int) (*mismatchStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &mismatchStore{Dir: dir, Max: max, count: len(existing)}, nil
+}
+
+// reserve reports whether there is room for one more file, and takes it.
+func (s *mismatchStore) reserve() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count >= s.Max {
+		return false
+	}
+	s.count++
+	if s.count == s.Max {
+		log.Printf("[%v] %v Stored %d mismatches in %s, storing no more", "X", time.Now().UTC(), s.Max, s.Dir)
+	}
+	return true
+}
+
+// Save writes req, whose body getBody returns, and the responses of
+// production and the alternates that differed from it, by origin.
+func (s *mismatchStore) Save(req *http.Request, getBody func() (io.ReadCloser, error), production *capturedResponse, alternates map[string]*capturedResponse) {
+	if s == nil || len(alternates) == 0 || !s.reserve() {
+		return
+	}
+	id := req.Header.Get(REQUEST_ID_HEADER)
+	if id == "" {
+		id = newRequestID()
+	}
+	entry := mismatch{
+		RequestID: id,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Request: recordedMessage{
+			Method: req.Method,
+			URI:    req.RequestURI,
+			Host:   req.Host,
+			Header: req.Header,
+		},
+		Production: production.Message(),
+		Alternates: make(map[string]*recordedMessage),
+	}
+	if getBody != nil {
+		if body, err := getBody(); err == nil {
+			entry.Request.Body, _ = io.ReadAll(body)
+			body.Close()
+		}
+	}
+	for origin, alternate := range alternates {
+		entry.Alternates[origin] = alternate.Message()
+	}
+
+	// The ID may come from the client, keep it from escaping Dir.
+	name := filepath.Join(s.Dir, strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)+".json")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Printf("[%v] %v Failed to store mismatch: %v", "X", time.Now().UTC(), err)
+		return
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(entry); err != nil {
+		log.Printf("[%v] %v Failed to store mismatch: %v", "X", time.Now().UTC(), err)
+	}
+}
+
+// Message turns c into a recorded response, or nil for a backend that did
+// not answer.
+func (c *capturedResponse) Message() *recordedMessage {
+	if c == nil {
+		return nil
+	}
+	return &recordedMessage{Status: c.Status, Header: c.Header, Body: c.Body.Bytes(), Truncated: c.Truncated}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func capturedBody(origin, body string) *capturedResponse {
+	captured := &capturedResponse{Origin: origin, Status: http.StatusOK, Header: http.Header{}}
+	captured.Body.WriteString(body)
+	return captured
+}
+
+// compareOne compares production with a single alternate response.
+func compareOne(req *http.Request, body string, production, alternate *capturedResponse, store *mismatchStore) {
+	alternates := make(chan alternateResult, 1)
+	alternates <- alternateResult{Origin: "B", Response: alternate}
+	getBody := func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader([]byte(body))), nil }
+	compareResponses(req, getBody, production, alternates, 1, store)
+}
+
+func TestMismatchIsStored(t *testing.T) {
+	captureLog(t)
+	store, err := newMismatchStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/path?q=1", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "../../etc/id-1")
+	compareOne(req, "hello", capturedBody("A", "production"), capturedBody("B", "alternate"), store)
+
+	file, err := os.ReadFile(filepath.Join(store.Dir, "______etc_id-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry mismatch
+	if err := json.Unmarshal(file, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.RequestID != "../../etc/id-1" || entry.Request.Method != "POST" || entry.Request.URI != "/path?q=1" || string(entry.Request.Body) != "hello" {
+		t.Errorf("Expected the POST request to /path?q=1, but received %+v", entry.Request)
+	}
+	if string(entry.Production.Body) != "production" || entry.Alternates["B"] == nil || string(entry.Alternates["B"].Body) != "alternate" {
+		t.Errorf("Expected both responses, but received '%s'", file)
+	}
+}
+
+func TestMatchIsNotStored(t *testing.T) {
+	store, err := newMismatchStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareOne(httptest.NewRequest("GET", "/", nil), "", capturedBody("A", "same"), capturedBody("B", "same"), store)
+	if files, _ := filepath.Glob(filepath.Join(store.Dir, "*")); len(files) != 0 {
+		t.Errorf("Expected no files, but received %v", files)
+	}
+}
+
+func TestMismatchesAreBounded(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "earlier.json"), nil, 0644)
+	store, err := newMismatchStore(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		compareOne(httptest.NewRequest("GET", "/", nil), "", capturedBody("A", "production"), nil, store)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 3 {
+		t.Errorf("Expected %d files, but received %v", 3, files)
+	}
+}
+
+func TestFailedAlternatesAreStoredByOrigin(t *testing.T) {
+	captureLog(t)
+	store, err := newMismatchStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "id-2")
+	alternates := make(chan alternateResult, 2)
+	alternates <- alternateResult{Origin: "B1"}
+	alternates <- alternateResult{Origin: "B2"}
+	compareResponses(req, nil, capturedBody("A", "production"), alternates, 2, store)
+
+	file, err := os.ReadFile(filepath.Join(store.Dir, "id-2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry mismatch
+	if err := json.Unmarshal(file, &entry); err != nil {
+		t.Fatal(err)
+	}
+	for _, origin := range []string{"B1", "B2"} {
+		if alternate, ok := entry.Alternates[origin]; !ok || alternate != nil {
+			t.Errorf("Expected the failure of %s, but received '%s'", origin, file)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// RequestObserver is told about every request to a backend, production or
+// alternate, just before it is sent. It must not change the request.
+type RequestObserver interface {
+	ObserveRequest(origin string, outbound *http.Request)
+}
+
+// ResponseObserver is told about the outcome of every request to a backend
+// once it is done. Observers are called on the goroutine of the request,
+// concurrently for different requests.
+type ResponseObserver interface {
+	ObserveResponse(exchange *Exchange)
+}
+
+// Exchange is a request to a backend and its outcome.
+type Exchange struct {
+	Origin   string         // "A", or "B", "B1", ... for the alternates
+	Request  *http.Request  // as received from the client
+	Outbound *http.Request  // as sent to the backend
+	Response *http.Response // nil if the request failed; the body is consumed
+	Duration time.Duration  // from sending the request until the response
+}
+
+// accessLogObserver writes the access log line of each exchange with
+// -verbose. It is the ResponseObserver of handlers configured without any.
+type accessLogObserver struct{}
+
+func (accessLogObserver) ObserveResponse(exchange *Exchange) {
+	if *verbose {
+		logAccess(exchange.Origin, exchange.Request, exchange.Response, exchange.Duration, exchange.Outbound.Host)
+	}
+}
+
+// observeRequest tells the RequestObservers of h that outbound is sent to
+// origin.
+func (h *handler) observeRequest(origin string, outbound *http.Request) {
+	for _, observer := range h.RequestObservers {
+		observer.ObserveRequest(origin, outbound)
+	}
+}
+
+// observeResponse tells the ResponseObservers of h how the request of origin
+// turned out.
+func (h *handler) observeResponse(origin string, req, outbound *http.Request, response *http.Response, duration time.Duration) {
+	if len(h.ResponseObservers) == 0 {
+		return
+	}
+	exchange := &Exchange{Origin: origin, Request: req, Outbound: outbound, Response: response, Duration: duration}
+	for _, observer := range h.ResponseObservers {
+		observer.ObserveResponse(exchange)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingObserver remembers what it was told, as "origin method status".
+type recordingObserver struct {
+	mu        sync.Mutex
+	requests  []string
+	responses []string
+}
+
+func (o *recordingObserver) ObserveRequest(origin string, outbound *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, origin+" "+outbound.Method)
+}
+
+func (o *recordingObserver) ObserveResponse(exchange *Exchange) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	status := "failed"
+	if exchange.Response != nil {
+		status = exchange.Response.Status
+	}
+	if exchange.Duration <= 0 {
+		status += " without a duration"
+	}
+	o.responses = append(o.responses, exchange.Origin+" "+exchange.Request.Method+" "+status)
+}
+
+func TestObserversSeeBothBackends(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusNotFound, "")
+	observer := &recordingObserver{}
+	h, err := NewHandler(HandlerConfig{
+		Production:        production.Address(),
+		Alternatives:      []string{alternate.Address()},
+		RequestObservers:  []RequestObserver{observer},
+		ResponseObservers: []ResponseObserver{observer},
+		Seed:              1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve(t, h, httptest.NewRequest("PUT", "/", strings.NewReader("body")))
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	sort.Strings(observer.requests)
+	sort.Strings(observer.responses)
+	if requests := strings.Join(observer.requests, ","); requests != "A PUT,B PUT" {
+		t.Errorf("Expected 'A PUT,B PUT', but received '%s'", requests)
+	}
+	if responses := strings.Join(observer.responses, ","); responses != "A PUT 200 OK,B PUT 404 Not Found" {
+		t.Errorf("Expected 'A PUT 200 OK,B PUT 404 Not Found', but received '%s'", responses)
+	}
+}
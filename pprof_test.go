@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPprofEndpoints(t *testing.T) {
+	m := http.NewServeMux()
+	handlePprof(m)
+	for path, expectation := range map[string]string{"/debug/pprof/": "goroutine", "/debug/pprof/heap?debug=1": "heap profile", "/debug/pprof/goroutine?debug=1": "goroutine profile"} {
+		recorder := httptest.NewRecorder()
+		m.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), expectation) {
+			t.Errorf("Expected a profile for %s, but received %d '%.100s'", path, recorder.Code, recorder.Body)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// preflightTimeout bounds each preflight request, so that a wrong address
+// is reported quickly at startup.
+const preflightTimeout = 2 * time.Second
+
+// preflight sends a test request to production and to every alternate, and
+// logs the status and latency of each. It returns an error naming the
+// backends that did not answer.
+func (h *handler) preflight() error {
+	var errs []error
+	check := func(origin, target string, transport http.RoundTripper, https bool) {
+		request, err := http.NewRequest(*preflightMethod, targetScheme(target)+"://"+targetHost(target)+*preflightPath, nil)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		if https {
+			request.URL.Scheme = "https"
+		}
+		start := time.Now()
+		response := handleRequest(origin, request, withDeadline(transport, preflightTimeout), 0, false)
+		if response == nil {
+			errs = append(errs, fmt.Errorf("%s %s is unreachable", origin, target))
+			return
+		}
+		response.Body.Close()
+		log.Printf("[%v] %v Preflight %v %v to %v: %v in %v", origin, time.Now().UTC(), request.Method, *preflightPath, target, response.StatusCode, time.Since(start))
+	}
+
+	check("A", h.Target, h.Transport, *productionHostSchemeHTTPS)
+	for i, alternative := range h.Alternatives {
+		if publisher := h.Publishers[alternative]; publisher != nil {
+			// A broker does not speak HTTP, it is only connected to.
+			conn, err := net.DialTimeout("tcp", publisher.Broker, preflightTimeout)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s is unreachable", publisher.Origin, alternative))
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		check(alternateOrigin(i, len(h.Alternatives)), alternative, h.AltTransport, *alternateHostSchemeHTTPS)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreflightReportsBackends(t *testing.T) {
+	output := captureLog(t)
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusNotFound, "")
+	h := newTestHandler(production, alternate)
+
+	if err := h.preflight(); err != nil {
+		t.Errorf("Expected no error, but received '%s'", err)
+	}
+	for _, expectation := range []string{"[A] ", "GET / to " + production.Address() + ": 200 in ", "[B] ", "GET / to " + alternate.Address() + ": 404 in "} {
+		if !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+		}
+	}
+}
+
+func TestPreflightFailsForUnreachableBackend(t *testing.T) {
+	defer func(path string) { *preflightPath = path }(*preflightPath)
+	*preflightPath = "/status"
+	production := newTestBackend(t, http.StatusOK, "")
+	unreachable := closedAddress(t)
+	h := newTestHandlerFor(production.Address(), unreachable)
+
+	err := h.preflight()
+	if err == nil || err.Error() != "B "+unreachable+" is unreachable" {
+		t.Errorf("Expected the alternate to be unreachable, but received '%v'", err)
+	}
+	if requests := production.Requests(); len(requests) != 1 || requests[0].URL.Path != "/status" {
+		t.Errorf("Expected one preflight request for /status, but received %d", len(requests))
+	}
+}
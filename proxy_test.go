@@ -0,0 +1,778 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend is a backend server that remembers the requests it received.
+type testBackend struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+// newTestBackend starts a backend answering every request with status and
+// body.
+func newTestBackend(t *testing.T, status int, body string) *testBackend {
+	b := &testBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ := io.ReadAll(req.Body)
+		b.mu.Lock()
+		b.requests = append(b.requests, req)
+		b.bodies = append(b.bodies, string(received))
+		b.mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Address returns the host:port of the backend, as given to -a and -b.
+func (b *testBackend) Address() string {
+	return strings.TrimPrefix(b.URL, "http://")
+}
+
+// Requests returns the requests received so far.
+func (b *testBackend) Requests() []*http.Request {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*http.Request(nil), b.requests...)
+}
+
+// Bodies returns the bodies of the requests received so far.
+func (b *testBackend) Bodies() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.bodies...)
+}
+
+// closedAddress returns an address on which nothing listens.
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestHandler(production *testBackend, alternates ...*testBackend) *handler {
+	var alternatives []string
+	for _, alternate := range alternates {
+		alternatives = append(alternatives, alternate.Address())
+	}
+	return newTestHandlerFor(production.Address(), alternatives...)
+}
+
+// newTestHandlerFor returns a handler for the given addresses, configured
+// from the flags that apply per request, with a fixed seed.
+func newTestHandlerFor(target string, alternatives ...string) *handler {
+	h, err := NewHandler(HandlerConfig{Production: target, Alternatives: alternatives, Seed: 1})
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// serve sends req through h and waits for the alternate requests to finish.
+func serve(t *testing.T, h *handler, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if abandoned := h.alternates.Wait(ctx); abandoned != 0 {
+		t.Fatalf("Expected alternate requests to finish, but %d are still running", abandoned)
+	}
+	return recorder
+}
+
+func TestMethodsAreProxied(t *testing.T) {
+	for _, method := range []string{"HEAD", "OPTIONS", "PURGE"} {
+		production := newTestBackend(t, http.StatusOK, "")
+		alternate := newTestBackend(t, http.StatusOK, "")
+		h := newTestHandler(production, alternate)
+
+		recorder := serve(t, h, httptest.NewRequest(method, "/resource", nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected status %d for %s, but received %d", http.StatusOK, method, recorder.Code)
+		}
+		if requests := production.Requests(); len(requests) != 1 || requests[0].Method != method {
+			t.Errorf("Expected one %s request to production, but received %d", method, len(requests))
+		}
+		if requests := alternate.Requests(); len(requests) != 1 || requests[0].Method != method {
+			t.Errorf("Expected one %s request to alternate, but received %d", method, len(requests))
+		}
+	}
+}
+
+func TestIgnoredMethodsOnlyGoToProduction(t *testing.T) {
+	for _, method := range []string{"HEAD", "OPTIONS", "PURGE"} {
+		production := newTestBackend(t, http.StatusNoContent, "")
+		alternate := newTestBackend(t, http.StatusOK, "")
+		h := newTestHandler(production, alternate)
+		h.IgnoredMethods = map[string]bool{"HEAD": true, "OPTIONS": true, "PURGE": true}
+
+		recorder := serve(t, h, httptest.NewRequest(method, "/resource", nil))
+		if recorder.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d for %s, but received %d", http.StatusNoContent, method, recorder.Code)
+		}
+		if requests := production.Requests(); len(requests) != 1 {
+			t.Errorf("Expected one %s request to production, but received %d", method, len(requests))
+		}
+		if requests := alternate.Requests(); len(requests) != 0 {
+			t.Errorf("Expected no %s request to alternate, but received %d", method, len(requests))
+		}
+	}
+}
+
+func TestAllowedMethodsAreTheOnlyOnesDuplicated(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h, err := NewHandler(HandlerConfig{
+		Production:   production.Address(),
+		Alternatives: []string{alternate.Address()},
+		Methods:      []string{"GET"},
+		Exclude:      "^/private",
+		Seed:         1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, h, httptest.NewRequest("POST", "/public", strings.NewReader("body")))
+	serve(t, h, httptest.NewRequest("GET", "/private", nil))
+	serve(t, h, httptest.NewRequest("GET", "/public", nil))
+
+	if requests := production.Requests(); len(requests) != 3 {
+		t.Errorf("Expected 3 requests to production, but received %d", len(requests))
+	}
+	if requests := alternate.Requests(); len(requests) != 1 || requests[0].Method != "GET" || requests[0].URL.Path != "/public" {
+		t.Errorf("Expected only GET /public on the alternate, but received %v", requests)
+	}
+}
+
+func TestVerboseLogWithFailedAlternate(t *testing.T) {
+	defer func(enabled bool) { *verbose = enabled }(*verbose)
+	*verbose = true
+	output := captureLog(t)
+
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production)
+	h.Alternatives = []string{closedAddress(t)}
+
+	recorder := serve(t, h, httptest.NewRequest("GET", "/resource", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but received %d", http.StatusOK, recorder.Code)
+	}
+	if expectation := "GET failed "; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s' in the log, but received '%s'", expectation, output)
+	}
+	if strings.Contains(output.String(), "Recovered") {
+		t.Errorf("Expected no panic, but received '%s'", output)
+	}
+}
+
+func TestRequestIsDuplicatedToEveryAlternate(t *testing.T) {
+	defer func(enabled bool) { *verbose = enabled }(*verbose)
+	*verbose = true
+	output := captureLog(t)
+
+	production := newTestBackend(t, http.StatusOK, "")
+	// Told apart in the log by their status.
+	alternates := []*testBackend{newTestBackend(t, http.StatusCreated, ""), newTestBackend(t, http.StatusAccepted, "")}
+	serve(t, newTestHandler(production, alternates...), httptest.NewRequest("POST", "/resource", strings.NewReader("payload")))
+
+	for i, alternate := range alternates {
+		if bodies := alternate.Bodies(); len(bodies) != 1 || bodies[0] != "payload" {
+			t.Errorf("Expected alternate %d to receive 'payload', but received %v", i, bodies)
+		}
+		origin, status := alternateOrigin(i, len(alternates)), http.StatusCreated+i
+		expectation := regexp.MustCompile(fmt.Sprintf(`\[%s\] .* POST %d `, origin, status))
+		if !expectation.MatchString(output.String()) {
+			t.Errorf("Expected a log line of %s with status %d, but received '%s'", origin, status, output)
+		}
+	}
+}
+
+func TestPathIncludeAndExclude(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, production)
+	h.Include = regexp.MustCompile("^/api/")
+	h.Exclude = regexp.MustCompile("^/api/admin")
+
+	for path, expectation := range map[string]bool{
+		"/api/users":             true,
+		"/api/users?admin=1":     true,
+		"/api/admin/users":       false,
+		"/api/admin?page=/api/x": false,
+		"/static/app.js":         false,
+		"/static?path=/api/x":    false,
+	} {
+		if duplicated := h.duplicates(httptest.NewRequest("GET", path, nil)); duplicated != expectation {
+			t.Errorf("Expected duplication %v for %s, but received %v", expectation, path, duplicated)
+		}
+	}
+}
+
+func TestHeaderMatches(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, production)
+	var matches headerMatchList
+	matches.Set("x-canary=true")
+	matches.Set("X-USER")
+	h.HeaderMatches = matches
+
+	for headers, expectation := range map[string]bool{
+		"X-Canary: true; X-User: 1":  true,
+		"x-canary: true; x-user: 2":  true,
+		"X-Canary: false; X-User: 1": false,
+		"X-Canary: true":             false,
+		"X-User: 1":                  false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, header := range strings.Split(headers, "; ") {
+			name, value, _ := strings.Cut(header, ": ")
+			req.Header.Add(name, value)
+		}
+		if duplicated := h.duplicates(req); duplicated != expectation {
+			t.Errorf("Expected duplication %v for %q, but received %v", expectation, headers, duplicated)
+		}
+	}
+}
+
+func TestTrailersAreForwarded(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.WriteString(w, "body")
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	defer production.Close()
+	proxy := httptest.NewServer(newTestHandlerFor(strings.TrimPrefix(production.URL, "http://")))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "body" {
+		t.Errorf("Expected body 'body', but received '%s'", body)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected trailer Grpc-Status '0', but received '%s'", status)
+	}
+	if message := resp.Trailer.Get("Grpc-Message"); message != "done" {
+		t.Errorf("Expected trailer Grpc-Message 'done', but received '%s'", message)
+	}
+}
+
+func TestTargetListWeights(t *testing.T) {
+	targets := &targetList{targets: []string{"localhost:8081"}, weights: []float64{1}}
+	if err := targets.Set("b1:80@3,b2:80"); err != nil {
+		t.Fatal(err)
+	}
+	if err := targets.Set("b3:80@0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "b1:80@3,b2:80@1,b3:80@0.5"; targets.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, targets.String())
+	}
+	for _, spec := range []string{"b:80@", "b:80@-1", "b:80@x", "kafka://broker:9092/", "kafka://broker:9092/a/b"} {
+		if err := (&targetList{}).Set(spec); err == nil {
+			t.Errorf("Expected an error for '%s'", spec)
+		}
+	}
+	if weights := (&targetList{}).Weights(); weights != nil {
+		t.Errorf("Expected no weights without a weighted address, but received %v", weights)
+	}
+}
+
+func TestWeightedAlternateIsChosenByWeight(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	heavy := newTestBackend(t, http.StatusOK, "")
+	light := newTestBackend(t, http.StatusOK, "")
+	excluded := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, heavy, light, excluded)
+	// Weights are relative: these are 75%, 25% and 0%.
+	h.Weights = []float64{6, 2, 0}
+
+	const count = 400
+	for i := 0; i < count; i++ {
+		serve(t, h, httptest.NewRequest("GET", "/", nil))
+	}
+	if requests := production.Requests(); len(requests) != count {
+		t.Errorf("Expected %d requests to production, but received %d", count, len(requests))
+	}
+	heavyCount, lightCount := len(heavy.Requests()), len(light.Requests())
+	if heavyCount+lightCount != count {
+		t.Errorf("Expected every request to go to exactly one alternate, but received %d and %d", heavyCount, lightCount)
+	}
+	if heavyCount < 250 || heavyCount > 350 {
+		t.Errorf("Expected about 300 requests to the heavy alternate, but received %d", heavyCount)
+	}
+	if requests := excluded.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no requests to the alternate of weight 0, but received %d", len(requests))
+	}
+}
+
+func TestDryRunLogsRoutingOnly(t *testing.T) {
+	defer func(enabled bool) { *dryRun = enabled }(*dryRun)
+	*dryRun = true
+	output := captureLog(t)
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	h.Exclude = regexp.MustCompile("^/admin")
+
+	for _, path := range []string{"/api", "/admin"} {
+		if recorder := serve(t, h, httptest.NewRequest("GET", path, nil)); recorder.Code != http.StatusNoContent {
+			t.Errorf("Expected status %d, but received %d", http.StatusNoContent, recorder.Code)
+		}
+	}
+	if requests := len(production.Requests()) + len(alternate.Requests()); requests != 0 {
+		t.Errorf("Expected no requests to the backends, but received %d", requests)
+	}
+	for _, expectation := range []string{`DRY-RUN method=GET uri="/api" to=A,B reason=sampled`, `DRY-RUN method=GET uri="/admin" to=A reason=excluded`} {
+		if !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+		}
+	}
+}
+
+func TestAlternateDelay(t *testing.T) {
+	defer func(min, max time.Duration) { *alternateDelayMin, *alternateDelayMax = min, max }(*alternateDelayMin, *alternateDelayMax)
+	*alternateDelayMin, *alternateDelayMax = 100*time.Millisecond, 200*time.Millisecond
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("Expected production not to be delayed, but took %v", elapsed)
+	}
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	// Both requests were delayed, so waiting for the second one covers the first.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Errorf("Expected the alternate to be delayed 100ms to 200ms, but took %v", elapsed)
+	}
+	if requests := alternate.Requests(); len(requests) != 2 {
+		t.Errorf("Expected 2 requests to the alternate, but received %d", len(requests))
+	}
+
+	for i := 0; i < 100; i++ {
+		if delay := h.alternateDelay(); delay < *alternateDelayMin || delay >= *alternateDelayMax {
+			t.Fatalf("Expected a delay between %v and %v, but received %v", *alternateDelayMin, *alternateDelayMax, delay)
+		}
+	}
+	*alternateDelayMax = 0
+	if delay := h.alternateDelay(); delay != *alternateDelayMin {
+		t.Errorf("Expected a fixed delay of %v, but received %v", *alternateDelayMin, delay)
+	}
+}
+
+func TestAlternateLagFollowsProduction(t *testing.T) {
+	defer func(lag time.Duration) { *alternateLag = lag }(*alternateLag)
+	defer func(enabled bool) { *streamBodies = enabled }(*streamBodies)
+	*alternateLag, *streamBodies = 100*time.Millisecond, true
+	var mu sync.Mutex
+	var answered, arrived time.Time
+	var body []byte
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.ReadAll(req.Body)
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		answered = time.Now()
+		mu.Unlock()
+	}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		arrived = time.Now()
+		body, _ = io.ReadAll(req.Body)
+	}))
+	defer alternate.Close()
+	h := newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"), strings.TrimPrefix(alternate.URL, "http://"))
+
+	serve(t, h, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	mu.Lock()
+	defer mu.Unlock()
+	if lag := arrived.Sub(answered); lag < *alternateLag {
+		t.Errorf("Expected the alternate %v after production answered, but it was %v", *alternateLag, lag)
+	}
+	if string(body) != "body" {
+		t.Errorf("Expected 'body', but received '%s'", body)
+	}
+}
+
+func TestAlternateMethodMap(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	var err error
+	if h.MethodMap, err = parseMethodMap("post=GET, PUT=GET"); err != nil {
+		t.Fatal(err)
+	}
+
+	for method, expectation := range map[string]string{"POST": "GET", "PUT": "GET", "DELETE": "DELETE"} {
+		serve(t, h, httptest.NewRequest(method, "/", strings.NewReader("body")))
+		productionRequests, alternateRequests := production.Requests(), alternate.Requests()
+		if received := productionRequests[len(productionRequests)-1].Method; received != method {
+			t.Errorf("Expected %s to production, but received %s", method, received)
+		}
+		if received := alternateRequests[len(alternateRequests)-1].Method; received != expectation {
+			t.Errorf("Expected %s to the alternate for %s, but received %s", expectation, method, received)
+		}
+		if bodies := alternate.Bodies(); bodies[len(bodies)-1] != "body" {
+			t.Errorf("Expected the body to be kept for %s, but received '%s'", method, bodies[len(bodies)-1])
+		}
+	}
+
+	if _, err := parseMethodMap("POST"); err == nil {
+		t.Errorf("Expected an error for a mapping without target method")
+	}
+}
+
+func TestAddHeadersPerOrigin(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	h.AddHeaders, h.AltAddHeaders = make(headerList), make(headerList)
+	for _, spec := range []string{"X-Origin:A", "X-Both:production"} {
+		if err := h.AddHeaders.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, spec := range []string{"X-Shadow:1", "X-Both:alternate"} {
+		if err := h.AltAddHeaders.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("body"))
+	req.Header.Set("X-Both", "client")
+	serve(t, h, req)
+	productionHeader, alternateHeader := production.Requests()[0].Header, alternate.Requests()[0].Header
+	if productionHeader.Get("X-Origin") != "A" || productionHeader.Get("X-Both") != "production" || productionHeader.Get("X-Shadow") != "" {
+		t.Errorf("Expected only the production headers on production, but received %v", productionHeader)
+	}
+	if alternateHeader.Get("X-Shadow") != "1" || alternateHeader.Get("X-Both") != "alternate" || alternateHeader.Get("X-Origin") != "" {
+		t.Errorf("Expected only the alternate headers on the alternate, but received %v", alternateHeader)
+	}
+
+	if err := make(headerList).Set("X-Shadow"); err == nil {
+		t.Errorf("Expected an error for a header without value")
+	}
+}
+
+func TestUserAgentSuffix(t *testing.T) {
+	defer func(suffix string) { *alternateUASuffix = suffix }(*alternateUASuffix)
+	*alternateUASuffix = " teeproxy-shadow"
+	for userAgent, expectation := range map[string]string{"curl/8.0": "curl/8.0 teeproxy-shadow", "": "teeproxy-shadow"} {
+		production := newTestBackend(t, http.StatusOK, "")
+		alternate := newTestBackend(t, http.StatusOK, "")
+		req := httptest.NewRequest("GET", "/", nil)
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		serve(t, newTestHandler(production, alternate), req)
+
+		if received := alternate.Requests()[0].UserAgent(); received != expectation {
+			t.Errorf("Expected User-Agent '%s' on the alternate, but received '%s'", expectation, received)
+		}
+		if received := production.Requests()[0].UserAgent(); strings.Contains(received, "teeproxy-shadow") || (userAgent != "" && received != userAgent) {
+			t.Errorf("Expected User-Agent '%s' untouched on production, but received '%s'", userAgent, received)
+		}
+	}
+}
+
+func TestChunkedBodyIsSentWithLength(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	// Without a known length, the client sends the body chunked.
+	body := io.MultiReader(strings.NewReader("chunked "), strings.NewReader("upload"))
+	resp, err := http.Post(proxy.URL, "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+
+	for name, backend := range map[string]*testBackend{"production": production, "the alternate": alternate} {
+		requests, bodies := backend.Requests(), backend.Bodies()
+		if len(requests) != 1 || bodies[0] != "chunked upload" {
+			t.Fatalf("Expected the body on %s, but received %q", name, bodies)
+		}
+		if requests[0].ContentLength != 14 || len(requests[0].TransferEncoding) != 0 {
+			t.Errorf("Expected a Content-Length of 14 on %s, but received %d and %v", name, requests[0].ContentLength, requests[0].TransferEncoding)
+		}
+	}
+}
+
+func TestDuplicatedRequestsHaveOwnHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Shared", "original")
+	requests := DuplicateRequests(req, 2)
+	requests[1].Header.Set("X-Shared", "changed")
+	if value := requests[0].Header.Get("X-Shared"); value != "original" {
+		t.Errorf("Expected '%s', but received '%s'", "original", value)
+	}
+	if value := req.Header.Get("X-Shared"); value != "original" {
+		t.Errorf("Expected the inbound request to keep '%s', but received '%s'", "original", value)
+	}
+}
+
+func TestDuplicateRequestIsIndependent(t *testing.T) {
+	req := httptest.NewRequest("GET", "/path", nil)
+	req.Header.Set("X-Shared", "original")
+	request1, request2 := DuplicateRequest(req)
+	request1.Header.Set("X-Shared", "changed")
+	request1.Header.Set("X-New", "1")
+	request1.URL.Scheme = "https"
+	request1.URL.Path = "/changed"
+	if value := request2.Header.Get("X-Shared"); value != "original" || request2.Header.Get("X-New") != "" {
+		t.Errorf("Expected the headers of request2 to be unchanged, but received %v", request2.Header)
+	}
+	if request2.URL.String() != "/path" || req.URL.String() != "/path" {
+		t.Errorf("Expected the URL of request2 to be unchanged, but received '%s'", request2.URL)
+	}
+}
+
+func TestClientDisconnectCancelsProduction(t *testing.T) {
+	defer func(enabled bool) { *debug = enabled }(*debug)
+	*debug = true
+	output := captureLog(t)
+	canceled := make(chan bool, 1)
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(make([]byte, 64*1024))
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-req.Context().Done():
+				canceled <- true
+				return
+			case <-time.After(5 * time.Second):
+				canceled <- false
+				return
+			case <-time.After(10 * time.Millisecond):
+				w.Write(make([]byte, 64*1024))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer production.Close()
+	h := newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"))
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(resp.Body, make([]byte, 1024))
+	resp.Body.Close()
+
+	if !<-canceled {
+		t.Errorf("Expected the production request to be canceled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.production.Wait(ctx)
+	if expectation := "Failed to forward the response to "; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+	}
+}
+
+func TestStalledBodyIsCutAtTheTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { *productionTimeout = timeout }(*productionTimeout)
+	*productionTimeout = 200 * time.Millisecond
+	output := captureLog(t)
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write(make([]byte, 10))
+		w.(http.Flusher).Flush()
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer production.Close()
+	h := newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"))
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	start := time.Now()
+	resp, err := http.Get(proxy.URL + "/stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(body) != 10 {
+		t.Errorf("Expected a truncated body of 10 bytes, but received %d bytes and %v", len(body), err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the body to be cut at the timeout, but it took %v", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.production.Wait(ctx)
+	if expectation := "Failed to read the response to GET /stalled: read 10 of 100 bytes of the body: context deadline exceeded"; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+	}
+}
+
+func TestAddPathPrefix(t *testing.T) {
+	for _, test := range []struct{ prefix, path, expectation string }{
+		{"", "/users", "/users"},
+		{"/", "/users", "/users"},
+		{"/v2", "/users", "/v2/users"},
+		{"v2/", "/users?id=1", "/v2/users?id=1"},
+		{"/api/v2/", "/", "/api/v2/"},
+		{"/v2", "/a%2Fb", "/v2/a%2Fb"},
+	} {
+		request := httptest.NewRequest("GET", test.path, nil)
+		setRequestTarget(request, "backend:80")
+		addPathPrefix(request, test.prefix)
+		if received := request.URL.RequestURI(); received != test.expectation {
+			t.Errorf("Expected '%s' for '%s' + '%s', but received '%s'", test.expectation, test.prefix, test.path, received)
+		}
+	}
+}
+
+func TestAlternatePathPrefix(t *testing.T) {
+	defer func(prefix string) { *alternatePathPrefix = prefix }(*alternatePathPrefix)
+	*alternatePathPrefix = "/v2"
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	serve(t, newTestHandler(production, alternate), httptest.NewRequest("GET", "/users", nil))
+	if path := production.Requests()[0].URL.Path; path != "/users" {
+		t.Errorf("Expected '%s' on production, but received '%s'", "/users", path)
+	}
+	if path := alternate.Requests()[0].URL.Path; path != "/v2/users" {
+		t.Errorf("Expected '%s' on the alternate, but received '%s'", "/v2/users", path)
+	}
+}
+
+func TestProductionPathPrefixKeepsTheLoggedRequest(t *testing.T) {
+	defer func(prefix string) { *productionPathPrefix = prefix }(*productionPathPrefix)
+	defer func(enabled bool) { *verbose = enabled }(*verbose)
+	*productionPathPrefix, *verbose = "/v1", true
+	output := captureLog(t)
+	production := newTestBackend(t, http.StatusOK, "")
+	h, err := NewHandler(HandlerConfig{
+		Production:   production.Address(),
+		RewriteRules: writeRewriteRules(t, `[{"scope": "a", "match": "^/old$", "replace": "/new"}]`),
+		Seed:         1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/old", nil)
+	serve(t, h, req)
+
+	if path := production.Requests()[0].URL.Path; path != "/v1/new" {
+		t.Errorf("Expected '%s' on production, but received '%s'", "/v1/new", path)
+	}
+	if req.URL.Path != "/old" || req.RequestURI != "/old" {
+		t.Errorf("Expected the inbound request to stay /old, but received %s and %s", req.URL.Path, req.RequestURI)
+	}
+	if expectation := " example.com /old "; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s' in the log, but received '%s'", expectation, output)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	id := production.Requests()[0].Header.Get(REQUEST_ID_HEADER)
+	if len(id) != 36 {
+		t.Errorf("Expected a UUID, but received '%s'", id)
+	}
+	if received := alternate.Requests()[0].Header.Get(REQUEST_ID_HEADER); received != id {
+		t.Errorf("Expected '%s', but received '%s'", id, received)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "client-id")
+	serve(t, h, req)
+	if received := production.Requests()[1].Header.Get(REQUEST_ID_HEADER); received != "client-id" {
+		t.Errorf("Expected '%s', but received '%s'", "client-id", received)
+	}
+	if received := alternate.Requests()[1].Header.Get(REQUEST_ID_HEADER); received != "client-id" {
+		t.Errorf("Expected '%s', but received '%s'", "client-id", received)
+	}
+}
+
+func TestBasicAuthIsSetOnTheConfiguredSide(t *testing.T) {
+	defer func(credentials string) { *alternateBasicAuth = credentials }(*alternateBasicAuth)
+	*alternateBasicAuth = "shadow:s3cr:et"
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	serve(t, newTestHandler(production, alternate), httptest.NewRequest("GET", "/", nil))
+
+	if user, password, ok := alternate.Requests()[0].BasicAuth(); !ok || user != "shadow" || password != "s3cr:et" {
+		t.Errorf("Expected '%s', but received '%s:%s'", *alternateBasicAuth, user, password)
+	}
+	if authorization := production.Requests()[0].Header.Get("Authorization"); authorization != "" {
+		t.Errorf("Expected no credentials on production, but received '%s'", authorization)
+	}
+}
+
+func TestAlternateWithoutBody(t *testing.T) {
+	defer func(noBody bool) { *alternateNoBody = noBody }(*alternateNoBody)
+	*alternateNoBody = true
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	serve(t, newTestHandler(production, alternate), httptest.NewRequest("POST", "/upload", strings.NewReader("large upload")))
+
+	if body := production.Bodies()[0]; body != "large upload" {
+		t.Errorf("Expected '%s' on production, but received '%s'", "large upload", body)
+	}
+	if body := alternate.Bodies()[0]; body != "" {
+		t.Errorf("Expected no body on the alternate, but received '%s'", body)
+	}
+	if request := alternate.Requests()[0]; request.Method != "POST" || request.URL.Path != "/upload" || request.ContentLength != 0 {
+		t.Errorf("Expected an empty POST to /upload, but received %v %v with %d bytes", request.Method, request.URL.Path, request.ContentLength)
+	}
+}
+
+func TestProductionDownAnswersBadGateway(t *testing.T) {
+	recorder := serve(t, newTestHandlerFor(closedAddress(t)), httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway || recorder.Body.String() != "Bad gateway\n" {
+		t.Errorf("Expected %d 'Bad gateway', but received %d '%s'", http.StatusBadGateway, recorder.Code, recorder.Body)
+	}
+}
+
+func TestConfiguredProductionError(t *testing.T) {
+	defer func(status int, body string) { *errorStatus, *errorBody = status, body }(*errorStatus, *errorBody)
+	*errorStatus, *errorBody = http.StatusServiceUnavailable, "try again later"
+	recorder := serve(t, newTestHandlerFor(closedAddress(t)), httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != "try again later" {
+		t.Errorf("Expected %d '%s', but received %d '%s'", http.StatusServiceUnavailable, *errorBody, recorder.Code, recorder.Body)
+	}
+}
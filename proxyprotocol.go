@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// proxyHeaderKey is the context key of the PROXY protocol header that is
+// written to a backend connection before the request.
+type proxyHeaderKey struct{}
+
+// proxyProtocolHeader builds the PROXY protocol v1 header for a client at
+// remoteAddr that connected to localAddr.
+func proxyProtocolHeader(remoteAddr string, localAddr net.Addr) string {
+	sourceHost, sourcePort, err := net.SplitHostPort(remoteAddr)
+	source := net.ParseIP(sourceHost)
+	destination, ok := localAddr.(*net.TCPAddr)
+	if err != nil || source == nil || !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	// Both addresses have to be of the same family. Mixed ones are sent as
+	// IPv6, with the IPv4 address mapped.
+	if source.To4() != nil && destination.IP.To4() != nil {
+		return fmt.Sprintf("PROXY TCP4 %s %s %s %d\r\n", source.To4(), destination.IP.To4(), sourcePort, destination.Port)
+	}
+	return fmt.Sprintf("PROXY TCP6 %s %s %s %d\r\n", ipv6String(source), ipv6String(destination.IP), sourcePort, destination.Port)
+}
+
+// ipv6String formats ip in IPv6 notation, also if it is an IPv4 address.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+// withProxyHeader returns a copy of request that makes the dialer send the
+// PROXY protocol header for the client of inbound first.
+func withProxyHeader(request, inbound *http.Request) *http.Request {
+	localAddr, _ := inbound.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	header := proxyProtocolHeader(inbound.RemoteAddr, localAddr)
+	return request.WithContext(context.WithValue(request.Context(), proxyHeaderKey{}, header))
+}
+
+// proxyProtocolDialer wraps dial so that it writes the PROXY protocol header
+// from the context, if any, to new connections.
+func proxyProtocolDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if header, ok := ctx.Value(proxyHeaderKey{}).(string); ok {
+			if _, err := io.WriteString(conn, header); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
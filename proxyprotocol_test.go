@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	for _, c := range []struct {
+		remoteAddr  string
+		localAddr   net.Addr
+		expectation string
+	}{
+		{"192.168.0.1:56324", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8888}, "PROXY TCP4 192.168.0.1 10.0.0.1 56324 8888\r\n"},
+		{"[2001:db8::1]:56324", &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8888}, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 8888\r\n"},
+		{"[2001:db8::1]:56324", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8888}, "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 56324 8888\r\n"},
+		{"192.168.0.1", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8888}, "PROXY UNKNOWN\r\n"},
+		{"192.168.0.1:56324", nil, "PROXY UNKNOWN\r\n"},
+	} {
+		if header := proxyProtocolHeader(c.remoteAddr, c.localAddr); header != c.expectation {
+			t.Errorf("Expected '%q', but received '%q'", c.expectation, header)
+		}
+	}
+}
+
+func TestProxyProtocolIsSentToBackend(t *testing.T) {
+	defer func(enabled bool) { *proxyProtocol = enabled }(*proxyProtocol)
+	*proxyProtocol = true
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header, _ := reader.ReadString('\n')
+		headers <- header
+		if _, err := http.ReadRequest(reader); err == nil {
+			conn.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+		}
+	}()
+
+	h := newTestHandlerFor(backend.Addr().String())
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[2001:db8::1]:56324"
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8888}))
+	if recorder := serve(t, h, req); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, but received %d", http.StatusNoContent, recorder.Code)
+	}
+	if expectation := "PROXY TCP6 2001:db8::1 2001:db8::2 56324 8888\r\n"; <-headers != expectation {
+		t.Errorf("Expected the backend to receive '%q'", expectation)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// queueReportInterval is how often a queue that dropped requests says so.
+const queueReportInterval = time.Minute
+
+// alternateQueue runs alternate requests on a fixed number of workers. When
+// its buffer is full, new requests are dropped instead of waiting, so that
+// production traffic is never held up by a slow alternate.
+type alternateQueue struct {
+	jobs     chan func()
+	accepted atomic.Int64
+	dropped  atomic.Int64
+}
+
+func newAlternateQueue(workers, size int) *alternateQueue {
+	q := &alternateQueue{jobs: make(chan func(), size)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *alternateQueue) work() {
+	for job := range q.jobs {
+		job()
+	}
+}
+
+// Submit queues job without blocking. It returns false if the queue is full
+// and the job was dropped.
+func (q *alternateQueue) Submit(job func()) bool {
+	select {
+	case q.jobs <- job:
+		q.accepted.Add(1)
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+// reportDrops logs the share of dropped requests every interval in which
+// there were any.
+func (q *alternateQueue) reportDrops(interval time.Duration) {
+	reportDrops("Alternate queue full", &q.accepted, &q.dropped, interval)
+}
+
+func reportDrops(reason string, accepted, dropped *atomic.Int64, interval time.Duration) {
+	var a, d int64
+	for range time.Tick(interval) {
+		nowAccepted, nowDropped := accepted.Load(), dropped.Load()
+		if nowDropped > d {
+			log.Printf("[%v] %v %s: dropped %d of %d requests in the last %v",
+				"X", time.Now().UTC(), reason, nowDropped-d, nowDropped-d+nowAccepted-a, interval)
+		}
+		a, d = nowAccepted, nowDropped
+	}
+}
+
+// alternateLimit caps the number of alternate requests in progress at once.
+// Requests beyond the cap are dropped instead of waiting, like those of a
+// full queue.
+type alternateLimit struct {
+	slots    chan struct{}
+	accepted atomic.Int64
+	dropped  atomic.Int64
+}
+
+func newAlternateLimit(max int) *alternateLimit {
+	return &alternateLimit{slots: make(chan struct{}, max)}
+}
+
+// Acquire takes a slot without blocking. It returns false if all slots are
+// taken and the request was dropped.
+func (l *alternateLimit) Acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.accepted.Add(1)
+		return true
+	default:
+		l.dropped.Add(1)
+		return false
+	}
+}
+
+// Release gives back a slot taken by Acquire.
+func (l *alternateLimit) Release() {
+	<-l.slots
+}
+
+func (l *alternateLimit) reportDrops(interval time.Duration) {
+	reportDrops("Alternate concurrency limit reached", &l.accepted, &l.dropped, interval)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueDropsWhenFull(t *testing.T) {
+	q := newAlternateQueue(0, 2)
+	for i, expectation := range []bool{true, true, false, false} {
+		if accepted := q.Submit(func() {}); accepted != expectation {
+			t.Errorf("Expected submission %d to be accepted: %v, but received %v", i, expectation, accepted)
+		}
+	}
+	if q.accepted.Load() != 2 || q.dropped.Load() != 2 {
+		t.Errorf("Expected 2 accepted and 2 dropped, but received %d and %d", q.accepted.Load(), q.dropped.Load())
+	}
+}
+
+func TestQueueRunsJobs(t *testing.T) {
+	q := newAlternateQueue(2, 10)
+	done := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		i := i
+		q.Submit(func() { done <- i })
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+}
+
+func TestLimitDropsWhenFull(t *testing.T) {
+	l := newAlternateLimit(2)
+	for i, expectation := range []bool{true, true, false} {
+		if accepted := l.Acquire(); accepted != expectation {
+			t.Errorf("Expected acquisition %d to be accepted: %v, but received %v", i, expectation, accepted)
+		}
+	}
+	l.Release()
+	if !l.Acquire() {
+		t.Errorf("Expected a released slot to be available again")
+	}
+	if l.accepted.Load() != 3 || l.dropped.Load() != 1 {
+		t.Errorf("Expected 3 accepted and 1 dropped, but received %d and %d", l.accepted.Load(), l.dropped.Load())
+	}
+}
+
+func TestMaxConcurrencyUnderBurst(t *testing.T) {
+	release := make(chan struct{})
+	var inProgress, most, received atomic.Int64
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received.Add(1)
+		n := inProgress.Add(1)
+		defer inProgress.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		<-release
+	}))
+	defer alternate.Close()
+	production := newTestBackend(t, http.StatusOK, "OK")
+
+	h := newTestHandlerFor(production.Address(), alternate.Listener.Addr().String())
+	h.Limit = newAlternateLimit(3)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/burst", nil))
+		}()
+	}
+	wg.Wait()
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+
+	if len(production.Requests()) != 50 {
+		t.Errorf("Expected production to receive all 50 requests, but received %d", len(production.Requests()))
+	}
+	if most.Load() > 3 || received.Load() > 3 {
+		t.Errorf("Expected at most 3 alternate requests, but received %d, %d at once", received.Load(), most.Load())
+	}
+	if h.Limit.accepted.Load()+h.Limit.dropped.Load() != 50 || h.Limit.dropped.Load() < 47 {
+		t.Errorf("Expected at least 47 of 50 dropped, but received %d accepted and %d dropped", h.Limit.accepted.Load(), h.Limit.dropped.Load())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens left for a client, refilled at a rate per
+// second up to a burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one. Otherwise it returns how long it
+// takes until there is.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter limits the inbound requests, globally or per client IP.
+type rateLimiter struct {
+	Rate  float64 // requests per second
+	Burst float64
+	PerIP bool
+
+	mu      sync.Mutex
+	global  tokenBucket
+	buckets map[string]*tokenBucket
+	now     func() time.Time // for tests
+}
+
+// maxRateLimitBuckets bounds the per IP buckets kept in memory; beyond it,
+// buckets of clients that have been idle long enough to be full are removed.
+const maxRateLimitBuckets = 10000
+
+func newRateLimiter(rate, burst float64, perIP bool) *rateLimiter {
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{Rate: rate, Burst: burst, PerIP: perIP, buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// Allow reports whether req is admitted, and if not, when to retry.
+func (l *rateLimiter) Allow(req *http.Request) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.PerIP {
+		return l.global.take(now, l.Rate, l.Burst)
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	bucket := l.buckets[ip]
+	if bucket == nil {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.evictFull(now)
+		}
+		bucket = &tokenBucket{}
+		l.buckets[ip] = bucket
+	}
+	return bucket.take(now, l.Rate, l.Burst)
+}
+
+func (l *rateLimiter) evictFull(now time.Time) {
+	refill := time.Duration(l.Burst / l.Rate * float64(time.Second))
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// rejectTooManyRequests answers 429 with a Retry-After of wait, rounded up
+// to seconds.
+func rejectTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func requestFrom(remoteAddr string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+// admitted counts how many of count requests from remoteAddr l admits.
+func admitted(l *rateLimiter, remoteAddr string, count int) int {
+	n := 0
+	for i := 0; i < count; i++ {
+		if ok, _ := l.Allow(requestFrom(remoteAddr)); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRateLimiterAdmitsRate(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(10, 0, false)
+	l.now = func() time.Time { return now }
+
+	if n := admitted(l, "192.168.0.1:80", 20); n != 10 {
+		t.Errorf("Expected a burst of 10, but received %d", n)
+	}
+	if ok, wait := l.Allow(requestFrom("192.168.0.2:80")); ok || wait != 100*time.Millisecond {
+		t.Errorf("Expected to wait 100ms, but received %v, %v", ok, wait)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if n := admitted(l, "192.168.0.3:80", 20); n != 5 {
+		t.Errorf("Expected 5 requests after 500ms, but received %d", n)
+	}
+	now = now.Add(time.Hour)
+	if n := admitted(l, "192.168.0.3:80", 20); n != 10 {
+		t.Errorf("Expected the burst not to exceed 10, but received %d", n)
+	}
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(2, 4, true)
+	l.now = func() time.Time { return now }
+
+	if n := admitted(l, "192.168.0.1:80", 10); n != 4 {
+		t.Errorf("Expected a burst of 4 for the first client, but received %d", n)
+	}
+	if n := admitted(l, "192.168.0.1:81", 10); n != 0 {
+		t.Errorf("Expected no more requests for the first client from another port, but received %d", n)
+	}
+	if n := admitted(l, "[2001:db8::1]:80", 10); n != 4 {
+		t.Errorf("Expected a burst of 4 for the second client, but received %d", n)
+	}
+}
+
+func TestRateLimitedRequestsGet429(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production)
+	h.RateLimiter = newRateLimiter(0.5, 1, false)
+
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	recorder := serve(t, h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected status %d with Retry-After 2, but received %d with '%s'", http.StatusTooManyRequests, recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if requests := production.Requests(); len(requests) != 1 {
+		t.Errorf("Expected one request to production, but received %d", len(requests))
+	}
+}
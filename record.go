@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recordQueueSize is the number of records waiting to be written before new
+// ones are dropped.
+const recordQueueSize = 1024
+
+// recordEntry is one line of the record file: an alternate request and the
+// response to it.
+type recordEntry struct {
+	Timestamp  string           `json:"timestamp"`
+	Origin     string           `json:"origin"`
+	Target     string           `json:"target"`
+	Sampling   string           `json:"sampling"` // "all", "key" or "random"
+	Percent    float64          `json:"percent"`
+	DurationMS float64          `json:"duration_ms"`
+	Request    recordedMessage  `json:"request"`
+	Response   *recordedMessage `json:"response"` // nil if the backend did not answer
+}
+
+// recordedMessage is a recorded request or response. Bodies are capped at
+// -record-max-body bytes, and are missing for streamed requests.
+type recordedMessage struct {
+	Method    string      `json:"method,omitempty"`
+	URI       string      `json:"uri,omitempty"`
+	Host      string      `json:"host,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// newRecordEntry records alternativeRequest, the copy of req sent to target.
+func newRecordEntry(origin, target string, alternativeRequest, req *http.Request, sampling string) *recordEntry {
+	header := alternativeRequest.Header
+	if *alternateBasicAuth != "" {
+		// The credentials of -b.basic-auth stay out of the file, replay
+		// sets them again.
+		header = header.Clone()
+		header.Del("Authorization")
+	}
+	entry := &recordEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Origin:    origin,
+		Target:    target,
+		Sampling:  sampling,
+		Percent:   percent.Load(),
+		Request: recordedMessage{
+			Method: alternativeRequest.Method,
+			URI:    req.RequestURI,
+			Host:   alternativeRequest.Host,
+			Header: header,
+		},
+	}
+	if alternativeRequest.GetBody != nil {
+		if body, err := alternativeRequest.GetBody(); err == nil {
+			entry.Request.SetBody(readRecordedBody(body))
+			body.Close()
+		}
+	}
+	return entry
+}
+
+// SetResponse records response, which took duration. It reads the recorded
+// part of the body and puts it back in front of the rest, so the caller can
+// still read the whole body.
+func (e *recordEntry) SetResponse(response *http.Response, duration time.Duration) {
+	e.DurationMS = float64(duration) / float64(time.Millisecond)
+	if response == nil {
+		return
+	}
+	e.Response = &recordedMessage{Status: response.StatusCode, Header: response.Header}
+	prefix := readRecordedBody(response.Body)
+	e.Response.SetBody(prefix)
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), response.Body), response.Body}
+}
+
+// readRecordedBody reads one byte more than -record-max-body of body, to
+// tell whether the body is truncated.
+func readRecordedBody(body io.Reader) []byte {
+	prefix, _ := io.ReadAll(io.LimitReader(body, int64(*recordMaxBody)+1))
+	return prefix
+}
+
+// SetBody records prefix, capped at -record-max-body bytes.
+func (m *recordedMessage) SetBody(prefix []byte) {
+	if len(prefix) > *recordMaxBody {
+		prefix, m.Truncated = prefix[:*recordMaxBody], true
+	}
+	m.Body = prefix
+}
+
+// recorder writes records as JSON lines in the background, so that a slow
+// disk does not hold up the alternates. Records that do not fit in the queue
+// are dropped.
+type recorder struct {
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+	entries chan *recordEntry
+	done    chan struct{}
+	file    io.WriteCloser
+}
+
+func newRecorder(file io.WriteCloser) *recorder {
+	r := &recorder{
+		entries: make(chan *recordEntry, recordQueueSize),
+		done:    make(chan struct{}),
+		file:    file,
+	}
+	go r.run()
+	return r
+}
+
+// Record queues entry to be written, unless the queue is full or the
+// recorder is closed.
+func (r *recorder) Record(entry *recordEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.entries <- entry:
+	default:
+		r.dropped++
+	}
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	w := bufio.NewWriter(r.file)
+	encoder := json.NewEncoder(w)
+	for entry := range r.entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("[%v] %v Failed to record request: %v", "X", time.Now().UTC(), err)
+		}
+		// Flush whenever the queue runs empty, so the file stays current.
+		if len(r.entries) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+// Close writes the queued records and closes the file. Records after Close
+// are discarded.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	close(r.entries)
+	dropped := r.dropped
+	r.mu.Unlock()
+
+	<-r.done
+	if dropped > 0 {
+		log.Printf("[%v] %v Dropped %d records because the record file could not keep up", "X", time.Now().UTC(), dropped)
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordBuffer is a record file in memory.
+type recordBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *recordBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestAlternateTrafficIsRecorded(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "production")
+	alternate := newTestBackend(t, http.StatusCreated, "alternate")
+	h := newTestHandler(production, alternate)
+	file := &recordBuffer{}
+	h.Recorder = newRecorder(file)
+
+	req := httptest.NewRequest("POST", "/path?q=1", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	serve(t, h, req)
+	h.Recorder.Close()
+
+	if !file.closed {
+		t.Errorf("Expected the record file to be closed")
+	}
+	var entry recordEntry
+	if err := json.Unmarshal(file.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected one JSON record, but received '%s': %s", file.String(), err)
+	}
+	if entry.Origin != "B" || entry.Target != alternate.Address() || entry.Sampling != "all" {
+		t.Errorf("Expected origin B, target '%s' and sampling all, but received %+v", alternate.Address(), entry)
+	}
+	if entry.Request.Method != "POST" || entry.Request.URI != "/path?q=1" || string(entry.Request.Body) != "hello" || entry.Request.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the POST request to /path?q=1, but received %+v", entry.Request)
+	}
+	if entry.Response == nil || entry.Response.Status != http.StatusCreated || string(entry.Response.Body) != "alternate" {
+		t.Errorf("Expected the alternate response, but received %+v", entry.Response)
+	}
+}
+
+func TestFailedAlternateIsRecorded(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandlerFor(production.Address(), closedAddress(t))
+	file := &recordBuffer{}
+	h.Recorder = newRecorder(file)
+
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	h.Recorder.Close()
+
+	if !strings.Contains(file.String(), `"response":null`) {
+		t.Errorf("Expected a record without response, but received '%s'", file.String())
+	}
+}
+
+func TestRecordedResponseBodyIsCapped(t *testing.T) {
+	defer func(max int) { *recordMaxBody = max }(*recordMaxBody)
+	*recordMaxBody = 4
+
+	response := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("hello world"))}
+	entry := &recordEntry{}
+	entry.SetResponse(response, time.Millisecond)
+	if string(entry.Response.Body) != "hell" || !entry.Response.Truncated {
+		t.Errorf("Expected the truncated body 'hell', but received '%s'", entry.Response.Body)
+	}
+	if body, _ := io.ReadAll(response.Body); string(body) != "hello world" {
+		t.Errorf("Expected the whole body to remain readable, but received '%s'", body)
+	}
+}
+
+func TestRecordsAfterCloseAreDiscarded(t *testing.T) {
+	file := &recordBuffer{}
+	r := newRecorder(file)
+	r.Close()
+	r.Record(&recordEntry{})
+	if file.Len() != 0 {
+		t.Errorf("Expected nothing to be recorded, but received '%s'", file.String())
+	}
+}
+
+func TestBasicAuthIsNotRecorded(t *testing.T) {
+	defer func(credentials string) { *alternateBasicAuth = credentials }(*alternateBasicAuth)
+	*alternateBasicAuth = "shadow:secret"
+	h := newTestHandler(newTestBackend(t, http.StatusOK, ""), newTestBackend(t, http.StatusOK, ""))
+	file := &recordBuffer{}
+	h.Recorder = newRecorder(file)
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	h.Recorder.Close()
+
+	if strings.Contains(file.String(), "Authorization") {
+		t.Errorf("Expected no credentials in the record file, but received '%s'", file.String())
+	}
+}
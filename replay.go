@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayTarget is a backend that recorded requests are replayed against.
+type replayTarget struct {
+	Origin      string
+	Target      string
+	Transport   http.RoundTripper
+	Retries     int
+	RetryOn503  bool
+	PathPrefix  string
+	BasicAuth   string
+	HostRewrite bool
+	HTTPS       bool
+}
+
+// replayTargets returns the backends named by -replay-to: "a" for
+// production and "b" for all alternates.
+func replayTargets(names []string) ([]replayTarget, error) {
+	var targets []replayTarget
+	for _, name := range names {
+		switch name {
+		case "a":
+			// Host routes are not replayed, only the default target.
+			production, _, err := productionRoutes(targetProduction)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, replayTarget{
+				Origin:      "A",
+				Target:      production,
+				Transport:   withDeadline(newTransport(*productionTimeout, productionTLSConfig, nil), *productionTimeout),
+				Retries:     *productionRetries,
+				RetryOn503:  *productionRetryOn503,
+				PathPrefix:  *productionPathPrefix,
+				BasicAuth:   *productionBasicAuth,
+				HostRewrite: *productionHostRewrite,
+				HTTPS:       *productionHostSchemeHTTPS,
+			})
+		case "b":
+			transport := withDeadline(newTransport(*alternateTimeout, alternateTLSConfig, net.ParseIP(*alternateLocalAddr)), *alternateTimeout)
+			for i, alternative := range altTargets.targets {
+				if isKafkaTarget(alternative) {
+					// Published requests have no response to replay.
+					continue
+				}
+				targets = append(targets, replayTarget{
+					Origin:      alternateOrigin(i, len(altTargets.targets)),
+					Target:      alternative,
+					Transport:   transport,
+					Retries:     *alternateRetries,
+					PathPrefix:  *alternatePathPrefix,
+					BasicAuth:   *alternateBasicAuth,
+					HostRewrite: *alternateHostRewrite,
+					HTTPS:       *alternateHostSchemeHTTPS,
+				})
+			}
+		default:
+			return nil, fmt.Errorf("expected a or b, but found %q", name)
+		}
+	}
+	return targets, nil
+}
+
+// Request rebuilds the recorded request of entry for t.
+func (t replayTarget) Request(entry *recordEntry) (*http.Request, error) {
+	recorded := entry.Request
+	request, err := http.NewRequest(recorded.Method, recorded.URI, bytes.NewReader(recorded.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header = recorded.Header.Clone()
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
+	request.Host = recorded.Host
+	addPathPrefix(request, t.PathPrefix)
+	setRequestTarget(request, t.Target)
+	setBasicAuth(request, t.BasicAuth)
+	if t.HostRewrite {
+		request.Host = rewrittenHost(t.Target)
+	}
+	if t.HTTPS {
+		request.URL.Scheme = "https"
+	}
+	return request, nil
+}
+
+// replayStats aggregates the responses of one replay target.
+type replayStats struct {
+	mu        sync.Mutex
+	statuses  map[int]int // 0 for failed requests
+	durations []time.Duration
+}
+
+func (s *replayStats) Observe(response *http.Response, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	if s.statuses == nil {
+		s.statuses = make(map[int]int)
+	}
+	s.statuses[status]++
+	s.durations = append(s.durations, duration)
+}
+
+// String summarizes the status codes and latency percentiles, like
+// "200=95 500=5 p50=12ms p90=20ms p99=31ms max=40ms".
+func (s *replayStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.durations) == 0 {
+		return "no requests"
+	}
+	statuses := make([]int, 0, len(s.statuses))
+	for status := range s.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	var parts []string
+	for _, status := range statuses {
+		name := "failed"
+		if status != 0 {
+			name = fmt.Sprint(status)
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", name, s.statuses[status]))
+	}
+
+	durations := append([]time.Duration(nil), s.durations...)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p int) time.Duration {
+		return durations[(len(durations)-1)*p/100]
+	}
+	parts = append(parts, fmt.Sprintf("p50=%v p90=%v p99=%v max=%v", percentile(50), percentile(90), percentile(99), durations[len(durations)-1]))
+	return strings.Join(parts, " ")
+}
+
+// replay sends every request recorded in records to each target, at rate
+// requests per second, or one after the other as fast as possible if rate
+// is 0. It returns the stats of each target, in the order of targets.
+func replay(records io.Reader, targets []replayTarget, rate float64) ([]*replayStats, error) {
+	stats := make([]*replayStats, len(targets))
+	for i := range stats {
+		stats[i] = &replayStats{}
+	}
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	decoder := json.NewDecoder(records)
+	for count := 1; ; count++ {
+		entry := &recordEntry{}
+		if err := decoder.Decode(entry); err == io.EOF {
+			break
+		} else if err != nil {
+			wg.Wait()
+			return stats, fmt.Errorf("record %d: %s", count, err)
+		}
+		if tick != nil {
+			<-tick
+		}
+		for i, target := range targets {
+			request, err := target.Request(entry)
+			if err != nil {
+				log.Printf("[%v] %v Skipping record %d: %s", target.Origin, time.Now().UTC(), count, err)
+				continue
+			}
+			wg.Add(1)
+			if tick != nil {
+				go replayRequest(target, request, stats[i], &wg)
+			} else {
+				replayRequest(target, request, stats[i], &wg)
+			}
+		}
+	}
+	wg.Wait()
+	return stats, nil
+}
+
+func replayRequest(target replayTarget, request *http.Request, stats *replayStats, wg *sync.WaitGroup) {
+	defer wg.Done()
+	start := time.Now()
+	response := handleRequest(target.Origin, request, target.Transport, target.Retries, target.RetryOn503)
+	if response != nil {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+	stats.Observe(response, time.Since(start))
+}
+
+// replayRecordFile replays the record file at path against the backends
+// named by -replay-to and logs the stats of each.
+func replayRecordFile(path string) error {
+	targets, err := replayTargets(splitList(*replayTo))
+	if err != nil {
+		return fmt.Errorf("invalid -replay-to %s: %s", *replayTo, err)
+	}
+	records, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer records.Close()
+
+	start := time.Now()
+	stats, err := replay(records, targets, *replayRate)
+	for i, target := range targets {
+		log.Printf("[%v] %v Replayed to %s in %v: %s", target.Origin, time.Now().UTC(), target.Target, time.Since(start), stats[i])
+	}
+	return err
+}
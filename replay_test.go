@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayRecords = `{"request":{"method":"POST","uri":"/path?q=1","host":"example.com","header":{"Content-Type":["text/plain"]},"body":"aGVsbG8="}}
+{"request":{"method":"GET","uri":"/other","host":"example.com","header":{}}}
+`
+
+func TestReplaySendsRecordedRequests(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK, "")
+	targets := []replayTarget{{Origin: "B", Target: backend.Address(), Transport: newTransport(time.Second, nil, nil)}}
+
+	stats, err := replay(strings.NewReader(replayRecords), targets, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, but received '%s'", err)
+	}
+	requests := backend.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, but received %d", len(requests))
+	}
+	if requests[0].Method != "POST" || requests[0].URL.String() != "/path?q=1" || requests[0].Host != "example.com" || requests[0].Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the recorded POST request, but received %s %s for %s", requests[0].Method, requests[0].URL, requests[0].Host)
+	}
+	if body := backend.Bodies()[0]; body != "hello" {
+		t.Errorf("Expected body 'hello', but received '%s'", body)
+	}
+	if summary := stats[0].String(); !strings.HasPrefix(summary, "200=2 p50=") {
+		t.Errorf("Expected 2 OK responses, but received '%s'", summary)
+	}
+}
+
+func TestReplayAtRate(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK, "")
+	targets := []replayTarget{
+		{Origin: "A", Target: backend.Address(), Transport: newTransport(time.Second, nil, nil)},
+		{Origin: "B", Target: closedAddress(t), Transport: newTransport(time.Second, nil, nil)},
+	}
+
+	start := time.Now()
+	stats, err := replay(strings.NewReader(replayRecords), targets, 20)
+	if err != nil {
+		t.Fatalf("Expected no error, but received '%s'", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected 2 requests at 20 per second to take 100ms, but took %v", elapsed)
+	}
+	if summary := stats[1].String(); !strings.HasPrefix(summary, "failed=2 ") {
+		t.Errorf("Expected 2 failed requests, but received '%s'", summary)
+	}
+}
+
+func TestReplayInvalidRecord(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK, "")
+	targets := []replayTarget{{Origin: "B", Target: backend.Address(), Transport: newTransport(time.Second, nil, nil)}}
+
+	_, err := replay(strings.NewReader(replayRecords+"not json\n"), targets, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "record 3:") {
+		t.Errorf("Expected an error for record 3, but received '%v'", err)
+	}
+	if requests := backend.Requests(); len(requests) != 2 {
+		t.Errorf("Expected the 2 valid records to be replayed, but received %d", len(requests))
+	}
+}
+
+func TestReplayTargets(t *testing.T) {
+	if _, err := replayTargets([]string{"a", "c"}); err == nil {
+		t.Errorf("Expected an error for backend c")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+// newRequestID returns a random ID in the form of a version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ensureRequestID sets the X-Request-Id header of request, unless the client
+// already sent one, so that production and the alternates see the same ID.
+func ensureRequestID(request *http.Request) {
+	if request.Header.Get(REQUEST_ID_HEADER) == "" {
+		request.Header.Set(REQUEST_ID_HEADER, newRequestID())
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "net/http"
+
+// filterResponseHeaders removes the headers of -strip-response-headers from
+// the headers of a response to the client, then sets those of
+// -set-response-headers, replacing the values from the backend.
+func filterResponseHeaders(header http.Header) {
+	for _, name := range splitList(*stripResponseHeaders) {
+		header.Del(name)
+	}
+	responseSetHeaders.Apply(header)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeadersAreStrippedAndSet(t *testing.T) {
+	defer func(strip string) { *stripResponseHeaders = strip }(*stripResponseHeaders)
+	defer func() {
+		for name := range responseSetHeaders {
+			delete(responseSetHeaders, name)
+		}
+	}()
+	*stripResponseHeaders = "server, x-internal-backend"
+	responseSetHeaders.Set("X-Frame-Options:DENY")
+	responseSetHeaders.Set("Cache-Control:no-store")
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "backend/1.2.3")
+		w.Header().Set("X-Internal-Backend", "db-7")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+	}))
+	defer production.Close()
+	h := newTestHandlerFor(production.Listener.Addr().String())
+
+	header := serve(t, h, httptest.NewRequest("GET", "/", nil)).Header()
+	for _, name := range []string{"Server", "X-Internal-Backend"} {
+		if value := header.Get(name); value != "" {
+			t.Errorf("Expected no %s header, but received '%s'", name, value)
+		}
+	}
+	for name, expected := range map[string]string{"X-Frame-Options": "DENY", "Cache-Control": "no-store", "Content-Type": "text/plain"} {
+		if values := header.Values(name); len(values) != 1 || values[0] != expected {
+			t.Errorf("Expected %s '%s', but received '%v'", name, expected, values)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFailingBackend starts a backend that drops every connection without
+// answering, and counts the attempts.
+func newFailingBackend(t *testing.T, attempts *atomic.Int64) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestRetriesAgainstFailingBackend(t *testing.T) {
+	for retries, expectation := range map[int]int64{0: 1, 1: 2, 3: 4} {
+		var attempts atomic.Int64
+		backend := newFailingBackend(t, &attempts)
+
+		request, _ := http.NewRequest("GET", backend.URL, nil)
+		if response := handleRequest("A", request, newTransport(time.Second, nil, nil), retries, false); response != nil {
+			t.Errorf("Expected no response, but received %d", response.StatusCode)
+		}
+		if attempts.Load() != expectation {
+			t.Errorf("Expected %d attempts with %d retries, but received %d", expectation, retries, attempts.Load())
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(backoff time.Duration) { *retryBackoff = backoff }(*retryBackoff)
+	*retryBackoff = 50 * time.Millisecond
+	var attempts atomic.Int64
+	backend := newFailingBackend(t, &attempts)
+
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	start := time.Now()
+	handleRequest("A", request, newTransport(time.Second, nil, nil), 2, false)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected two backoffs of %v, but all attempts took %v", *retryBackoff, elapsed)
+	}
+}
+
+func TestRetriedPostDeliversBody(t *testing.T) {
+	defer func(retries int) { *productionRetries = retries }(*productionRetries)
+	defer func(enabled bool) { *retryNonIdempotent = enabled }(*retryNonIdempotent)
+	*productionRetries, *retryNonIdempotent = 1, true
+
+	for _, duplicated := range []bool{false, true} {
+		var attempts atomic.Int64
+		received := make(chan string, 1)
+		production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if attempts.Add(1) == 1 {
+				io.Copy(io.Discard, req.Body)
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			received <- string(body)
+		}))
+		defer production.Close()
+
+		h := newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"))
+		if duplicated {
+			alternate := newTestBackend(t, http.StatusOK, "")
+			h.Alternatives = []string{alternate.Address()}
+		}
+		serve(t, h, httptest.NewRequest("POST", "/resource", strings.NewReader("payload")))
+		select {
+		case body := <-received:
+			if body != "payload" {
+				t.Errorf("Expected '%s' on the retry (duplicated: %v), but received '%s'", "payload", duplicated, body)
+			}
+		default:
+			t.Errorf("Expected a retry (duplicated: %v), but received %d attempts", duplicated, attempts.Load())
+		}
+	}
+}
+
+func TestNonIdempotentRequestsAreNotRetried(t *testing.T) {
+	for _, test := range []struct {
+		method      string
+		header      string
+		expectation int64
+	}{{"POST", "", 1}, {"PATCH", "", 1}, {"POST", "Idempotency-Key", 3}, {"PUT", "", 3}} {
+		var attempts atomic.Int64
+		backend := newFailingBackend(t, &attempts)
+
+		request, _ := http.NewRequest(test.method, backend.URL, strings.NewReader("payload"))
+		if test.header != "" {
+			request.Header.Set(test.header, "1")
+		}
+		handleRequest("A", request, newTransport(time.Second, nil, nil), 2, false)
+		if attempts.Load() != test.expectation {
+			t.Errorf("Expected %d attempts for %s with '%s', but received %d", test.expectation, test.method, test.header, attempts.Load())
+		}
+	}
+}
+
+func TestRetryOn503(t *testing.T) {
+	var attempts atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("deployed"))
+	}))
+	defer backend.Close()
+
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	response := handleRequest("A", request, newTransport(time.Second, nil, nil), 1, true)
+	if response == nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d after a retry, but received %v", http.StatusOK, response)
+	}
+	if body, _ := io.ReadAll(response.Body); string(body) != "deployed" || attempts.Load() != 2 {
+		t.Errorf("Expected '%s' on attempt 2, but received '%s' on attempt %d", "deployed", body, attempts.Load())
+	}
+}
+
+func TestLast503IsForwarded(t *testing.T) {
+	for retryAfter, expectation := range map[string]int64{"": 3, "1000": 1} {
+		var attempts atomic.Int64
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			attempts.Add(1)
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		request, _ := http.NewRequest("GET", backend.URL, nil)
+		response := handleRequest("A", request, newTransport(time.Second, nil, nil), 2, true)
+		if response == nil || response.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected %d, but received %v", http.StatusServiceUnavailable, response)
+		}
+		if attempts.Load() != expectation {
+			t.Errorf("Expected %d attempts with Retry-After '%s', but received %d", expectation, retryAfter, attempts.Load())
+		}
+		backend.Close()
+	}
+}
+
+func Test503IsNotRetriedByDefault(t *testing.T) {
+	var attempts atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	handleRequest("A", request, newTransport(time.Second, nil, nil), 2, false)
+	if attempts.Load() != 1 {
+		t.Errorf("Expected 1 attempt, but received %d", attempts.Load())
+	}
+}
+
+func TestDeadlineBoundsAllRetries(t *testing.T) {
+	defer func(retries int, timeout, deadline time.Duration) {
+		*productionRetries, *productionTimeout, *productionDeadline = retries, timeout, deadline
+	}(*productionRetries, *productionTimeout, *productionDeadline)
+	*productionRetries, *productionTimeout, *productionDeadline = 2, 300*time.Millisecond, 500*time.Millisecond
+	var attempts atomic.Int64
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer production.Close()
+
+	start := time.Now()
+	serve(t, newTestHandlerFor(strings.TrimPrefix(production.URL, "http://")), httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("Expected the retries to end at the deadline of %v, but they took %v", *productionDeadline, elapsed)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts within the deadline, but received %d", attempts.Load())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+)
+
+// rewriteRule is one rule of the -rewrite-rules file. A rule applies to the
+// requests of its scope whose path matches Match, or to all of them without
+// Match. It replaces the matches in the path with Replace, in which $1 and
+// ${name} are the groups of Match, then sets and removes the headers.
+type rewriteRule struct {
+	Scope         string            `json:"scope"` // "a", "b" or "both", the default
+	Match         string            `json:"match"`
+	Replace       *string           `json:"replace"` // nil leaves the path alone
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+
+	match *regexp.Regexp
+}
+
+// rewriteRules are the rules of the -rewrite-rules file, applied in order.
+// A nil rewriteRules rewrites nothing.
+type rewriteRules []*rewriteRule
+
+// loadRewriteRules reads a file with a JSON array of rules.
+func loadRewriteRules(path string) (rewriteRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules rewriteRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		switch rule.Scope {
+		case "":
+			rule.Scope = "both"
+		case "a", "b", "both":
+		default:
+			return nil, fmt.Errorf("rule %d: expected a scope of a, b or both, but found %q", i+1, rule.Scope)
+		}
+		if rule.Match != "" {
+			if rule.match, err = regexp.Compile(rule.Match); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i+1, err)
+			}
+		} else if rule.Replace != nil {
+			return nil, fmt.Errorf("rule %d: replace needs a match", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// Apply rewrites request, which goes to the backends of scope, "a" or "b".
+// Each rule sees the path as the rules before it left it.
+func (r rewriteRules) Apply(request *http.Request, scope string) {
+	for _, rule := range r {
+		if rule.Scope != scope && rule.Scope != "both" {
+			continue
+		}
+		if rule.match != nil && !rule.match.MatchString(request.URL.Path) {
+			continue
+		}
+		if rule.Replace != nil {
+			request.URL.Path = rule.match.ReplaceAllString(request.URL.Path, *rule.Replace)
+			request.URL.RawPath = ""
+		}
+		for name, value := range rule.SetHeaders {
+			request.Header.Set(name, value)
+		}
+		for _, name := range rule.RemoveHeaders {
+			request.Header.Del(name)
+		}
+	}
+}
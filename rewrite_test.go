@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRewriteRules writes rules to a file and returns its path.
+func writeRewriteRules(t *testing.T, rules string) string {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRewriteRules(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h, err := NewHandler(HandlerConfig{
+		Production:   production.Address(),
+		Alternatives: []string{alternate.Address()},
+		RewriteRules: writeRewriteRules(t, `[
+			{"scope": "b", "match": "^/old/([^/]+)$", "replace": "/new/$1"},
+			{"match": "^/new/", "set_headers": {"X-Api-Version": "2"}},
+			{"remove_headers": ["X-Deprecated"]}
+		]`),
+		Seed: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/old/42?q=1", nil)
+	req.Header.Set("X-Deprecated", "yes")
+	serve(t, h, req)
+
+	requests := production.Requests()
+	if len(requests) != 1 || requests[0].URL.Path != "/old/42" || requests[0].Header.Get("X-Api-Version") != "" {
+		t.Fatalf("Expected /old/42 unchanged on production, but received %v", requests)
+	}
+	if deprecated := requests[0].Header.Get("X-Deprecated"); deprecated != "" {
+		t.Errorf("Expected X-Deprecated to be removed on production, but received '%s'", deprecated)
+	}
+	requests = alternate.Requests()
+	if len(requests) != 1 || requests[0].URL.Path != "/new/42" || requests[0].URL.RawQuery != "q=1" {
+		t.Fatalf("Expected /new/42?q=1 on the alternate, but received %v", requests)
+	}
+	if version := requests[0].Header.Get("X-Api-Version"); version != "2" {
+		t.Errorf("Expected X-Api-Version '2' after the path was rewritten, but received '%s'", version)
+	}
+	if deprecated := requests[0].Header.Get("X-Deprecated"); deprecated != "" {
+		t.Errorf("Expected X-Deprecated to be removed on the alternate, but received '%s'", deprecated)
+	}
+}
+
+func TestRewriteKeepsTheInboundRequest(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h, err := NewHandler(HandlerConfig{
+		Production:   production.Address(),
+		RewriteRules: writeRewriteRules(t, `[{"scope": "a", "match": "^/old$", "replace": "/new", "set_headers": {"X-Api-Version": "2"}}]`),
+		Seed:         1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without alternates, the request is not duplicated.
+	req := httptest.NewRequest("GET", "/old", nil)
+	serve(t, h, req)
+
+	if requests := production.Requests(); len(requests) != 1 || requests[0].URL.Path != "/new" {
+		t.Fatalf("Expected /new on production, but received %v", requests)
+	}
+	if req.URL.Path != "/old" || req.Header.Get("X-Api-Version") != "" {
+		t.Errorf("Expected the inbound request to stay /old without X-Api-Version, but received %s %v", req.URL.Path, req.Header)
+	}
+}
+
+func TestInvalidRewriteRules(t *testing.T) {
+	for expectation, rules := range map[string]string{
+		"rule 1: expected a scope": `[{"scope": "c"}]`,
+		"rule 2: error parsing":    `[{}, {"match": "("}]`,
+		"rule 1: replace needs":    `[{"replace": "/new"}]`,
+		"cannot unmarshal":         `{"match": "^/"}`,
+	} {
+		if _, err := loadRewriteRules(writeRewriteRules(t, rules)); err == nil || !strings.Contains(err.Error(), expectation) {
+			t.Errorf("Expected an error with '%s' for %s, but received '%v'", expectation, rules, err)
+		}
+	}
+	if _, err := NewHandler(HandlerConfig{RewriteRules: filepath.Join(t.TempDir(), "missing.json")}); err == nil || !strings.HasPrefix(err.Error(), "-rewrite-rules") {
+		t.Errorf("Expected an error for a missing file, but received '%v'", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// targetHealth tracks which production targets are up, for routing. A target
+// is marked down after Threshold failed probes in a row, and up again on the
+// first one that succeeds. Targets start up, so that requests are routed
+// before the first probe. A nil *targetHealth has every target up.
+type targetHealth struct {
+	Threshold int
+	Probe     func(target string) error
+
+	mu       sync.RWMutex
+	failures map[string]int
+	down     map[string]bool
+}
+
+func newTargetHealth(threshold int, probe func(target string) error) *targetHealth {
+	return &targetHealth{
+		Threshold: threshold,
+		Probe:     probe,
+		failures:  make(map[string]int),
+		down:      make(map[string]bool),
+	}
+}
+
+// Up reports whether target was up on the last probe.
+func (t *targetHealth) Up(target string) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return !t.down[target]
+}
+
+// Record changes the state of target by the result of a probe, and logs the
+// transitions.
+func (t *targetHealth) Record(target string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		if t.down[target] {
+			log.Printf("[%v] %v Production target %s is up again", "A", time.Now().UTC(), target)
+		}
+		t.failures[target], t.down[target] = 0, false
+		return
+	}
+	t.failures[target]++
+	if !t.down[target] && t.failures[target] >= t.Threshold {
+		log.Printf("[%v] %v Production target %s is down after %d failed checks: %v", "A", time.Now().UTC(), target, t.failures[target], err)
+		t.down[target] = true
+	}
+}
+
+// run probes targets every interval, forever.
+func (t *targetHealth) run(targets []string, interval time.Duration) {
+	for {
+		for _, target := range targets {
+			t.Record(target, t.Probe(target))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// productionTargets returns the default target and the targets of routes,
+// each once.
+func productionTargets(target string, routes []hostRoute) []string {
+	targets := []string{target}
+	seen := map[string]bool{target: true}
+	for _, route := range routes {
+		if !seen[route.Target] {
+			targets = append(targets, route.Target)
+			seen[route.Target] = true
+		}
+	}
+	return targets
+}
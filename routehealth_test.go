@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTargetHealthTransitions(t *testing.T) {
+	output := captureLog(t)
+	health := newTargetHealth(2, nil)
+	failed := errors.New("connection refused")
+
+	health.Record("a:80", failed)
+	if !health.Up("a:80") {
+		t.Errorf("Expected a:80 to be up after one failed check")
+	}
+	health.Record("a:80", failed)
+	if health.Up("a:80") {
+		t.Errorf("Expected a:80 to be down after two failed checks")
+	}
+	health.Record("a:80", nil)
+	if !health.Up("a:80") {
+		t.Errorf("Expected a:80 to be up again after a successful check")
+	}
+	for _, expectation := range []string{"Production target a:80 is down after 2 failed checks: connection refused", "Production target a:80 is up again"} {
+		if !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected '%s' in '%s'", expectation, output.String())
+		}
+	}
+	if !(*targetHealth)(nil).Up("a:80") {
+		t.Errorf("Expected every target to be up without health checks")
+	}
+}
+
+func TestRoutingSkipsDownTargets(t *testing.T) {
+	first := newTestBackend(t, http.StatusOK, "first")
+	second := newTestBackend(t, http.StatusOK, "second")
+	fallback := newTestBackend(t, http.StatusOK, "fallback")
+	h := newTestHandler(fallback)
+	h.Routes = []hostRoute{{"api.example.com", first.Address()}, {"api.example.com", second.Address()}}
+	h.Health = newTargetHealth(1, nil)
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = "api.example.com"
+		return serve(t, h, req)
+	}
+	failed := errors.New("connection refused")
+
+	if body := get().Body.String(); body != "first" {
+		t.Errorf("Expected '%s', but received '%s'", "first", body)
+	}
+	h.Health.Record(first.Address(), failed)
+	if body := get().Body.String(); body != "second" {
+		t.Errorf("Expected '%s' with the first target down, but received '%s'", "second", body)
+	}
+	h.Health.Record(second.Address(), failed)
+	if recorder := get(); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with all targets down, but received %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if requests := fallback.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no request to the default target, but received %d", len(requests))
+	}
+	h.Health.Record(first.Address(), nil)
+	if body := get().Body.String(); body != "first" {
+		t.Errorf("Expected '%s' after it recovered, but received '%s'", "first", body)
+	}
+}
+
+func TestProductionTargets(t *testing.T) {
+	routes := []hostRoute{{"a.example.com", "a:80"}, {"b.example.com", "default:80"}, {"c.example.com", "a:80"}}
+	if targets := productionTargets("default:80", routes); strings.Join(targets, ",") != "default:80,a:80" {
+		t.Errorf("Expected each target once, but received %v", targets)
+	}
+}
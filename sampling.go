@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lockedRand is a rand.Rand that is safe for concurrent use, since the
+// requests of a handler share its Randomizer. It keeps a seeded source, as
+// opposed to the global rand functions, so that tests are deterministic.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) Int63n(n int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Int63n(n)
+}
+
+// sampleBy names the header or cookie whose value decides the sampling of a
+// request, so that all requests with the same value are treated alike.
+type sampleBy struct {
+	Cookie bool // Name is a cookie rather than a header
+	Name   string
+}
+
+// parseSampleBy parses "header:Name" or "cookie:Name".
+func parseSampleBy(spec string) (*sampleBy, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	if name == "" || (kind != "header" && kind != "cookie") {
+		return nil, fmt.Errorf("expected header:Name or cookie:Name, but found %q", spec)
+	}
+	return &sampleBy{Cookie: kind == "cookie", Name: name}, nil
+}
+
+// Key returns the value of the header or cookie of req, and false if it is
+// missing or empty.
+func (s *sampleBy) Key(req *http.Request) (string, bool) {
+	if s.Cookie {
+		cookie, err := req.Cookie(s.Name)
+		if err != nil || cookie.Value == "" {
+			return "", false
+		}
+		return cookie.Value, true
+	}
+	value := req.Header.Get(s.Name)
+	return value, value != ""
+}
+
+// samplePoint maps key to a point in [0, 100) with a resolution of 0.01, by
+// taking the 32 bit FNV-1a hash of the key modulo 10000. A key is sampled if
+// its point is below the percentage, so raising the percentage only adds
+// keys.
+func samplePoint(key string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return float64(hash.Sum32()%10000) / 100
+}
+
+// sampled makes the percentage decision for req: by key with -sample-by if
+// the request has one, at random otherwise. With -every-n, every Nth
+// request is sampled instead.
+func (h *handler) sampled(req *http.Request) bool {
+	if *everyN > 0 {
+		return h.nth(uint64(*everyN))
+	}
+	// Load once, so that a change at runtime cannot split the decision.
+	p := percent.Load()
+	if p == 100.0 {
+		return true
+	}
+	if h.SampleBy != nil {
+		if key, ok := h.SampleBy.Key(req); ok {
+			return samplePoint(key) < p
+		}
+	}
+	return h.Randomizer.Float64()*100 < p
+}
+
+// forcedSampling returns the decision the -force-shadow-param query
+// parameter of req makes instead of the percentage: to duplicate with a true
+// value like ?shadow=1, not to with a false one like ?shadow=0. It returns
+// false for ok if req has no such value.
+func forcedSampling(req *http.Request) (duplicate bool, ok bool) {
+	if *forceShadowParam == "" {
+		return false, false
+	}
+	duplicate, err := strconv.ParseBool(req.URL.Query().Get(*forceShadowParam))
+	return duplicate, err == nil
+}
+
+// samplingMethod names how the percentage decision for req is made:
+// "forced" by -force-shadow-param, "every-n" with -every-n, "all" at 100%,
+// "key" by -sample-by, or "random".
+func (h *handler) samplingMethod(req *http.Request) string {
+	if _, ok := forcedSampling(req); ok {
+		return "forced"
+	}
+	if *everyN > 0 {
+		return "every-n"
+	}
+	if percent.Load() == 100.0 {
+		return "all"
+	}
+	if h.SampleBy != nil {
+		if _, ok := h.SampleBy.Key(req); ok {
+			return "key"
+		}
+	}
+	return "random"
+}
+
+// nth counts the requests modulo n and reports whether this is the first of
+// each n. The counter stays below n, so that it never overflows.
+func (h *handler) nth(n uint64) bool {
+	for {
+		count := h.requestCount.Load()
+		if h.requestCount.CompareAndSwap(count, (count+1)%n) {
+			return count%n == 0
+		}
+	}
+}
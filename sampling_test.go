@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSamplePointIsStable(t *testing.T) {
+	for _, key := range []string{"", "session-1", "session-2"} {
+		point := samplePoint(key)
+		if point < 0 || point >= 100 {
+			t.Errorf("Expected a point in [0, 100) for '%s', but received %v", key, point)
+		}
+		for i := 0; i < 10; i++ {
+			if again := samplePoint(key); again != point {
+				t.Errorf("Expected %v for '%s' again, but received %v", point, key, again)
+			}
+		}
+	}
+	// FNV-1a of "session-1" is 0x736a51cd.
+	if expectation := float64(0x736a51cd%10000) / 100; samplePoint("session-1") != expectation {
+		t.Errorf("Expected %v, but received %v", expectation, samplePoint("session-1"))
+	}
+}
+
+func TestSamplingByKeyIsConsistent(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(50)
+
+	for _, spec := range []string{"header:X-Session", "cookie:session"} {
+		by, err := parseSampleBy(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &handler{SampleBy: by}
+		sampled := 0
+		for i := 0; i < 100; i++ {
+			key := string(rune('a' + i%26))
+			first := h.sampled(sampleRequest(by, key))
+			for j := 0; j < 5; j++ {
+				if again := h.sampled(sampleRequest(by, key)); again != first {
+					t.Fatalf("Expected the same decision %v for key '%s' via %s, but received %v", first, key, spec, again)
+				}
+			}
+			if first {
+				sampled++
+			}
+		}
+		if sampled == 0 || sampled == 100 {
+			t.Errorf("Expected a mix of sampled keys via %s, but received %d of 100", spec, sampled)
+		}
+	}
+}
+
+func sampleRequest(by *sampleBy, key string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if by.Cookie {
+		req.AddCookie(&http.Cookie{Name: by.Name, Value: key})
+	} else {
+		req.Header.Set(by.Name, key)
+	}
+	return req
+}
+
+func TestInvalidSampleBy(t *testing.T) {
+	for _, spec := range []string{"X-Session", "query:id", "header:"} {
+		if _, err := parseSampleBy(spec); err == nil {
+			t.Errorf("Expected an error for '%s'", spec)
+		}
+	}
+}
+
+func TestSamplingEveryN(t *testing.T) {
+	defer func(n int) { *everyN = n }(*everyN)
+	for n, expectation := range map[int]int{1: 30, 3: 10} {
+		*everyN = n
+		h := &handler{}
+		sampled := 0
+		for i := 0; i < 30; i++ {
+			if h.sampled(httptest.NewRequest("GET", "/", nil)) {
+				sampled++
+			}
+		}
+		if sampled != expectation {
+			t.Errorf("Expected %d of 30 requests for N=%d, but received %d", expectation, n, sampled)
+		}
+	}
+
+	*everyN = 0
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(0)
+	if newTestHandlerFor("localhost:0").sampled(httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("Expected -p to decide with N=0")
+	}
+}
+
+func TestSamplingEveryNIsConcurrencySafe(t *testing.T) {
+	defer func(n int) { *everyN = n }(*everyN)
+	*everyN = 7
+	h := &handler{}
+	var sampled atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 70; j++ {
+				if h.nth(7) {
+					sampled.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if sampled.Load() != 100 {
+		t.Errorf("Expected exactly 100 of 700 requests, but received %d", sampled.Load())
+	}
+	if count := h.requestCount.Load(); count != 0 {
+		t.Errorf("Expected the counter to wrap to 0, but received %d", count)
+	}
+}
+
+func TestRandomSamplingIsConcurrencySafe(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	percent.Store(50)
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production, alternate)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}()
+	}
+	wg.Wait()
+	serve(t, h, httptest.NewRequest("GET", "/last", nil))
+	if requests := production.Requests(); len(requests) != 201 {
+		t.Errorf("Expected 201 requests to production, but received %d", len(requests))
+	}
+	if requests := alternate.Requests(); len(requests) == 0 || len(requests) == 201 {
+		t.Errorf("Expected about half of 201 requests to the alternate, but received %d", len(requests))
+	}
+}
+
+func TestForceShadowParam(t *testing.T) {
+	defer func(p float64) { percent.Store(p) }(percent.Load())
+	defer func(param string) { *forceShadowParam = param }(*forceShadowParam)
+	*forceShadowParam = "shadow"
+	h := newTestHandlerFor("production:80", "alternate:80")
+
+	for _, test := range []struct {
+		percent   float64
+		uri       string
+		duplicate bool
+		reason    string
+	}{
+		{0, "/?shadow=1", true, "forced"},
+		{0, "/?shadow=true&id=7", true, "forced"},
+		{100, "/?shadow=0", false, "suppressed"},
+		{100, "/?shadow=false", false, "suppressed"},
+		{0, "/?shadow=maybe", false, "not-sampled"},
+		{100, "/", true, "sampled"},
+	} {
+		percent.Store(test.percent)
+		if duplicate, reason := h.routing(httptest.NewRequest("GET", test.uri, nil)); duplicate != test.duplicate || reason != test.reason {
+			t.Errorf("Expected %v, %s for %s at %v%%, but received %v, %s", test.duplicate, test.reason, test.uri, test.percent, duplicate, reason)
+		}
+	}
+}
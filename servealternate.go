@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// serveAlternate answers the client of req with the response of the
+// alternate origin to alternativeRequest, for -b.serve-percent of the
+// duplicated requests. productionRequest is sent to production in the
+// background instead, unless teeproxy is shutting down, as if production
+// were the alternate, and compared if alternateResponses is not nil; count
+// is the number of other alternates sent on it.
+func (h *handler) serveAlternate(w http.ResponseWriter, req *http.Request, origin, target string, alternativeRequest, productionRequest *http.Request, alternateResponses chan alternateResult, count int) {
+	if h.alternates.Start() {
+		go h.shadowProduction(req, productionRequest, alternateResponses, count+1)
+	}
+
+	h.alternateRequest(alternativeRequest, target)
+	backendSpan := h.Tracer.StartBackend(req, alternativeRequest, origin, target)
+	h.observeRequest(origin, alternativeRequest)
+	startReq := time.Now()
+	resp := handleRequest(origin, alternativeRequest, h.AltTransport, *alternateRetries, false)
+	h.Breakers[target].Record(resp != nil)
+	backendSpan.SetResponse(resp)
+	h.Tracer.End(backendSpan)
+	backendMetrics.Observe(origin, resp, time.Since(startReq))
+	h.Stats.Observe(origin, resp, time.Since(startReq))
+	h.Summary.Observe(origin, resp, time.Since(startReq))
+	h.observeResponse(origin, req, alternativeRequest, resp, time.Since(startReq))
+
+	if resp == nil {
+		if alternateResponses != nil {
+			alternateResponses <- alternateResult{Origin: origin}
+		}
+		productionError(w)
+		return
+	}
+	defer resp.Body.Close()
+
+	var alternate *capturedResponse
+	var capture io.Writer
+	if alternateResponses != nil {
+		alternate = newCapturedResponse(origin, resp)
+		capture = alternate
+	}
+	err := forwardResponse(w, req, resp, capture)
+	if alternateResponses != nil {
+		if err != nil {
+			alternate = nil
+		}
+		alternateResponses <- alternateResult{Origin: origin, Response: alternate}
+	}
+	if err != nil {
+		logForwardError(origin, req, err)
+	}
+}
+
+// shadowProduction sends productionRequest to production for a request that
+// an alternate answered, and discards the response. If alternateResponses
+// is not nil, the response is compared to the count responses on it.
+func (h *handler) shadowProduction(req, productionRequest *http.Request, alternateResponses <-chan alternateResult, count int) {
+	defer h.alternates.Done()
+	defer func() {
+		if r := recover(); r != nil && *debug {
+			log.Println("Recovered in ServeHTTP(shadowed production request) from:", r)
+		}
+	}()
+
+	// The client may be gone before production answers.
+	productionRequest = productionRequest.WithContext(context.WithoutCancel(productionRequest.Context()))
+	backendSpan := h.Tracer.StartBackend(req, productionRequest, "A", h.productionTarget(req))
+	h.observeRequest("A", productionRequest)
+	startReq := time.Now()
+	resp := handleRequest("A", productionRequest, h.Transport, *productionRetries, *productionRetryOn503)
+	backendSpan.SetResponse(resp)
+	h.Tracer.End(backendSpan)
+	backendMetrics.Observe("A", resp, time.Since(startReq))
+	h.Stats.Observe("A", resp, time.Since(startReq))
+	h.Summary.Observe("A", resp, time.Since(startReq))
+	h.observeResponse("A", req, productionRequest, resp, time.Since(startReq))
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if alternateResponses == nil {
+		io.Copy(io.Discard, resp.Body)
+		return
+	}
+	compareResponses(req, productionRequest.GetBody, captureResponse("A", resp), alternateResponses, count, h.Mismatches)
+}
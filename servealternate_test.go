@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServePercent(t *testing.T) {
+	defer func(percent float64, diff bool) { *alternateServePercent, *diffResponses = percent, diff }(*alternateServePercent, *diffResponses)
+	*diffResponses = true
+	for _, test := range []struct {
+		percent     float64
+		expectation string
+	}{
+		{0, "production"},
+		{100, "alternate"},
+	} {
+		*alternateServePercent = test.percent
+		production := newTestBackend(t, http.StatusOK, "production")
+		alternate := newTestBackend(t, http.StatusCreated, "alternate")
+		output := captureLog(t)
+		recorder := serve(t, newTestHandler(production, alternate), httptest.NewRequest("POST", "/path", strings.NewReader("payload")))
+
+		if body := recorder.Body.String(); body != test.expectation {
+			t.Errorf("Expected '%s' with %v%%, but received '%s'", test.expectation, test.percent, body)
+		}
+		for name, backend := range map[string]*testBackend{"production": production, "alternate": alternate} {
+			if bodies := backend.Bodies(); len(bodies) != 1 || bodies[0] != "payload" {
+				t.Errorf("Expected %s to receive 'payload' with %v%%, but received %v", name, test.percent, bodies)
+			}
+		}
+		// Only the shadowed production is waited for by serve.
+		if expectation := "DIFF POST /path status=200/201"; test.percent == 100 && !strings.Contains(output.String(), expectation) {
+			t.Errorf("Expected '%s' in '%s'", expectation, output)
+		}
+	}
+}
+
+func TestServedAlternateFailure(t *testing.T) {
+	defer func(percent float64) { *alternateServePercent = percent }(*alternateServePercent)
+	*alternateServePercent = 100
+	production := newTestBackend(t, http.StatusOK, "production")
+	recorder := serve(t, newTestHandlerFor(production.Address(), closedAddress(t)), httptest.NewRequest("GET", "/path", nil))
+	if recorder.Code != http.StatusBadGateway || recorder.Body.String() == "production" {
+		t.Errorf("Expected %d when the served alternate fails, but received %d with '%s'", http.StatusBadGateway, recorder.Code, recorder.Body)
+	}
+	if requests := production.Requests(); len(requests) != 1 {
+		t.Errorf("Expected one request to production, but received %d", len(requests))
+	}
+}
+
+func TestHeaderOnlyAlternatesAreNotServed(t *testing.T) {
+	defer func(percent float64, noBody bool) { *alternateServePercent, *alternateNoBody = percent, noBody }(*alternateServePercent, *alternateNoBody)
+	*alternateServePercent, *alternateNoBody = 100, true
+	production := newTestBackend(t, http.StatusOK, "production")
+	alternate := newTestBackend(t, http.StatusOK, "alternate")
+	recorder := serve(t, newTestHandler(production, alternate), httptest.NewRequest("POST", "/path", strings.NewReader("payload")))
+	if body := recorder.Body.String(); body != "production" {
+		t.Errorf("Expected '%s', but received '%s'", "production", body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tracker counts requests in progress so that shutdown can wait for them.
+// The zero value is ready to use.
+type tracker struct {
+	mu       sync.Mutex
+	started  int64
+	finished int64
+	closed   bool
+	idle     []chan struct{} // closed when no request is in progress
+}
+
+// Start counts a request as started. It returns false, and counts nothing,
+// once the tracker is closed.
+func (t *tracker) Start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.started++
+	return true
+}
+
+func (t *tracker) Done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished++
+	if t.started == t.finished {
+		for _, idle := range t.idle {
+			close(idle)
+		}
+		t.idle = nil
+	}
+}
+
+// Close makes Start refuse any further requests.
+func (t *tracker) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+}
+
+// Active returns the number of requests in progress.
+func (t *tracker) Active() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.started - t.finished
+}
+
+// Finished returns the number of requests done so far.
+func (t *tracker) Finished() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.finished
+}
+
+// Wait blocks until all requests are done or ctx expires, and returns the
+// number of requests still in progress.
+func (t *tracker) Wait(ctx context.Context) int64 {
+	t.mu.Lock()
+	if t.started == t.finished {
+		t.mu.Unlock()
+		return 0
+	}
+	idle := make(chan struct{})
+	t.idle = append(t.idle, idle)
+	t.mu.Unlock()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+	return t.Active()
+}
+
+// shutdown stops servers from accepting connections and gives the requests
+// in progress, production and alternate, until timeout to complete. No
+// alternate requests are started from then on. The servers share h and
+// shut down at the same time.
+func shutdown(servers []*http.Server, h *handler, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	h.alternates.Close()
+	production, alternate := h.production.Finished(), h.alternates.Finished()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Failed to shut down gracefully: %s", err)
+			}
+		}(server)
+	}
+	wg.Wait()
+	productionAbandoned := h.production.Wait(ctx)
+	alternateAbandoned := h.alternates.Wait(ctx)
+
+	log.Printf("Shut down: drained %d and abandoned %d production requests, drained %d and abandoned %d alternate requests",
+		h.production.Finished()-production, productionAbandoned, h.alternates.Finished()-alternate, alternateAbandoned)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBlockingBackend starts a backend that signals each request on arrived
+// and answers it once release is closed.
+func newBlockingBackend(t *testing.T, arrived chan<- struct{}, release <-chan struct{}) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestShutdownDrainsAndAbandonsRequests(t *testing.T) {
+	arrived := make(chan struct{}, 3)
+	released, blocked := make(chan struct{}), make(chan struct{})
+	production := newBlockingBackend(t, arrived, released)
+	drained := newBlockingBackend(t, arrived, released)
+	abandoned := newBlockingBackend(t, arrived, blocked)
+	h := newTestHandlerFor(production.Listener.Addr().String(), drained.Listener.Addr().String(), abandoned.Listener.Addr().String())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(h)
+	go server.Serve(listener)
+	go func() {
+		if response, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+			response.Body.Close()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		<-arrived
+	}
+
+	output := captureLog(t)
+	time.AfterFunc(50*time.Millisecond, func() { close(released) })
+	shutdown([]*http.Server{server}, h, 500*time.Millisecond)
+	close(blocked)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+
+	if expectation := "drained 1 and abandoned 0 production requests, drained 1 and abandoned 1 alternate requests"; !strings.Contains(output.String(), expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, output)
+	}
+	if h.startAlternate(func() { t.Error("Expected no alternate request after the shutdown") }) {
+		t.Errorf("Expected the alternate request to be dropped after the shutdown")
+	}
+}
+
+func TestTrackerWaitsForRequests(t *testing.T) {
+	var requests tracker
+	requests.Start()
+	requests.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if abandoned := requests.Wait(ctx); abandoned != 2 {
+		t.Errorf("Expected 2 requests in progress, but received %d", abandoned)
+	}
+
+	go requests.Done()
+	go requests.Done()
+	if abandoned := requests.Wait(context.Background()); abandoned != 0 || requests.Finished() != 2 {
+		t.Errorf("Expected 2 finished requests, but received %d in progress and %d finished", abandoned, requests.Finished())
+	}
+	requests.Close()
+	if requests.Start() || requests.Active() != 0 {
+		t.Errorf("Expected a closed tracker to refuse requests")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsAlpha is the weight of a new request in the moving averages, so that
+// roughly the last 1/statsAlpha requests dominate.
+const statsAlpha = 0.1
+
+// ewma is an exponentially weighted moving average.
+type ewma struct {
+	value float64
+	set   bool
+}
+
+func (e *ewma) Add(value float64) {
+	if !e.set {
+		e.value, e.set = value, true
+		return
+	}
+	e.value += statsAlpha * (value - e.value)
+}
+
+// originStats are the moving averages of one backend.
+type originStats struct {
+	latency   ewma // in seconds
+	errorRate ewma // 1 for a failed request or a 5xx response, 0 otherwise
+}
+
+// backendStats keeps moving averages of the latency and error rate of each
+// backend, for the -stats-interval log line. A nil *backendStats records
+// nothing.
+type backendStats struct {
+	mu      sync.Mutex
+	origins map[string]*originStats
+}
+
+func newBackendStats() *backendStats {
+	return &backendStats{origins: make(map[string]*originStats)}
+}
+
+// Observe records one request to origin that took duration.
+func (s *backendStats) Observe(origin string, response *http.Response, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	failed := 0.0
+	if response == nil || response.StatusCode >= 500 {
+		failed = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.origins[origin]
+	if stats == nil {
+		stats = &originStats{}
+		s.origins[origin] = stats
+	}
+	stats.latency.Add(duration.Seconds())
+	stats.errorRate.Add(failed)
+}
+
+// String summarizes the averages by origin, like
+// "A latency=12ms errors=0.0% B latency=30ms errors=2.5%".
+func (s *backendStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	origins := make([]string, 0, len(s.origins))
+	for origin := range s.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	parts := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		stats := s.origins[origin]
+		latency := time.Duration(stats.latency.value * float64(time.Second)).Round(100 * time.Microsecond)
+		parts = append(parts, fmt.Sprintf("%s latency=%v errors=%.1f%%", origin, latency, 100*stats.errorRate.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// report logs the averages every interval, once there are any.
+func (s *backendStats) report(interval time.Duration) {
+	for range time.Tick(interval) {
+		if line := s.String(); line != "" {
+			log.Printf("[%v] %v STATS %s", "X", time.Now().UTC(), line)
+		}
+	}
+}
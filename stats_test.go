@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackendStats(t *testing.T) {
+	stats := newBackendStats()
+	stats.Observe("A", &http.Response{StatusCode: 200}, 10*time.Millisecond)
+	stats.Observe("A", &http.Response{StatusCode: 200}, 20*time.Millisecond)
+	stats.Observe("B", nil, 40*time.Millisecond)
+	stats.Observe("B", &http.Response{StatusCode: 404}, 40*time.Millisecond)
+
+	if expectation := "A latency=11ms errors=0.0% B latency=40ms errors=90.0%"; stats.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, stats)
+	}
+}
+
+func TestNilBackendStats(t *testing.T) {
+	var stats *backendStats
+	stats.Observe("A", nil, time.Second)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errAlternateTooSlow aborts the body of an alternate request that fell too
+// far behind production in streaming mode.
+var errAlternateTooSlow = errors.New("alternate fell behind production, body dropped")
+
+// errBodyRefused aborts the body of an alternate request when production
+// answered a request with Expect: 100-continue without reading its body.
+var errBodyRefused = errors.New("production refused the body, body dropped")
+
+// streamBuffer is the body of an alternate request in streaming mode. The
+// production request fills it as it reads the client body, without ever
+// waiting: an alternate that falls more than max bytes behind is dropped.
+type streamBuffer struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	data   []byte
+	max    int
+	err    error // set when no more data follows: io.EOF, or why not
+	closed bool  // by the reader, data is discarded from then on
+}
+
+func newStreamBuffer(max int) *streamBuffer {
+	b := &streamBuffer{max: max}
+	b.ready = sync.NewCond(&b.mu)
+	return b
+}
+
+// write appends p unless the buffer was finished or closed.
+func (b *streamBuffer) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil || b.closed {
+		return
+	}
+	if len(b.data)+len(p) > b.max {
+		b.err = errAlternateTooSlow
+		b.data = nil
+	} else {
+		b.data = append(b.data, p...)
+	}
+	b.ready.Broadcast()
+}
+
+// finish ends the body with err, which is io.EOF for a complete one.
+func (b *streamBuffer) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.ready.Broadcast()
+}
+
+// Dropped reports whether the alternate fell behind.
+func (b *streamBuffer) Dropped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err == errAlternateTooSlow
+}
+
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.data) == 0 && b.err == nil && !b.closed {
+		b.ready.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *streamBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.data = nil
+	b.ready.Broadcast()
+	return nil
+}
+
+// teeBody is the body of the production request in streaming mode. Whatever
+// production reads from the client body is copied to the alternates.
+type teeBody struct {
+	mu         sync.Mutex
+	body       io.ReadCloser
+	alternates []*streamBuffer
+	closed     chan struct{} // closed once production is done with the body
+	closeOnce  sync.Once
+	lazy       bool // the client waits for 100 Continue before sending the body
+	read       bool // production read some of the body
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, err := t.body.Read(p)
+	t.read = t.read || n > 0
+	for _, alternate := range t.alternates {
+		alternate.write(p[:n])
+		if err != nil {
+			alternate.finish(err)
+		}
+	}
+	return n, err
+}
+
+// Close is called by the transport of the production request. The client
+// body stays open, since the alternates may not have all of it yet.
+func (t *teeBody) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+// Finish passes the rest of the client body on to the alternates, which still
+// want it, after production is done with it. It must be called before the
+// handler returns.
+func (t *teeBody) Finish() {
+	select {
+	case <-t.closed:
+	case <-time.After(*productionTimeout):
+		// The transport closes the body when done with it, but rather give
+		// up on the alternates than hang if that never happens.
+		for _, alternate := range t.alternates {
+			alternate.finish(errAlternateTooSlow)
+		}
+	}
+	t.mu.Lock()
+	refused := t.lazy && !t.read
+	t.mu.Unlock()
+	if refused {
+		// Reading the body now would ask the client for what production
+		// turned down.
+		for _, alternate := range t.alternates {
+			alternate.finish(errBodyRefused)
+		}
+		if *debug {
+			log.Printf("[%v] %v Production answered without the body. Dropped it for the alternates.", "X", time.Now().UTC())
+		}
+		t.body.Close()
+		return
+	}
+	for _, alternate := range t.alternates {
+		if !alternate.Dropped() {
+			io.Copy(io.Discard, t)
+			break
+		}
+	}
+	for _, alternate := range t.alternates {
+		alternate.finish(io.EOF)
+		if alternate.Dropped() && *debug {
+			log.Printf("[%v] %v Alternate fell more than %d bytes behind. Dropped its body.", "X", time.Now().UTC(), alternate.max)
+		}
+	}
+	t.body.Close()
+}
+
+// StreamRequests returns a production request and count-1 alternate requests
+// that all get the body of request as production reads it, without
+// buffering it whole. Each alternate may fall up to max bytes behind. The
+// returned teeBody must be finished once production is done.
+func StreamRequests(request *http.Request, count, max int) ([]*http.Request, *teeBody) {
+	tee := &teeBody{body: request.Body, closed: make(chan struct{}), lazy: expectsContinue(request)}
+	requests := []*http.Request{copyRequest(request, tee)}
+	for i := 1; i < count; i++ {
+		alternate := newStreamBuffer(max)
+		tee.alternates = append(tee.alternates, alternate)
+		requests = append(requests, copyRequest(request, alternate))
+	}
+	return requests, tee
+}
+
+// expectsContinue reports whether the client of req waits for 100 Continue
+// before it sends the body. The server sends it once the body is first read.
+func expectsContinue(req *http.Request) bool {
+	return req.ContentLength != 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamedBodyReachesAllBackends(t *testing.T) {
+	defer func(enabled bool) { *streamBodies = enabled }(*streamBodies)
+	*streamBodies = true
+	body := strings.Repeat("0123456789", 10000)
+
+	for _, chunked := range []bool{false, true} {
+		production := newTestBackend(t, http.StatusOK, "")
+		alternate1 := newTestBackend(t, http.StatusOK, "")
+		alternate2 := newTestBackend(t, http.StatusOK, "")
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		serve(t, newTestHandler(production, alternate1, alternate2), req)
+
+		for name, backend := range map[string]*testBackend{"production": production, "alternate 1": alternate1, "alternate 2": alternate2} {
+			if bodies := backend.Bodies(); len(bodies) != 1 || bodies[0] != body {
+				t.Errorf("Expected %s to receive %d bytes (chunked: %v), but received %d requests", name, len(body), chunked, len(bodies))
+			}
+		}
+	}
+}
+
+func TestSlowAlternateIsDroppedFromStream(t *testing.T) {
+	defer func(enabled bool, size int) { *streamBodies, *streamBufferSize = enabled, size }(*streamBodies, *streamBufferSize)
+	*streamBodies, *streamBufferSize = true, 1024
+	// Larger than the socket buffers, so that the alternate really stalls.
+	body := strings.Repeat("x", 16<<20)
+
+	production := newTestBackend(t, http.StatusOK, "")
+	received := make(chan int64, 1)
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Second)
+		n, _ := io.Copy(io.Discard, req.Body)
+		received <- n
+	}))
+	defer stalling.Close()
+
+	h := newTestHandlerFor(production.Address(), strings.TrimPrefix(stalling.URL, "http://"))
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("Expected production not to wait for the stalled alternate, but it took %v", elapsed)
+	}
+	if bodies := production.Bodies(); len(bodies) != 1 || len(bodies[0]) != len(body) {
+		t.Errorf("Expected production to receive %d bytes", len(body))
+	}
+	select {
+	case n := <-received:
+		if n == int64(len(body)) {
+			t.Errorf("Expected the alternate body to be cut off, but it received all %d bytes", n)
+		}
+	case <-time.After(3 * time.Second):
+	}
+}
+
+// sendExpectingContinue sends a POST with Expect: 100-continue to the proxy
+// at address, sends the body only after 100 Continue, and returns the status
+// lines received.
+func sendExpectingContinue(t *testing.T, address, body string) []string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", len(body))
+	responses := bufio.NewReader(conn)
+	var statuses []string
+	for {
+		response, err := http.ReadResponse(responses, nil)
+		if err != nil {
+			t.Fatalf("Expected a response, but received %v after %v", err, statuses)
+		}
+		statuses = append(statuses, response.Status)
+		if response.StatusCode != http.StatusContinue {
+			return statuses
+		}
+		io.WriteString(conn, body)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(production, alternate)
+	serveProxy(t, h, listener)
+
+	statuses := sendExpectingContinue(t, listener.Addr().String(), "payload")
+	if expectation := []string{"100 Continue", "200 OK"}; !reflect.DeepEqual(statuses, expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, statuses)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+	for name, backend := range map[string]*testBackend{"production": production, "alternate": alternate} {
+		if bodies := backend.Bodies(); len(bodies) != 1 || bodies[0] != "payload" {
+			t.Errorf("Expected %s to receive '%s', but received %v", name, "payload", bodies)
+		}
+	}
+}
+
+func TestExpectContinueUploadReachesAlternateInFull(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusOK, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(production, alternate)
+	serveProxy(t, h, listener)
+
+	// Larger than the buffers of the connections, but within -stream-buffer.
+	upload := strings.Repeat("0123456789abcdef", 16*1024)
+	statuses := sendExpectingContinue(t, listener.Addr().String(), upload)
+	if expectation := []string{"100 Continue", "200 OK"}; !reflect.DeepEqual(statuses, expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, statuses)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+	if bodies := alternate.Bodies(); len(bodies) != 1 || bodies[0] != upload {
+		t.Errorf("Expected the alternate to receive all %d bytes, but received %d bodies", len(upload), len(bodies))
+	}
+}
+
+func TestExpectContinueRefusedByProduction(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer production.Close()
+	alternate := newTestBackend(t, http.StatusOK, "")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandlerFor(production.Listener.Addr().String(), alternate.Address())
+	serveProxy(t, h, listener)
+
+	statuses := sendExpectingContinue(t, listener.Addr().String(), "payload")
+	if expectation := []string{"401 Unauthorized"}; !reflect.DeepEqual(statuses, expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, statuses)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.alternates.Wait(ctx)
+	for _, body := range alternate.Bodies() {
+		if body != "" {
+			t.Errorf("Expected no body on the alternate, but received '%s'", body)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summarySubBuckets is the number of buckets per power of two of the
+// latency histogram, so that a percentile is within about 6% of the actual
+// latency.
+const summarySubBuckets = 16
+
+// summaryBuckets covers latencies from 1µs to 2^44µs, about 200 days.
+const summaryBuckets = summarySubBuckets * 41
+
+// latencyHistogram is a fixed-size histogram of latencies in microseconds,
+// with exact buckets below summarySubBuckets and log-linear ones above,
+// like an HDR histogram.
+type latencyHistogram struct {
+	counts [summaryBuckets]uint64
+	total  uint64
+}
+
+func summaryBucket(micros uint64) int {
+	if micros < summarySubBuckets {
+		return int(micros)
+	}
+	shift := bits.Len64(micros) - 5 // micros>>shift is in [16, 32)
+	bucket := summarySubBuckets*(shift+1) + int(micros>>shift) - summarySubBuckets
+	return min(bucket, summaryBuckets-1)
+}
+
+// summaryLatency returns the lowest latency of bucket.
+func summaryLatency(bucket int) time.Duration {
+	if bucket < summarySubBuckets {
+		return time.Duration(bucket) * time.Microsecond
+	}
+	shift := bucket/summarySubBuckets - 1
+	micros := uint64(bucket%summarySubBuckets+summarySubBuckets) << shift
+	return time.Duration(micros) * time.Microsecond
+}
+
+func (h *latencyHistogram) Add(duration time.Duration) {
+	h.counts[summaryBucket(uint64(duration.Microseconds()))]++
+	h.total++
+}
+
+// Percentile returns the latency below which p percent of the requests
+// fall, 0 without requests.
+func (h *latencyHistogram) Percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.total))
+	if rank >= h.total {
+		rank = h.total - 1
+	}
+	var seen uint64
+	for bucket, count := range h.counts {
+		seen += count
+		if seen > rank {
+			return summaryLatency(bucket)
+		}
+	}
+	return summaryLatency(summaryBuckets - 1)
+}
+
+// originSummary is what the summary keeps of one backend.
+type originSummary struct {
+	latency latencyHistogram
+	failed  uint64 // requests without a response
+}
+
+// latencySummary accumulates the latencies of all requests to each backend
+// for -summary-on-exit, in a fixed amount of memory per backend. A nil
+// *latencySummary records nothing.
+type latencySummary struct {
+	mu      sync.Mutex
+	origins map[string]*originSummary
+}
+
+func newLatencySummary() *latencySummary {
+	return &latencySummary{origins: make(map[string]*originSummary)}
+}
+
+// Observe records one request to origin that took duration.
+func (s *latencySummary) Observe(origin string, response *http.Response, duration time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := s.origins[origin]
+	if summary == nil {
+		summary = &originSummary{}
+		s.origins[origin] = summary
+	}
+	summary.latency.Add(duration)
+	if response == nil {
+		summary.failed++
+	}
+}
+
+// Lines summarizes each origin in a line like
+// "A requests=120 failed=0 p50=12ms p90=30ms p99=81ms", sorted by origin.
+func (s *latencySummary) Lines() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	origins := make([]string, 0, len(s.origins))
+	for origin := range s.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	lines := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		summary := s.origins[origin]
+		parts := []string{fmt.Sprintf("%s requests=%d failed=%d", origin, summary.latency.total, summary.failed)}
+		for _, p := range []float64{50, 90, 99} {
+			parts = append(parts, fmt.Sprintf("p%v=%v", p, summary.latency.Percentile(p)))
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	return lines
+}
+
+// Log logs the summary of each backend, once shutdown is done.
+func (s *latencySummary) Log() {
+	if s == nil {
+		return
+	}
+	for _, line := range s.Lines() {
+		log.Printf("[%v] %v SUMMARY %s", "X", time.Now().UTC(), line)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	var h latencyHistogram
+	for i := 1; i <= 1000; i++ {
+		h.Add(time.Duration(i) * time.Millisecond)
+	}
+	for _, test := range []struct {
+		p           float64
+		expectation time.Duration
+	}{{50, 500 * time.Millisecond}, {90, 900 * time.Millisecond}, {99, 990 * time.Millisecond}} {
+		if latency := h.Percentile(test.p); latency > test.expectation || latency < test.expectation*94/100 {
+			t.Errorf("Expected p%v within 6%% of %v, but received %v", test.p, test.expectation, latency)
+		}
+	}
+	if latency := (&latencyHistogram{}).Percentile(50); latency != 0 {
+		t.Errorf("Expected 0 without requests, but received %v", latency)
+	}
+	for _, micros := range []uint64{0, 15, 16, 1000, 1 << 39} {
+		if bucket := summaryBucket(micros); bucket < 0 || bucket >= summaryBuckets || summaryLatency(bucket) > time.Duration(micros)*time.Microsecond {
+			t.Errorf("Expected a bucket at or below %dµs, but received %d", micros, bucket)
+		}
+	}
+	if bucket := summaryBucket(1 << 62); bucket != summaryBuckets-1 {
+		t.Errorf("Expected the last bucket for the longest latencies, but received %d", bucket)
+	}
+}
+
+func TestSummaryOfRequests(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandlerFor(production.Address(), closedAddress(t))
+	h.Summary = newLatencySummary()
+	for i := 0; i < 3; i++ {
+		serve(t, h, httptest.NewRequest("GET", "/", nil))
+	}
+
+	lines := h.Summary.Lines()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "A requests=3 failed=0 p50=") || !strings.HasPrefix(lines[1], "B requests=3 failed=3 p50=") {
+		t.Errorf("Expected a line for A and one for B with 3 requests each, but received %q", lines)
+	}
+	if !strings.Contains(lines[0], " p90=") || !strings.Contains(lines[0], " p99=") {
+		t.Errorf("Expected p90 and p99, but received '%s'", lines[0])
+	}
+	var summary *latencySummary
+	summary.Observe("A", nil, time.Second)
+	summary.Log()
+}
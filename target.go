@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// targetURL returns target parsed, if it is given as an http:// or https://
+// URL like https://backend.internal/base rather than as host:port.
+func targetURL(target string) (*url.URL, bool) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// validateTarget checks a target given as a URL. A URL has no query, since
+// that is the client's, and no credentials, which are given with
+// -a.basic-auth and -b.basic-auth.
+func validateTarget(target string) error {
+	if isKafkaTarget(target) {
+		_, _, err := parseKafkaTarget(target)
+		return err
+	}
+	if !strings.Contains(target, "://") {
+		return nil
+	}
+	u, ok := targetURL(target)
+	switch {
+	case !ok:
+		return fmt.Errorf("expected an http:// or https:// URL with a host, but found %q", target)
+	case u.User != nil:
+		return fmt.Errorf("%q: credentials go into -a.basic-auth or -b.basic-auth", target)
+	case u.RawQuery != "" || u.Fragment != "":
+		return fmt.Errorf("%q: expected no query", target)
+	}
+	return nil
+}
+
+// targetScheme returns the scheme of the requests to target: the one of its
+// URL, or http.
+func targetScheme(target string) string {
+	if u, ok := targetURL(target); ok {
+		return u.Scheme
+	}
+	return "http"
+}
+
+// targetBasePath returns the path of the URL of target, which is prepended
+// to the path of the requests to it, or "" for host:port.
+func targetBasePath(target string) string {
+	if u, ok := targetURL(target); ok {
+		return u.Path
+	}
+	return ""
+}
+
+// targetAddress returns the host:port of a target given as a URL, with the
+// default port of its scheme if it has none.
+func targetAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -2,131 +2,797 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Console flags
 var (
-	listen                    = flag.String("l", ":8888", "port to accept requests")
-	targetProduction          = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production")
-	altTarget                 = flag.String("b", "localhost:8081", "where testing traffic goes. response are skipped. http://localhost:8081/test")
+	configFile                = flag.String("config", "", "path to a JSON or YAML file with flag values, overridden by the command line")
+	checkConfigOnly           = flag.Bool("check-config", false, "validate the flags and config file, report every problem and exit, non-zero if there is one, without listening")
+	listen                    = stringListFlag("l", "port to accept requests, :8888 if not given (repeatable, http:// or https:// to choose TLS per address)")
+	targetProduction          = targetListFlag("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production (repeatable or comma-separated, host=host:port to route by Host header)")
+	altTargets                = targetListFlag("b", "localhost:8081", "where testing traffic goes. response are skipped. http://localhost:8081/test (repeatable or comma-separated, host:port@weight to send each request to one alternate by weight)")
 	debug                     = flag.Bool("debug", false, "more logging, showing ignored output")
 	verbose                   = flag.Bool("verbose", false, "log the requests and responses like an access log")
-	productionTimeout         = flag.Int("a.timeout", 2500, "timeout in milliseconds for production traffic")
-	alternateTimeout          = flag.Int("b.timeout", 1000, "timeout in milliseconds for alternate site traffic")
+	logFormat                 = flag.String("log-format", "text", "format of the verbose access log, text or json")
+	accessLogFile             = flag.String("access-log-file", "", "file to write the access log of -verbose to instead of stderr")
+	accessLogMaxSize          = flag.Int64("access-log-max-size", 100<<20, "size in bytes at which the access log file is rotated, 0 to never rotate")
+	accessLogMaxFiles         = flag.Int("access-log-max-files", 5, "number of rotated access log files kept")
+	logHeaders                = flag.Bool("log-headers", false, "with -debug, log the headers sent to and received from each backend")
+	redactHeaders             = flag.String("redact-headers", "Authorization,Cookie", "comma-separated headers whose values -log-headers does not show")
+	otelEndpoint              = flag.String("otel-endpoint", "", "OTLP/HTTP endpoint of an OpenTelemetry collector to export spans to, e.g. http://localhost:4318")
+	statsInterval             = flag.Duration("stats-interval", 0, "interval between log lines with the average latency and error rate of each backend, 0 to disable")
+	summaryOnExit             = flag.Bool("summary-on-exit", false, "log the p50, p90 and p99 latency and the number of requests of each backend on shutdown")
+	compressResponses         = flag.Bool("compress", false, "gzip uncompressed responses to clients that accept gzip, except those below 1024 bytes and server-sent events")
+	requestID                 = flag.Bool("request-id", true, "send an X-Request-Id header to all backends, unless the client sent one")
+	productionTimeout         = timeoutFlag("a.timeout", 2500*time.Millisecond, "timeout for production traffic, e.g. 2500ms or 2s, or a number of milliseconds")
+	alternateTimeout          = timeoutFlag("b.timeout", time.Second, "timeout for alternate site traffic, e.g. 1s, or a number of milliseconds")
+	productionRetries         = flag.Int("a.retries", 0, "number of times a failed request to production is retried")
+	alternateRetries          = flag.Int("b.retries", 0, "number of times a failed request to alternate site is retried")
+	alternateDelayMin         = flag.Duration("b.delay-min", 0, "minimum delay added before each alternate site request")
+	alternateDelayMax         = flag.Duration("b.delay-max", 0, "maximum delay added before each alternate site request, for a random delay between the minimum and this")
+	alternateLag              = flag.Duration("b.lag", 0, "time the alternate site requests wait after production answered, e.g. for its writes to settle before they are read")
+	alternateFaultRate        = flag.Float64("b.fault-rate", 0, "percentage of alternate site requests that get the fault of -b.fault-type")
+	alternateFaultType        = flag.String("b.fault-type", "abort", "fault injected into alternate site requests: abort, to cancel them once sent, or delay, to send them -b.fault-delay late")
+	alternateFaultDelay       = flag.Duration("b.fault-delay", time.Second, "delay of the delay fault")
+	errorStatus               = flag.Int("error-status", http.StatusBadGateway, "status answered when production does not respond")
+	errorBody                 = flag.String("error-body", "Bad gateway\n", "body answered when production does not respond")
+	productionDeadline        = flag.Duration("a.deadline", 0, "time a production request may take across all its attempts, 0 for no limit")
+	productionRetryOn503      = flag.Bool("a.retry-on-503", false, "also retry production requests answered with 503, after their Retry-After")
+	retryBackoff              = flag.Duration("retry-backoff", 0, "delay between retries")
+	retryNonIdempotent        = flag.Bool("retry-non-idempotent", false, "also retry requests that are not idempotent, like POST and PATCH, which may repeat their side effects")
+	productionPathPrefix      = flag.String("a.path-prefix", "", "path prepended to the path of production traffic, e.g. /v1")
+	rewriteRulesFile          = flag.String("rewrite-rules", "", "JSON file of ordered rules rewriting the path and headers of production or alternate site traffic")
+	alternatePathPrefix       = flag.String("b.path-prefix", "", "path prepended to the path of alternate site traffic, e.g. /v2")
 	productionHostRewrite     = flag.Bool("a.rewrite", false, "rewrite the host header when proxying production traffic")
 	alternateHostRewrite      = flag.Bool("b.rewrite", false, "rewrite the host header when proxying alternate site traffic")
 	productionHostSchemeHTTPS = flag.Bool("a.https", false, "rewrite the host scheme when proxying production traffic to use HTTPS")
 	alternateHostSchemeHTTPS  = flag.Bool("b.https", false, "rewrite the host scheme when proxying alternate site traffic to use HTTPS")
-	percent                   = flag.Float64("p", 100.0, "float64 percentage of traffic to send to testing")
-	tlsPrivateKey             = flag.String("key.file", "", "path to the TLS private key file")
-	tlsCertificate            = flag.String("cert.file", "", "path to the TLS certificate file")
+	percent                   = percentFlag("p", 100.0, "float64 percentage of traffic to send to testing, can be changed at runtime with -admin-listen")
+	everyN                    = flag.Int("every-n", 0, "send every Nth request to testing instead of a percentage, 0 to use -p")
+	sampleByKey               = flag.String("sample-by", "", "header:Name or cookie:Name whose value decides the sampling, so that it is stable per value")
+	forceShadowParam          = flag.String("force-shadow-param", "", "query parameter that forces duplication with a true value like ?shadow=1 and suppresses it with a false one like ?shadow=0, whatever -p says")
+	alternateHashBy           = flag.String("b.hash-by", "", "header whose value picks, by consistent hashing, the one alternate site each request is sent to, so that a value always reaches the same one")
+	tlsPrivateKeys            = stringListFlag("key.file", "path to a TLS private key file (repeatable, one per -cert.file)")
+	tlsCertificates           = stringListFlag("cert.file", "path to a TLS certificate file (repeatable, selected by SNI)")
+	tlsMinVersion             = flag.String("tls-min-version", "1.2", "minimum TLS version accepted from clients: 1.0, 1.1, 1.2 or 1.3")
+	tlsFailOpen               = flag.Bool("tls-fail-open", false, "if the certificates of -cert.file and -key.file fail to load, log a warning and serve bare -l addresses without TLS instead of exiting")
+	tlsCiphers                = flag.String("tls-ciphers", "", "comma-separated cipher suites accepted from clients for TLS 1.2 and below, default Go's secure suites")
+	backendCertificate        = flag.String("backend-cert.file", "", "path to the TLS client certificate file presented to HTTPS backends")
+	backendPrivateKey         = flag.String("backend-key.file", "", "path to the TLS client private key file presented to HTTPS backends")
+	backendCA                 = flag.String("backend-ca.file", "", "path to a file of CA certificates trusted for HTTPS backends instead of the system ones")
+	backendInsecure           = flag.Bool("backend-insecure-skip-verify", false, "do not verify the TLS certificates of the backends, insecure")
+	productionInsecure        = flag.Bool("a.insecure", false, "do not verify the TLS certificate of production traffic, insecure")
+	alternateInsecure         = flag.Bool("b.insecure", false, "do not verify the TLS certificates of alternate site traffic, insecure")
+	productionSNI             = flag.String("a.sni", "", "TLS server name sent to and verified for production, instead of the host of the target")
+	alternateSNI              = flag.String("b.sni", "", "TLS server name sent to and verified for the alternate sites, instead of the host of the target")
+	alternateLocalAddr        = flag.String("b.local-addr", "", "local IP address the connections to the alternate sites are made from, instead of the one the route picks")
+	preflightCheck            = flag.Bool("preflight", false, "send a test request to every backend at startup and report the results")
+	preflightMethod           = flag.String("preflight-method", "GET", "method of the preflight request")
+	preflightPath             = flag.String("preflight-path", "/", "path of the preflight request")
+	preflightFatal            = flag.Bool("preflight-fatal", false, "refuse to start if a backend does not answer the preflight request")
+	dryRun                    = flag.Bool("dry-run", false, "only log where each request would be sent and answer 204, without sending it")
+	rateLimit                 = flag.Float64("rate-limit", 0, "maximum number of requests per second accepted, 0 for no limit")
+	rateLimitBurst            = flag.Float64("rate-limit-burst", 0, "number of requests accepted in a burst, by default the rate limit")
+	rateLimitPerIP            = flag.Bool("rate-limit-per-ip", false, "apply the rate limit to each client IP instead of all clients together")
+	forwardProtoHost          = flag.Bool("forward-proto-host", false, "enable forwarding of the original scheme and host to the backend using the 'X-Forwarded-Proto' and 'X-Forwarded-Host' headers")
+	forwardProtoHostTrust     = flag.Bool("forward-proto-host.trust", false, "keep the 'X-Forwarded-Proto' and 'X-Forwarded-Host' headers of an upstream proxy instead of overwriting them, only for clients behind a trusted proxy")
+	addVia                    = flag.Bool("add-via", false, "append teeproxy to the Via header of forwarded requests")
+	viaName                   = flag.String("via-name", "teeproxy", "pseudonym of teeproxy in the Via header")
 	forwardClientIP           = flag.Bool("forward-client-ip", false, "enable forwarding of the client IP to the backend using the 'X-Forwarded-For' and 'Forwarded' headers")
+	proxyProtocol             = flag.Bool("proxy-protocol", false, "send the client address to the backends with the PROXY protocol v1")
 	closeConnections          = flag.Bool("close-connections", false, "close connections to the clients and backends")
+	allowConnect              = flag.Bool("allow-connect", false, "tunnel CONNECT requests to the host:port they name, as a forward proxy, instead of refusing them")
+	maxIdleConnsPerHost       = flag.Int("max-idle-conns-per-host", 100, "maximum number of idle connections kept open to each backend")
+	dnsCacheTTL               = flag.Duration("dns-cache-ttl", 0, "how long resolved backend host names are cached, refreshed in the background, 0 to resolve on every new connection")
+	tcpKeepAlive              = flag.Duration("tcp-keepalive", 30*time.Second, "interval between TCP keep-alive probes on connections to the backends, negative to disable them")
+	idleConnTimeout           = timeoutFlag("idle-conn-timeout", 90*time.Second, "how long an idle connection to a backend is kept open")
+	diffResponses             = flag.Bool("diff", false, "compare the alternate responses with the production response and log differences")
+	diffHeaders               = flag.String("diff-headers", "Content-Type", "comma-separated response headers compared in diff mode")
+	replayFile                = flag.String("replay-file", "", "replay the requests of this record file instead of listening for requests")
+	replayTo                  = flag.String("replay-to", "b", "comma-separated backends to replay to, a for production and b for the alternates")
+	replayRate                = flag.Float64("replay-rate", 0, "requests per second replayed, 0 for one after the other as fast as possible")
+	recordFile                = flag.String("record-file", "", "file to append the alternate requests and responses to, as JSON lines")
+	recordMaxBody             = flag.Int("record-max-body", 64*1024, "maximum number of request and response body bytes recorded")
+	kafkaBufferSize           = flag.Int("kafka-buffer", 10000, "number of requests waiting to be published to a kafka:// alternate before new ones are dropped")
+	kafkaBatchSize            = flag.Int("kafka-batch-size", 500, "maximum number of requests published to a kafka:// alternate at once")
+	kafkaLinger               = flag.Duration("kafka-linger", 100*time.Millisecond, "time a request waits for others to be published with it to a kafka:// alternate")
+	diffDir                   = flag.String("diff-dir", "", "directory to store the request and the responses of each difference found in diff mode")
+	diffMaxFiles              = flag.Int("diff-max-files", 1000, "maximum number of files stored in -diff-dir")
+	diffMaxBody               = flag.Int("diff-max-body", 64*1024, "maximum number of response body bytes buffered per backend in diff mode")
+	alternateHeaderMatches    = headerMatchListFlag("b.header-match", "Name=Value or Name; only requests with this header are sent to alternate site traffic (repeatable, all must match)")
+	alternateInclude          = flag.String("b.include", "", "regular expression; only request paths matching it are sent to alternate site traffic")
+	alternateExclude          = flag.String("b.exclude", "", "regular expression; request paths matching it are not sent to alternate site traffic")
+	alternateWorkers          = flag.Int("b.workers", 0, "number of workers sending alternate site traffic from a bounded queue, 0 for one goroutine per request")
+	alternateQueueSize        = flag.Int("b.queue-size", 1000, "number of alternate requests queued for the workers before new ones are dropped")
+	alternateServePercent     = flag.Float64("b.serve-percent", 0, "percentage of duplicated requests answered with the response of the first alternate site instead of production, which is still sent the request for comparison; if that alternate fails, the client gets -error-status (502 by default) rather than the response of production; streamed requests, including those with Expect: 100-continue, are always answered by production")
+	alternateMaxConcurrency   = flag.Int("b.max-concurrency", 0, "maximum number of alternate requests in progress at once before new ones are dropped, 0 for no limit")
+	maxBodyBytes              = flag.Int64("max-body-bytes", 0, "maximum size of a request body buffered for duplication, 0 for no limit")
+	maxBodyAction             = flag.String("max-body-action", "stream", "what to do with larger requests: stream them to production only, or reject them with 413")
+	alternateNoBody           = flag.Bool("b.no-body", false, "send the alternate sites the request line and headers only, with an empty body")
+	streamBodies              = flag.Bool("stream-bodies", false, "stream request bodies to production and alternate site while they arrive instead of buffering them")
+	streamBufferSize          = flag.Int("stream-buffer", 1<<20, "number of bytes an alternate may fall behind production when streaming bodies, with -stream-bodies or for Expect: 100-continue, before it is dropped")
+	breakerThreshold          = flag.Int("b.breaker-threshold", 0, "consecutive failures after which an alternate site is skipped for the cooldown, 0 to disable")
+	breakerWindow             = flag.Duration("b.breaker-window", time.Minute, "time within which the consecutive failures have to occur")
+	breakerCooldown           = flag.Duration("b.breaker-cooldown", 30*time.Second, "how long an alternate site is skipped before it is probed again")
+	productionBasicAuth       = flag.String("a.basic-auth", "", "user:pass sent as basic auth to production")
+	alternateBasicAuth        = flag.String("b.basic-auth", "", "user:pass sent as basic auth to the alternate sites")
+	productionAddHeaders      = headerListFlag("a.add-header", "Name:Value header set on production traffic (repeatable)")
+	alternateUASuffix         = flag.String("b.ua-suffix", "", "appended to the User-Agent header of alternate site traffic, e.g. ' teeproxy-shadow'")
+	alternateAddHeaders       = headerListFlag("b.add-header", "Name:Value header set on alternate site traffic (repeatable), e.g. X-Shadow:1")
+	stripResponseHeaders      = flag.String("strip-response-headers", "", "comma-separated headers removed from the responses to the clients, e.g. Server,X-Internal-Backend")
+	responseSetHeaders        = headerListFlag("set-response-headers", "Name:Value header set on the responses to the clients, replacing the one of the backend (repeatable)")
+	alternateMethodMap        = flag.String("b.method-map", "", "comma-separated FROM=TO methods replaced in alternate site traffic, e.g. POST=GET")
+	ignoreMethods             = flag.String("ignore-methods", "", "comma-separated request methods that are only sent to production")
+	alternateMethods          = flag.String("b.methods", "", "comma-separated request methods that are the only ones also sent to the alternate site, e.g. GET,HEAD")
+	readHeaderTimeout         = timeoutFlag("read-header-timeout", 10*time.Second, "time a client has to send the request headers, 0 for no limit")
+	readTimeout               = timeoutFlag("read-timeout", 0, "time a client has to send the whole request, 0 for no limit")
+	writeTimeout              = timeoutFlag("write-timeout", 0, "time after the request headers until the response has to be written, 0 for no limit")
+	shutdownTimeout           = timeoutFlag("shutdown-timeout", 10*time.Second, "grace period for requests in progress on SIGTERM or SIGINT")
+	metricsListen             = flag.String("metrics-listen", "", "address to serve Prometheus metrics on at /metrics, disabled if empty")
+	adminListen               = flag.String("admin-listen", "", "address of a separate HTTP server to change the sampling percentage at runtime, e.g. :9100")
+	adminToken                = flag.String("admin-token", "", "bearer token required by the admin server")
+	healthListen              = flag.String("health-listen", "", "address to serve the health check on at /healthz, disabled if empty")
+	pprofListen               = flag.String("pprof-listen", "", "address to serve the profiling endpoints of net/http/pprof on at /debug/pprof/, disabled if empty")
+	healthProbePath           = flag.String("health-probe-path", "", "path requested from the backends by the health check, a TCP connect if empty")
+	healthInterval            = flag.Duration("health-interval", 5*time.Second, "interval between health checks")
+	healthTimeout             = timeoutFlag("health-timeout", time.Second, "timeout of a health check probe")
+	productionHealthInterval  = flag.Duration("a.health-interval", 0, "interval between checks of the production targets, which are skipped while down, 0 to disable")
+	productionHealthThreshold = flag.Int("a.health-threshold", 3, "failed checks in a row after which a production target is down")
 )
 
+// targetList is a flag.Value holding one or more backend addresses. The flag
+// can be repeated or given a comma-separated list. The first explicit value
+// replaces the default. An address may carry a weight, as in host:port@weight,
+// and a host pattern, as in *.example.com=host:port.
+type targetList struct {
+	targets  []string
+	weights  []float64 // 1 for addresses without a weight
+	hosts    []string  // "" for addresses without a host pattern
+	weighted bool      // whether any address has a weight
+	routed   bool      // whether any address has a host pattern
+	explicit bool
+}
+
+func (t *targetList) String() string {
+	if t == nil {
+		return ""
+	}
+	specs := make([]string, len(t.targets))
+	for i, target := range t.targets {
+		specs[i] = target
+		if t.hosts[i] != "" {
+			specs[i] = t.hosts[i] + "=" + target
+		}
+		if t.weighted {
+			specs[i] += "@" + strconv.FormatFloat(t.weights[i], 'g', -1, 64)
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+func (t *targetList) Set(value string) error {
+	if !t.explicit {
+		t.targets, t.weights, t.hosts = nil, nil, nil
+		t.explicit = true
+	}
+	for _, spec := range splitList(value) {
+		host, target, routed := strings.Cut(spec, "=")
+		if !routed {
+			host, target = "", spec
+		} else if host = strings.ToLower(strings.TrimSpace(host)); host == "" {
+			return fmt.Errorf("expected a host pattern before = in %q", spec)
+		} else {
+			t.routed = true
+		}
+		target, weightSpec, weighted := strings.Cut(target, "@")
+		if err := validateTarget(target); err != nil {
+			return err
+		}
+		weight := 1.0
+		if weighted {
+			var err error
+			weight, err = strconv.ParseFloat(weightSpec, 64)
+			if err != nil || weight < 0 || math.IsInf(weight, 0) {
+				return fmt.Errorf("expected a weight of 0 or more in %q", spec)
+			}
+			t.weighted = true
+		}
+		t.targets = append(t.targets, target)
+		t.weights = append(t.weights, weight)
+		t.hosts = append(t.hosts, host)
+	}
+	return nil
+}
+
+// Hosts returns the host pattern of each address, or nil if none has one.
+func (t *targetList) Hosts() []string {
+	if !t.routed {
+		return nil
+	}
+	return t.hosts
+}
+
+// Weights returns the weight of each address, or nil if none has a weight.
+func (t *targetList) Weights() []float64 {
+	if !t.weighted {
+		return nil
+	}
+	return t.weights
+}
+
+// targetListFlag defines a repeatable flag with the given default address.
+func targetListFlag(name, value, usage string) *targetList {
+	t := &targetList{targets: []string{value}, weights: []float64{1}, hosts: []string{""}}
+	flag.Var(t, name, usage)
+	return t
+}
+
+// headerMatch requires a request header to be present and, unless Value is
+// empty, to have the given value.
+type headerMatch struct {
+	Name  string
+	Value string
+}
+
+// headerMatchList is a repeatable flag.Value of Name=Value or Name specs.
+type headerMatchList []headerMatch
+
+func (l *headerMatchList) String() string {
+	if l == nil {
+		return ""
+	}
+	specs := make([]string, len(*l))
+	for i, match := range *l {
+		specs[i] = match.Name
+		if match.Value != "" {
+			specs[i] += "=" + match.Value
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *headerMatchList) Set(spec string) error {
+	name, value, _ := strings.Cut(spec, "=")
+	if name = strings.TrimSpace(name); name == "" {
+		return fmt.Errorf("expected Name=Value or Name, but found %q", spec)
+	}
+	*l = append(*l, headerMatch{http.CanonicalHeaderKey(name), strings.TrimSpace(value)})
+	return nil
+}
+
+// Matches reports whether req carries the header.
+func (m headerMatch) Matches(req *http.Request) bool {
+	for _, value := range req.Header.Values(m.Name) {
+		if m.Value == "" || value == m.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMethodMap parses a comma-separated list of FROM=TO methods.
+func parseMethodMap(spec string) (map[string]string, error) {
+	methods := make(map[string]string)
+	for _, entry := range splitList(spec) {
+		from, to, _ := strings.Cut(entry, "=")
+		from, to = strings.ToUpper(strings.TrimSpace(from)), strings.ToUpper(strings.TrimSpace(to))
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("expected FROM=TO, but found %q", entry)
+		}
+		methods[from] = to
+	}
+	return methods, nil
+}
+
+// headerList is a repeatable flag.Value of Name:Value headers.
+type headerList http.Header
+
+func (l headerList) String() string {
+	var specs []string
+	for name, values := range l {
+		for _, value := range values {
+			specs = append(specs, name+":"+value)
+		}
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, ",")
+}
+
+func (l headerList) Set(spec string) error {
+	name, value, found := strings.Cut(spec, ":")
+	if name = strings.TrimSpace(name); name == "" || !found {
+		return fmt.Errorf("expected Name:Value, but found %q", spec)
+	}
+	http.Header(l).Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// Apply sets the headers on header, replacing the values it had.
+func (l headerList) Apply(header http.Header) {
+	for name, values := range l {
+		header[name] = append([]string(nil), values...)
+	}
+}
+
+func headerListFlag(name, usage string) headerList {
+	l := make(headerList)
+	flag.Var(l, name, usage)
+	return l
+}
+
+// stringList is a repeatable flag.Value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func stringListFlag(name, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func headerMatchListFlag(name, usage string) *headerMatchList {
+	l := &headerMatchList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
 // Sets the request URL.
 //
 // This turns a inbound request (a request without URL) into an outbound request.
-func setRequestTarget(request *http.Request, target *string) {
-	URL, err := url.Parse("http://" + *target + request.URL.String())
+// A target given as a URL sets the scheme, and its path is prepended to the
+// path of the request.
+func setRequestTarget(request *http.Request, target string) {
+	URL, err := url.Parse(targetScheme(target) + "://" + targetHost(target) + request.URL.String())
 	if err != nil {
 		log.Println(err)
 	}
 	request.URL = URL
+	if err == nil {
+		addPathPrefix(request, targetBasePath(target))
+	}
+}
+
+// addPathPrefix prepends prefix to the path of request, with exactly one
+// slash in between: /v2 or /v2/ and /users give /v2/users. request is
+// changed in place, so it must be a copy of the inbound request.
+func addPathPrefix(request *http.Request, prefix string) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return
+	}
+	prefix = "/" + prefix
+	if !strings.HasPrefix(request.URL.Path, "/") {
+		prefix += "/"
+	}
+	request.URL.Path = prefix + request.URL.Path
+	if request.URL.RawPath != "" {
+		request.URL.RawPath = prefix + request.URL.RawPath
+	}
+}
+
+// setBasicAuth sets the Authorization header of request to credentials in
+// the form user:pass, unless credentials is empty.
+func setBasicAuth(request *http.Request, credentials string) {
+	if credentials == "" {
+		return
+	}
+	user, password, _ := strings.Cut(credentials, ":")
+	request.SetBasicAuth(user, password)
+}
+
+// addUserAgentSuffix appends suffix to the User-Agent header, or sets the
+// header to suffix without its leading spaces if there is none.
+func addUserAgentSuffix(header http.Header, suffix string) {
+	if suffix == "" {
+		return
+	}
+	if userAgent := header.Get("User-Agent"); userAgent != "" {
+		header.Set("User-Agent", userAgent+suffix)
+	} else {
+		header.Set("User-Agent", strings.TrimLeft(suffix, " "))
+	}
+}
+
+// newDialer returns the dialer of connections to the backends, which gives
+// up connecting after timeout. Its TCP keep-alive probes are sent every
+// -tcp-keepalive, whatever the timeout. The connections are made from
+// localAddr, unless it is nil.
+func newDialer(timeout time.Duration, localAddr net.IP) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: *tcpKeepAlive,
+	}
+	if localAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: localAddr}
+	}
+	return dialer
 }
 
-// Sends a request and returns the response.
-func handleRequest(origin string, request *http.Request, timeout time.Duration) *http.Response {
-	transport := &http.Transport{
+// newTransport returns the transport for the requests to one kind of
+// backend. It is shared by all requests, so that connections are pooled.
+// tlsConfig is used for HTTPS and may be nil, as may localAddr, the address
+// to connect from.
+func newTransport(timeout time.Duration, tlsConfig *tls.Config, localAddr net.IP) *http.Transport {
+	return &http.Transport{
 		// NOTE(girone): DialTLS is not needed here, because the teeproxy works
 		// as an SSL terminator.
-		DialContext: (&net.Dialer{ // go1.8 deprecated: Use DialContext instead
-			Timeout:   timeout,
-			KeepAlive: timeout,
-			DualStack: true,
-		}).DialContext,
+		DialContext:     proxyProtocolDialer(backendDNS.Dialer(unixSocketDialer(newDialer(timeout, localAddr)))),
+		TLSClientConfig: tlsConfig,
 		// Close connections to the production and alternative servers?
-		DisableKeepAlives:     *closeConnections,
-		IdleConnTimeout:       timeout,
+		// With the PROXY protocol, a connection belongs to one client.
+		DisableKeepAlives:     *closeConnections || *proxyProtocol,
+		MaxIdleConnsPerHost:   *maxIdleConnsPerHost,
+		IdleConnTimeout:       *idleConnTimeout,
 		TLSHandshakeTimeout:   timeout,
 		ResponseHeaderTimeout: timeout,
 		ExpectContinueTimeout: timeout,
 	}
+}
+
+// deadlineTransport bounds each round trip through Transport by Timeout,
+// from dialing until the response body is closed.
+type deadlineTransport struct {
+	Transport http.RoundTripper
+	Timeout   time.Duration
+}
+
+func withDeadline(transport http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	return &deadlineTransport{Transport: transport, Timeout: timeout}
+}
+
+func (t *deadlineTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), t.Timeout)
+	response, err := t.Transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+// cancelOnClose releases the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// maxRetryAfter is the longest Retry-After of a 503 response that is waited
+// for. Backends that ask for more are not retried.
+const maxRetryAfter = 10 * time.Second
+
+// retryAfter returns how long to wait before retrying the 503 response: its
+// Retry-After in seconds or as a date, or backoff without one. It reports
+// false if the backend asks for more than maxRetryAfter.
+func retryAfter(response *http.Response, backoff time.Duration) (time.Duration, bool) {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return backoff, true
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	} else {
+		return backoff, true
+	}
+	if wait > maxRetryAfter {
+		return 0, false
+	}
+	return max(wait, 0), true
+}
 
-	response, err := transport.RoundTrip(request)
+// Sends a request, retrying it as often as given, and returns the response.
+// With retryOn503, 503 responses are retried as well. Requests that are not
+// idempotent are only retried with -retry-non-idempotent.
+func handleRequest(origin string, request *http.Request, transport http.RoundTripper, retries int, retryOn503 bool) *http.Response {
+	if retries > 0 && !*retryNonIdempotent && !isIdempotent(request) {
+		retries = 0
+	}
+	logRequestHeaders(origin, request)
+	response, err := roundTrip(transport, request, retries+1, *retryBackoff, retryOn503)
 	if err != nil {
 		log.Printf("[%v] Request failed: [%v]", origin, err)
 	}
+	logResponseHeaders(origin, response)
 	return response
 }
 
-// handler contains the address of the main Target and the one for the Alternative target
+// isIdempotent reports whether sending request twice has the same effect as
+// sending it once: it has an idempotent method, or, as net/http assumes, an
+// Idempotency-Key or X-Idempotency-Key header.
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	_, key := request.Header["Idempotency-Key"]
+	_, xKey := request.Header["X-Idempotency-Key"]
+	return key || xKey
+}
+
+// roundTrip sends request up to attempts times until it gets a response,
+// waiting backoff between the attempts, and returns the last error. With
+// retryOn503, a 503 response is retried too, after its Retry-After if that
+// is given; the last one is returned.
+func roundTrip(transport http.RoundTripper, request *http.Request, attempts int, backoff time.Duration, retryOn503 bool) (*http.Response, error) {
+	if attempts > 1 && request.Body != nil && request.GetBody == nil {
+		// The first attempt consumes the body, so keep a copy to resend.
+		body, err := io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		request.Body, _ = request.GetBody()
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, err := transport.RoundTrip(request)
+		if attempt >= attempts {
+			return response, err
+		}
+		wait := backoff
+		if err == nil {
+			if !retryOn503 || response.StatusCode != http.StatusServiceUnavailable {
+				return response, nil
+			}
+			var ok bool
+			if wait, ok = retryAfter(response, backoff); !ok {
+				return response, nil
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			err = errors.New(response.Status)
+		}
+		if *debug {
+			log.Printf("Attempt %d of %d failed: [%v]", attempt, attempts, err)
+		}
+		// The context of request may bound all attempts, as -a.deadline
+		// does, so a retry gives up once that is over.
+		select {
+		case <-time.After(wait):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+		if request.GetBody != nil {
+			if request.Body, err = request.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// handler contains the address of the main Target and the ones for the Alternative targets
 type handler struct {
-	Target      string
-	Alternative string
-	Randomizer  rand.Rand
+	Target         string
+	Routes         []hostRoute // production targets by host, tried before Target
+	Alternatives   []string
+	AltHosts       []string          // host pattern of each of the Alternatives, "" for any, if set
+	Weights        []float64         // of the Alternatives; if set, each request goes to one of them
+	HashBy         string            // header whose value picks the one alternate of a request, if set
+	Transport      http.RoundTripper // for production
+	AltTransport   http.RoundTripper // shared by the alternates
+	GRPCTransport  http.RoundTripper // for gRPC calls to production
+	Randomizer     *lockedRand
+	IgnoredMethods map[string]bool
+	AllowedMethods map[string]bool            // the only methods duplicated, if set
+	AddHeaders     headerList                 // set on production requests
+	AltAddHeaders  headerList                 // set on alternate requests
+	MethodMap      map[string]string          // methods replaced in alternate requests
+	Include        *regexp.Regexp             // only paths matching are duplicated, if set
+	Exclude        *regexp.Regexp             // paths matching are not duplicated, if set
+	HeaderMatches  []headerMatch              // all have to match for duplication
+	Queue          *alternateQueue            // runs the alternate requests, if set
+	Limit          *alternateLimit            // caps the alternate requests in progress, if set
+	SampleBy       *sampleBy                  // makes sampling stable per key, if set
+	Breakers       map[string]*circuitBreaker // by alternate, if enabled
+	RateLimiter    *rateLimiter               // limits inbound requests, if set
+	Recorder       *recorder                  // records alternate traffic, if set
+	Publishers     map[string]*kafkaPublisher // by kafka:// alternate
+	Stats          *backendStats              // moving averages for -stats-interval, if set
+	Summary        *latencySummary            // latencies for -summary-on-exit, if set
+	Rewrites       rewriteRules               // of -rewrite-rules, if set
+	Health         *targetHealth              // of the production targets with -a.health-interval
+	Mismatches     *mismatchStore             // stores differing responses in diff mode, if set
+	Tracer         *tracer                    // exports OpenTelemetry spans, if set
+
+	RequestObservers  []RequestObserver  // told about each request to a backend
+	ResponseObservers []ResponseObserver // told about each outcome, like the access log
+
+	production   tracker
+	alternates   tracker
+	requestCount atomic.Uint64 // modulo -every-n
+}
+
+// alternateOrigin names the alternate at index i in log lines. A single
+// alternate is plain "B", several are numbered "B1", "B2", ...
+func alternateOrigin(i, count int) string {
+	if count == 1 {
+		return "B"
+	}
+	return fmt.Sprintf("B%d", i+1)
 }
 
 // ServeHTTP duplicates the incoming request (req) and does the request to the
-// Target and the Alternate target discading the Alternate response
-func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method == "HEAD" {
-		log.Printf("[%v] %v Received HEAD request. Ignoring.", "X", time.Now().UTC())
+// Target and the Alternate targets discading the Alternate responses
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.production.Start()
+	defer h.production.Done()
+
+	if h.RateLimiter != nil {
+		if ok, wait := h.RateLimiter.Allow(req); !ok {
+			rejectTooManyRequests(w, wait)
+			return
+		}
+	}
+
+	if req.Method == http.MethodConnect {
+		serveConnect(w, req)
+		return
+	}
+	if *dryRun {
+		h.serveDryRun(w, req)
 		return
 	}
+	if h.productionTarget(req) == "" {
+		http.Error(w, "No production target is up", http.StatusServiceUnavailable)
+		return
+	}
+
+	req, requestSpan := h.Tracer.StartRequest(req)
+	defer h.Tracer.End(requestSpan)
 
-	var productionRequest, alternativeRequest *http.Request
+	var productionRequest *http.Request
+	if *requestID {
+		ensureRequestID(req)
+	}
 	if *forwardClientIP {
 		updateForwardedHeaders(req)
 	}
-	if *percent == 100.0 || h.Randomizer.Float64()*100 < *percent {
-		alternativeRequest, productionRequest = DuplicateRequest(req)
-		go func() {
-			defer func() {
-				if r := recover(); r != nil && *debug {
-					log.Println("Recovered in ServeHTTP(alternate request) from:", r)
-				}
-			}()
-
-			setRequestTarget(alternativeRequest, altTarget)
-
-			if *alternateHostRewrite {
-				alternativeRequest.Host = h.Alternative
+	if *forwardProtoHost {
+		// Before -a.rewrite and -b.rewrite replace the host.
+		insertXForwardedProtoHost(req, *forwardProtoHostTrust)
+	}
+	if isUpgrade(req) {
+		h.serveUpgrade(w, req)
+		return
+	}
+	removeHopByHopHeaders(req.Header)
+	if *addVia {
+		insertOrExtendViaHeader(req, *viaName)
+	}
+	if isGRPC(req) {
+		h.serveGRPC(w, req)
+		return
+	}
+	var alternateResponses chan alternateResult
+	var alternatesSent int
+	var servedOrigin, servedTarget string
+	var servedRequest *http.Request // answers the client instead of production, if set
+	duplicate := h.duplicates(req)
+	// Without bodies for the alternates, nothing is buffered.
+	if duplicate && *maxBodyBytes > 0 && !*alternateNoBody && !bodyWithinLimit(req, *maxBodyBytes) {
+		if *maxBodyAction == "reject" {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if *verbose || *debug {
+			log.Printf("[%v] %v Request body of %v %v exceeds %d bytes. Streaming it to production only.", "X", time.Now().UTC(), req.Method, req.RequestURI, *maxBodyBytes)
+		}
+		duplicate = false
+	}
+	// Closed when production has answered, for -b.lag.
+	productionDone := make(chan struct{})
+	answered := sync.OnceFunc(func() { close(productionDone) })
+	defer answered()
+	if duplicate {
+		chosen := h.chooseAlternates(req)
+		var requests []*http.Request
+		// Only alternates that get the whole body may answer the client.
+		serveAlternate := false
+		if *alternateNoBody {
+			requests = HeaderOnlyRequests(req, len(chosen)+1)
+		} else if (*streamBodies || expectsContinue(req)) && req.ContentLength != 0 && *alternateLag == 0 {
+			// Buffering the body would let the client send it before
+			// production agreed to take it. With -b.lag it is buffered
+			// anyway, since the alternates only start reading it after
+			// production is done.
+			if !*streamBodies && *debug {
+				log.Printf("[%v] %v Streaming the body of %v %v for Expect: 100-continue, with -stream-buffer and without -b.serve-percent", "X", time.Now().UTC(), req.Method, req.RequestURI)
 			}
-
-			if *alternateHostSchemeHTTPS {
-				alternativeRequest.URL.Scheme = "https"
+			var tee *teeBody
+			requests, tee = StreamRequests(req, len(chosen)+1, *streamBufferSize)
+			defer tee.Finish()
+		} else {
+			requests = DuplicateRequests(req, len(chosen)+1)
+			serveAlternate = len(chosen) > 0 && h.Randomizer.Float64()*100 < *alternateServePercent
+		}
+		productionRequest = requests[0]
+		if *diffResponses {
+			// Buffered, so that alternates never block on a comparison
+			// that gave up waiting for them.
+			alternateResponses = make(chan alternateResult, len(chosen))
+		}
+		for j, i := range chosen {
+			origin, target, alternativeRequest := alternateOrigin(i, len(h.Alternatives)), h.Alternatives[i], requests[j+1]
+			if method, ok := h.MethodMap[alternativeRequest.Method]; ok {
+				alternativeRequest.Method = method
 			}
-
-			timeout := time.Duration(*alternateTimeout) * time.Millisecond
-			// This keeps responses from the alternative target away from the outside world.
-			startReq := time.Now()
-			alternateResponse := handleRequest("B", alternativeRequest, timeout)
-			if alternateResponse != nil {
-				// NOTE(girone): Even though we do not care about the second
-				// response, we still need to close the Body reader. Otherwise
-				// the connection stays open and we would soon run out of file
-				// descriptors.
-				alternateResponse.Body.Close()
+			h.AltAddHeaders.Apply(alternativeRequest.Header)
+			setBasicAuth(alternativeRequest, *alternateBasicAuth)
+			addUserAgentSuffix(alternativeRequest.Header, *alternateUASuffix)
+			if publisher := h.Publishers[target]; publisher != nil {
+				// Published rather than sent, so there is no response
+				// to serve or to compare.
+				h.startAlternate(func() { h.publishAlternate(publisher, alternativeRequest) })
+				continue
 			}
-
-			if *verbose {
-				log.Printf("[%v] %v %v %v %v %v %v %v", "B", time.Now().UTC(), req.RemoteAddr, req.Method, alternateResponse.StatusCode, time.Since(startReq), alternativeRequest.Host, req.RequestURI)
+			if !h.Breakers[target].Allow() {
+				alternativeRequest.Body.Close()
+				continue
+			}
+			if *proxyProtocol {
+				alternativeRequest = withProxyHeader(alternativeRequest, req)
 			}
-		}()
+			if serveAlternate && j == 0 {
+				servedOrigin, servedTarget, servedRequest = origin, target, alternativeRequest
+				continue
+			}
+			// Drawn here rather than in the alternate, like the sampling.
+			delay, fault := h.alternateDelay(), h.alternateFault()
+			send := func() { h.sendAlternate(origin, target, delay, fault, alternativeRequest, req, alternateResponses) }
+			if *alternateLag > 0 {
+				send = lagged(productionDone, *alternateLag, send)
+			}
+			if h.startAlternate(send) {
+				alternatesSent++
+			}
+		}
 	} else {
-		productionRequest = req
+		// Rewritten below, while the access log, the record and the
+		// mismatches want req as the client sent it.
+		productionRequest = req.Clone(req.Context())
 	}
 	defer func() {
 		if r := recover(); r != nil && *debug {
@@ -134,82 +800,690 @@ func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
-	setRequestTarget(productionRequest, targetProduction)
+	// Production is torn down when the client goes away. The alternates are
+	// not, their requests do not depend on the client.
+	ctx, cancel := context.WithCancel(req.Context())
+	if *productionDeadline > 0 {
+		// One budget for all attempts, which -a.timeout bounds each.
+		ctx, cancel = context.WithTimeout(req.Context(), *productionDeadline)
+	}
+	defer cancel()
+	productionRequest = h.productionRequest(productionRequest.WithContext(ctx), req)
+	if servedRequest != nil {
+		h.serveAlternate(w, req, servedOrigin, servedTarget, servedRequest, productionRequest, alternateResponses, alternatesSent)
+		return
+	}
+
+	backendSpan := h.Tracer.StartBackend(req, productionRequest, "A", h.productionTarget(req))
+	h.observeRequest("A", productionRequest)
+	startReq := time.Now()
+	resp := handleRequest("A", productionRequest, h.Transport, *productionRetries, *productionRetryOn503)
+	answered()
+	backendSpan.SetResponse(resp)
+	h.Tracer.End(backendSpan)
+	requestSpan.SetResponse(resp)
+	backendMetrics.Observe("A", resp, time.Since(startReq))
+	h.Stats.Observe("A", resp, time.Since(startReq))
+	h.Summary.Observe("A", resp, time.Since(startReq))
+	h.observeResponse("A", req, productionRequest, resp, time.Since(startReq))
+
+	if resp == nil {
+		productionError(w)
+		return
+	}
+	defer resp.Body.Close()
+
+	var production *capturedResponse
+	var capture io.Writer
+	if alternateResponses != nil {
+		production = newCapturedResponse("A", resp)
+		capture = production
+	}
+	if err := forwardResponse(w, req, resp, capture); err != nil {
+		cancel()
+		logForwardError("A", req, err)
+		return
+	}
+	if production != nil {
+		go compareResponses(req, productionRequest.GetBody, production, alternateResponses, alternatesSent, h.Mismatches)
+	}
+}
+
+// forwardResponse writes resp to the client w of req, and its body to
+// capture as well if that is not nil. Streamed responses, like server-sent
+// events, are passed on as they arrive. With -compress, the body is gzipped
+// to the client if it can be, but captured as it is. The trailers are only
+// sent if the whole body was.
+func forwardResponse(w http.ResponseWriter, req *http.Request, resp *http.Response, capture io.Writer) error {
+	// Forward response headers, and announce the trailers.
+	removeHopByHopHeaders(resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	filterResponseHeaders(w.Header())
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
+	}
+	compress := compressible(req, resp)
+	if compress {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var client io.Writer = w
+	if isStreamedResponse(resp) {
+		flushing := newFlushWriter(w)
+		flushing.Flush()
+		client = flushing
+	}
+	var gzipped *gzip.Writer
+	if compress {
+		gzipped = gzip.NewWriter(client)
+		client = gzipped
+	}
+	if capture != nil {
+		client = io.MultiWriter(client, capture)
+	}
+	body := &bodyReader{Reader: resp.Body}
+	if _, err := io.Copy(client, body); err != nil {
+		if body.err != nil {
+			return &shortBodyError{Read: body.n, Length: resp.ContentLength, Err: body.err}
+		}
+		return err
+	}
+	if gzipped != nil {
+		if err := gzipped.Close(); err != nil {
+			return err
+		}
+	}
+	forwardTrailers(w, resp)
+	return nil
+}
+
+// bodyReader counts the bytes read from a response body and keeps the read
+// error, to tell a backend that stopped sending from a client that stopped
+// receiving.
+type bodyReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// shortBodyError is returned by forwardResponse when the body of the
+// backend ended early, e.g. when the backend stalled until the timeout.
+// The client gets a truncated response.
+type shortBodyError struct {
+	Read   int64
+	Length int64 // -1 if unknown
+	Err    error
+}
+
+func (e *shortBodyError) Error() string {
+	if e.Length >= 0 {
+		return fmt.Sprintf("read %d of %d bytes of the body: %v", e.Read, e.Length, e.Err)
+	}
+	return fmt.Sprintf("read %d bytes of the body: %v", e.Read, e.Err)
+}
+
+func (e *shortBodyError) Unwrap() error {
+	return e.Err
+}
+
+// logForwardError logs that the response from origin could not be forwarded
+// to the client of req. A body that ended early while the client was still
+// there is an error of the backend and always logged, a client that went
+// away only with -debug.
+func logForwardError(origin string, req *http.Request, err error) {
+	var short *shortBodyError
+	if errors.As(err, &short) && req.Context().Err() == nil {
+		log.Printf("[%v] %v Failed to read the response to %v %v: %v", origin, time.Now().UTC(), req.Method, req.RequestURI, err)
+	} else if *debug {
+		log.Printf("[%v] %v Failed to forward the response to %v: %v", origin, time.Now().UTC(), req.RemoteAddr, err)
+	}
+}
+
+// productionRequest points productionRequest, the copy of req for
+// production, at the production target.
+func (h *handler) productionRequest(productionRequest, req *http.Request) *http.Request {
+	if *proxyProtocol {
+		productionRequest = withProxyHeader(productionRequest, req)
+	}
+	target := h.productionTarget(req)
+	h.Rewrites.Apply(productionRequest, "a")
+	addPathPrefix(productionRequest, *productionPathPrefix)
+	setRequestTarget(productionRequest, target)
+	h.AddHeaders.Apply(productionRequest.Header)
+	setBasicAuth(productionRequest, *productionBasicAuth)
 
 	if *productionHostRewrite {
-		productionRequest.Host = h.Target
+		productionRequest.Host = rewrittenHost(target)
 	}
 
 	if *productionHostSchemeHTTPS {
 		productionRequest.URL.Scheme = "https"
 	}
+	return productionRequest
+}
 
-	timeout := time.Duration(*productionTimeout) * time.Millisecond
-	startReq := time.Now()
-	resp := handleRequest("A", productionRequest, timeout)
+// isStreamedResponse reports whether resp has no length known in advance,
+// as with chunked encoding.
+func isStreamedResponse(resp *http.Response) bool {
+	if resp.ContentLength < 0 {
+		return true
+	}
+	for _, encoding := range resp.TransferEncoding {
+		if encoding == "chunked" {
+			return true
+		}
+	}
+	return false
+}
 
-	if resp != nil {
-		defer resp.Body.Close()
+// flushWriter flushes the response after every write, so that the client
+// gets each chunk as soon as teeproxy got it.
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func newFlushWriter(w http.ResponseWriter) flushWriter {
+	return flushWriter{w, http.NewResponseController(w)}
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		err = f.Flush()
+	}
+	return n, err
+}
 
-		if *verbose {
-			log.Printf("[%v] %v %v %v %v %v %v %v", "A", time.Now().UTC(), req.RemoteAddr, req.Method, resp.StatusCode, time.Since(startReq), productionRequest.Host, req.RequestURI)
+// Flush sends what was written so far. Writers that cannot flush are not an
+// error.
+func (f flushWriter) Flush() error {
+	if err := f.controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// productionError answers the client of a request that production did not
+// answer with -error-status and -error-body.
+func productionError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(*errorStatus)
+	io.WriteString(w, *errorBody)
+}
+
+// forwardTrailers copies the trailers of resp, which are only known once its
+// body has been read, to w. Trailers that were not announced are sent with
+// http.TrailerPrefix.
+func forwardTrailers(w http.ResponseWriter, resp *http.Response) {
+	announced := make(map[string]bool)
+	for _, k := range w.Header().Values("Trailer") {
+		announced[http.CanonicalHeaderKey(k)] = true
+	}
+	for k, v := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		w.Header()[k] = v
+	}
+}
+
+// duplicates decides whether req is also sent to the alternates.
+func (h *handler) duplicates(req *http.Request) bool {
+	duplicate, _ := h.routing(req)
+	return duplicate
+}
+
+// routing decides whether req is also sent to the alternates, and names the
+// rule that decided it.
+func (h *handler) routing(req *http.Request) (bool, string) {
+	if len(h.Alternatives) == 0 {
+		return false, "no-alternates"
+	}
+	if isGRPC(req) {
+		return false, "grpc"
+	}
+	if h.IgnoredMethods[req.Method] || (h.AllowedMethods != nil && !h.AllowedMethods[req.Method]) {
+		if *debug {
+			log.Printf("[%v] %v Received %v request. Not duplicating.", "X", time.Now().UTC(), req.Method)
+		}
+		return false, "ignored-method"
+	}
+	if h.Include != nil && !h.Include.MatchString(req.URL.Path) {
+		return false, "not-included"
+	}
+	if h.Exclude != nil && h.Exclude.MatchString(req.URL.Path) {
+		return false, "excluded"
+	}
+	for _, match := range h.HeaderMatches {
+		if !match.Matches(req) {
+			return false, "header-mismatch"
 		}
+	}
+	if duplicate, ok := forcedSampling(req); ok {
+		if duplicate {
+			return true, "forced"
+		}
+		return false, "suppressed"
+	}
+	if !h.sampled(req) {
+		return false, "not-sampled"
+	}
+	return true, "sampled"
+}
 
-		// Forward response headers.
-		for k, v := range resp.Header {
-			w.Header()[k] = v
+// serveDryRun logs where req would be sent and why, and answers 204
+// without sending it anywhere. The line has the form
+//
+//	DRY-RUN method=GET uri=/path to=A,B reason=sampled
+func (h *handler) serveDryRun(w http.ResponseWriter, req *http.Request) {
+	to := []string{"A"}
+	duplicate, reason := h.routing(req)
+	if duplicate {
+		for _, i := range h.chooseAlternates(req) {
+			to = append(to, alternateOrigin(i, len(h.Alternatives)))
 		}
-		w.WriteHeader(resp.StatusCode)
+	}
+	log.Printf("[%v] %v DRY-RUN method=%s uri=%q to=%s reason=%s", "X", time.Now().UTC(), req.Method, req.RequestURI, strings.Join(to, ","), reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// chooseAlternates returns the indexes of the alternates req is sent to:
+// all that take its host, or with Weights or HashBy one of them. With HashBy,
+// a request carrying the header goes to the alternate its value hashes to;
+// the others are picked at random in proportion to their weight.
+func (h *handler) chooseAlternates(req *http.Request) []int {
+	var candidates []int
+	for i := range h.Alternatives {
+		if h.alternateMatches(i, req) {
+			candidates = append(candidates, i)
+		}
+	}
+	if (h.Weights == nil && h.HashBy == "") || len(candidates) == 0 {
+		return candidates
+	}
+	if key := req.Header.Get(h.HashBy); h.HashBy != "" && key != "" {
+		if i, ok := h.hashAlternate(key, candidates); ok {
+			return []int{i}
+		}
+		return nil
+	}
+	total := 0.0
+	for _, i := range candidates {
+		total += h.weight(i)
+	}
+	if total == 0 {
+		return nil
+	}
+	point := h.Randomizer.Float64() * total
+	for _, i := range candidates {
+		if point < h.weight(i) {
+			return []int{i}
+		}
+		point -= h.weight(i)
+	}
+	// Rounding may leave point at the very end: take the last weighted one.
+	for j := len(candidates) - 1; j >= 0; j-- {
+		if i := candidates[j]; h.weight(i) > 0 {
+			return []int{i}
+		}
+	}
+	return nil
+}
+
+// lagged returns send delayed until lag after done is closed, when
+// production has answered. Unlike -b.delay-min, the lag counts from the
+// answer of production rather than from the arrival of the request.
+func lagged(done <-chan struct{}, lag time.Duration, send func()) func() {
+	return func() {
+		<-done
+		timer := time.NewTimer(lag)
+		defer timer.Stop()
+		<-timer.C
+		send()
+	}
+}
+
+// alternateDelay returns the artificial delay of an alternate request,
+// drawn uniformly between -b.delay-min and -b.delay-max.
+func (h *handler) alternateDelay() time.Duration {
+	if *alternateDelayMax <= *alternateDelayMin {
+		return *alternateDelayMin
+	}
+	return *alternateDelayMin + time.Duration(h.Randomizer.Int63n(int64(*alternateDelayMax-*alternateDelayMin)))
+}
+
+// startAlternate runs send, which sends one alternate request, on the queue
+// if there is one. It returns false if the queue is full, -b.max-concurrency
+// requests are in progress or teeproxy is shutting down, and the request was
+// dropped.
+func (h *handler) startAlternate(send func()) bool {
+	if h.Limit != nil {
+		if !h.Limit.Acquire() {
+			backendMetrics.Drop()
+			return false
+		}
+		limited := send
+		send = func() {
+			defer h.Limit.Release()
+			limited()
+		}
+	}
+	if !h.alternates.Start() {
+		// Shutting down.
+		if h.Limit != nil {
+			h.Limit.Release()
+		}
+		return false
+	}
+	if h.Queue == nil {
+		go send()
+		return true
+	}
+	if !h.Queue.Submit(send) {
+		h.alternates.Done()
+		if h.Limit != nil {
+			h.Limit.Release()
+		}
+		backendMetrics.Drop()
+		return false
+	}
+	return true
+}
+
+// sendAlternate sends alternativeRequest to the alternate target and discards
+// the response, after waiting delay and with fault injected, if it is not
+// "". req is the original inbound request, used for logging. If results is
+// not nil, the response is captured and sent on it for diffing.
+func (h *handler) sendAlternate(origin, target string, delay time.Duration, fault string, alternativeRequest, req *http.Request, results chan<- alternateResult) {
+	defer h.alternates.Done()
+	defer func() {
+		if r := recover(); r != nil && *debug {
+			log.Println("Recovered in ServeHTTP(alternate request) from:", r)
+		}
+	}()
+
+	h.alternateRequest(alternativeRequest, target)
+
+	var record *recordEntry
+	if h.Recorder != nil {
+		record = newRecordEntry(origin, target, alternativeRequest, req, h.samplingMethod(req))
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	alternativeRequest, release := injectFault(origin, alternativeRequest, fault)
+	defer release()
+
+	// This keeps responses from the alternative target away from the outside world.
+	backendSpan := h.Tracer.StartBackend(req, alternativeRequest, origin, target)
+	h.observeRequest(origin, alternativeRequest)
+	startReq := time.Now()
+	alternateResponse := handleRequest(origin, alternativeRequest, h.AltTransport, *alternateRetries, false)
+	if fault != "abort" {
+		// An injected abort is no failure of the alternate.
+		h.Breakers[target].Record(alternateResponse != nil)
+	}
+	backendSpan.SetResponse(alternateResponse)
+	h.Tracer.End(backendSpan)
+	backendMetrics.Observe(origin, alternateResponse, time.Since(startReq))
+	h.Stats.Observe(origin, alternateResponse, time.Since(startReq))
+	h.Summary.Observe(origin, alternateResponse, time.Since(startReq))
+	if record != nil {
+		record.SetResponse(alternateResponse, time.Since(startReq))
+	}
+	if results != nil {
+		results <- alternateResult{Origin: origin, Response: captureResponse(origin, alternateResponse)}
+	}
+	if alternateResponse != nil {
+		// NOTE(girone): Even though we do not care about the second
+		// response, we still need to close the Body reader. Otherwise
+		// the connection stays open and we would soon run out of file
+		// descriptors.
+		alternateResponse.Body.Close()
+	}
+
+	if record != nil {
+		h.Recorder.Record(record)
+	}
+
+	h.observeResponse(origin, req, alternativeRequest, alternateResponse, time.Since(startReq))
+}
 
-		// Forward response body.
-		io.Copy(w, resp.Body)
+// publishAlternate publishes alternativeRequest, rewritten like the requests
+// sent to the other alternates.
+func (h *handler) publishAlternate(publisher *kafkaPublisher, alternativeRequest *http.Request) {
+	defer h.alternates.Done()
+	h.Rewrites.Apply(alternativeRequest, "b")
+	addPathPrefix(alternativeRequest, *alternatePathPrefix)
+	publisher.Publish(alternativeRequest)
+}
+
+// alternateRequest points alternativeRequest at the alternate target.
+func (h *handler) alternateRequest(alternativeRequest *http.Request, target string) {
+	h.Rewrites.Apply(alternativeRequest, "b")
+	addPathPrefix(alternativeRequest, *alternatePathPrefix)
+	setRequestTarget(alternativeRequest, target)
+
+	if *alternateHostRewrite {
+		alternativeRequest.Host = rewrittenHost(target)
+	}
+
+	if *alternateHostSchemeHTTPS {
+		alternativeRequest.URL.Scheme = "https"
 	}
 }
 
 func main() {
 	flag.Parse()
 
+	// Before the config file sets flags, for /admin/config.
+	commandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err == nil {
+			err = config.Apply(flag.CommandLine)
+		}
+		if err != nil {
+			log.Fatalf("Invalid config file %s: %s", *configFile, err)
+		}
+	}
+	if *checkConfigOnly {
+		os.Exit(checkConfig())
+	}
+	if errs := flagErrors(); len(errs) > 0 {
+		log.Fatalf("Invalid %s", errs[0])
+	}
+	if *accessLogFile != "" {
+		var err error
+		if accessLog, err = openRotatingFile(*accessLogFile, *accessLogMaxSize, *accessLogMaxFiles); err != nil {
+			log.Fatalf("Invalid -access-log-file %s: %s", *accessLogFile, err)
+		}
+	}
+	if *dnsCacheTTL > 0 {
+		// Before the transports are made.
+		backendDNS = newDNSCache(*dnsCacheTTL)
+	}
+
+	production, routes, err := productionRoutes(targetProduction)
+	if err != nil {
+		log.Fatalf("Invalid -a %s: %s", targetProduction, err)
+	}
+
 	log.Printf("Starting teeproxy at %s sending to A: %s and B: %s",
-		*listen, *targetProduction, *altTarget)
+		listenAddresses(), targetProduction, altTargets)
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	var err error
+	if *backendCertificate != "" || *backendPrivateKey != "" || *backendCA != "" {
+		config, err := loadBackendTLSConfig(*backendCertificate, *backendPrivateKey, *backendCA)
+		if err != nil {
+			log.Fatalf("Failed to load backend TLS files: %s", err)
+		}
+		productionTLSConfig, alternateTLSConfig = config, config
+	}
+	if *backendInsecure || *productionInsecure {
+		productionTLSConfig = insecureTLSConfig(productionTLSConfig)
+		log.Printf("WARNING: TLS certificate verification of production traffic is DISABLED. Never use this in production!")
+	}
+	if *backendInsecure || *alternateInsecure {
+		alternateTLSConfig = insecureTLSConfig(alternateTLSConfig)
+		log.Printf("WARNING: TLS certificate verification of alternate site traffic is DISABLED.")
+	}
+	if *productionSNI != "" {
+		productionTLSConfig = serverNameTLSConfig(productionTLSConfig, *productionSNI)
+	}
+	if *alternateSNI != "" {
+		alternateTLSConfig = serverNameTLSConfig(alternateTLSConfig, *alternateSNI)
+	}
 
-	var listener net.Listener
+	if *replayFile != "" {
+		if err := replayRecordFile(*replayFile); err != nil {
+			log.Fatalf("Failed to replay %s: %s", *replayFile, err)
+		}
+		return
+	}
 
-	if len(*tlsPrivateKey) > 0 {
-		cer, err := tls.LoadX509KeyPair(*tlsCertificate, *tlsPrivateKey)
-		if err != nil {
-			log.Fatalf("Failed to load certficate: %s and private key: %s", *tlsCertificate, *tlsPrivateKey)
+	// Endpoints configured with the same address share one server.
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(address string) *http.ServeMux {
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if *metricsListen != "" {
+		backendMetrics = newMetrics()
+		mux(*metricsListen).Handle("/metrics", backendMetrics)
+	}
+	if *adminListen != "" {
+		mux(*adminListen).Handle("/admin/percent", &adminHandler{Token: *adminToken})
+		mux(*adminListen).Handle("/admin/config", &configHandler{Token: *adminToken, Flags: flag.CommandLine, CommandLine: commandLine})
+	}
+	if *healthListen != "" {
+		checker := &healthChecker{
+			Production: production,
+			Alternates: altTargets.targets,
+			Path:       *healthProbePath,
+			Timeout:    *healthTimeout,
 		}
+		go checker.run(*healthInterval)
+		mux(*healthListen).Handle("/healthz", checker)
+	}
+	if *pprofListen != "" {
+		handlePprof(mux(*pprofListen))
+	}
+	for address, m := range muxes {
+		go func(address string, m *http.ServeMux) {
+			log.Fatalf("Failed to serve on %s: %s", address, http.ListenAndServe(address, m))
+		}(address, m)
+	}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err = tls.Listen("tcp", *listen, config)
-		if err != nil {
-			log.Fatalf("Failed to listen to %s: %s", *listen, err)
+	listenerTLS, err := loadListenerTLS()
+	if err != nil {
+		log.Fatalf("Invalid %s", err)
+	}
+	listeners, err := listenAll(*listen, listenerTLS)
+	if err != nil {
+		log.Fatalf("Failed to listen to %s", err)
+	}
+
+	h, err := NewHandler(handlerConfigFromFlags(production, routes))
+	if err != nil {
+		log.Fatalf("Invalid %s", err)
+	}
+
+	if *preflightCheck {
+		if err := h.preflight(); err != nil {
+			if *preflightFatal {
+				log.Fatalf("Preflight failed: %s", err)
+			}
+			log.Printf("WARNING: Preflight failed: %s", err)
 		}
-	} else {
-		listener, err = net.Listen("tcp", *listen)
-		if err != nil {
-			log.Fatalf("Failed to listen to %s: %s", *listen, err)
+	}
+
+	// All listeners share h, and with it the requests in progress.
+	var servers []*http.Server
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		server := newServer(h)
+		servers = append(servers, server)
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			served <- fmt.Errorf("%s: %s", listener.Addr(), err)
+		}(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		log.Fatalf("Failed to serve on %s", err)
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down within %v", sig, *shutdownTimeout)
+		shutdown(servers, h, *shutdownTimeout)
+		h.Summary.Log()
+		if h.Recorder != nil {
+			h.Recorder.Close()
+		}
+		for _, publisher := range h.Publishers {
+			publisher.Close()
+		}
+		h.Tracer.Close()
+		if err := accessLog.Close(); err != nil {
+			log.Printf("Failed to close the access log: %s", err)
 		}
 	}
+}
 
-	h := handler{
-		Target:      *targetProduction,
-		Alternative: *altTarget,
-		Randomizer:  *rand.New(rand.NewSource(time.Now().UnixNano())),
+// listenAddresses returns the addresses of -l, or the default one.
+func listenAddresses() string {
+	if len(*listen) == 0 {
+		return defaultListen
 	}
+	return listen.String()
+}
+
+// nextProtos are offered to TLS clients via ALPN, preferring HTTP/2.
+var nextProtos = []string{"h2", "http/1.1"}
 
+// newServer returns a server for h that speaks HTTP/1.1 and HTTP/2. Without
+// TLS, HTTP/2 is only used by clients with prior knowledge.
+func newServer(h http.Handler) *http.Server {
 	server := &http.Server{
-		Handler: h,
+		Handler:           h,
+		Protocols:         new(http.Protocols),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
 	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
 	if *closeConnections {
 		// Close connections to clients by setting the "Connection": "close" header in the response.
 		server.SetKeepAlivesEnabled(false)
 	}
-	server.Serve(listener)
+	return server
 }
 
 type nopCloser struct {
@@ -218,47 +1492,92 @@ type nopCloser struct {
 
 func (nopCloser) Close() error { return nil }
 
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
 func DuplicateRequest(request *http.Request) (request1 *http.Request, request2 *http.Request) {
-	b1 := new(bytes.Buffer)
-	b2 := new(bytes.Buffer)
-	w := io.MultiWriter(b1, b2)
-	io.Copy(w, request.Body)
+	requests := DuplicateRequests(request, 2)
+	return requests[0], requests[1]
+}
+
+// DuplicateRequests reads the body of request once and returns count
+// independent requests replaying it. Their GetBody hands out a fresh copy of
+// the body, so that they can be retried. The duplicates are sent to the
+// backends as HTTP/1.1, whatever protocol the client used.
+func DuplicateRequests(request *http.Request, count int) []*http.Request {
+	body := new(bytes.Buffer)
+	io.Copy(body, request.Body)
 	defer request.Body.Close()
-	request1 = &http.Request{
-		Method:        request.Method,
-		URL:           request.URL,
-		Proto:         request.Proto,
-		ProtoMajor:    request.ProtoMajor,
-		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          nopCloser{b1},
-		Host:          request.Host,
-		ContentLength: request.ContentLength,
-		Close:         true,
+	getBody := func() (io.ReadCloser, error) {
+		return nopCloser{bytes.NewReader(body.Bytes())}, nil
+	}
+	if request.ContentLength > 0 && request.ContentLength != int64(body.Len()) && *debug {
+		log.Printf("[%v] %v Received a body of %d bytes, but a Content-Length of %d", "X", time.Now().UTC(), body.Len(), request.ContentLength)
+	}
+	requests := make([]*http.Request, count)
+	for i := range requests {
+		// The copies carry the buffered body, so its length is known even
+		// if the client sent it chunked, and is sent as Content-Length.
+		var copyBody io.ReadCloser = http.NoBody
+		if body.Len() > 0 {
+			copyBody = nopCloser{bytes.NewReader(body.Bytes())}
+		}
+		requests[i] = copyRequest(request, copyBody)
+		requests[i].ContentLength = int64(body.Len())
+		requests[i].Header.Del("Transfer-Encoding")
+		requests[i].GetBody = getBody
+	}
+	return requests
+}
+
+// HeaderOnlyRequests returns count independent requests like
+// DuplicateRequests, but only the first one carries the body of request, as
+// it arrives. The others have an empty body.
+func HeaderOnlyRequests(request *http.Request, count int) []*http.Request {
+	requests := []*http.Request{copyRequest(request, request.Body)}
+	for i := 1; i < count; i++ {
+		alternate := copyRequest(request, http.NoBody)
+		alternate.ContentLength = 0
+		alternate.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		requests = append(requests, alternate)
+	}
+	return requests
+}
+
+// copyRequest returns an outbound copy of request with the given body. The
+// copy has its own headers and URL, so that they can be changed per backend.
+func copyRequest(request *http.Request, body io.ReadCloser) *http.Request {
+	header := request.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
 	}
-	request2 = &http.Request{
+	requestURL := *request.URL
+	return &http.Request{
 		Method:        request.Method,
-		URL:           request.URL,
-		Proto:         request.Proto,
-		ProtoMajor:    request.ProtoMajor,
-		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          nopCloser{b2},
+		URL:           &requestURL,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
 		Host:          request.Host,
 		ContentLength: request.ContentLength,
-		Close:         true,
 	}
-	return
 }
 
 func updateForwardedHeaders(request *http.Request) {
-	positionOfColon := strings.LastIndex(request.RemoteAddr, ":")
-	var remoteIP string
-	if positionOfColon != -1 {
-		remoteIP = request.RemoteAddr[:positionOfColon]
-	} else {
-		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", remoteIP)
-		remoteIP = request.RemoteAddr
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", request.RemoteAddr)
+		remoteIP = strings.TrimSuffix(strings.TrimPrefix(request.RemoteAddr, "["), "]")
 	}
 	insertOrExtendForwardedHeader(request, remoteIP)
 	insertOrExtendXFFHeader(request, remoteIP)
@@ -282,6 +1601,10 @@ const FORWARDED_HEADER = "Forwarded"
 // Implementation according to rfc7239
 func insertOrExtendForwardedHeader(request *http.Request, remoteIP string) {
 	extension := "for=" + remoteIP
+	if strings.Contains(remoteIP, ":") {
+		// IPv6 addresses are bracketed and quoted
+		extension = "for=\"[" + remoteIP + "]\""
+	}
 	header := request.Header.Get(FORWARDED_HEADER)
 	if header != "" {
 		// extend
@@ -291,3 +1614,44 @@ func insertOrExtendForwardedHeader(request *http.Request, remoteIP string) {
 		request.Header.Set(FORWARDED_HEADER, extension)
 	}
 }
+
+const XFP_HEADER = "X-Forwarded-Proto"
+const XFH_HEADER = "X-Forwarded-Host"
+
+// Sets the scheme and host the client connected with, replacing any values
+// sent by the client. With trusted, the values of an earlier proxy, which
+// saw the original request, are kept instead.
+func insertXForwardedProtoHost(request *http.Request, trusted bool) {
+	if !trusted || request.Header.Get(XFP_HEADER) == "" {
+		proto := "http"
+		if request.TLS != nil {
+			proto = "https"
+		}
+		request.Header.Set(XFP_HEADER, proto)
+	}
+	if !trusted || request.Header.Get(XFH_HEADER) == "" {
+		request.Header.Del(XFH_HEADER)
+		if request.Host != "" {
+			request.Header.Set(XFH_HEADER, request.Host)
+		}
+	}
+}
+
+const VIA_HEADER = "Via"
+
+// Implementation according to rfc7230, section 5.7.1
+func insertOrExtendViaHeader(request *http.Request, pseudonym string) {
+	version := fmt.Sprintf("%d.%d", request.ProtoMajor, request.ProtoMinor)
+	if request.ProtoMajor >= 2 {
+		version = fmt.Sprint(request.ProtoMajor)
+	}
+	extension := version + " " + pseudonym
+	header := strings.Join(request.Header.Values(VIA_HEADER), ", ")
+	if header != "" {
+		// extend
+		request.Header.Set(VIA_HEADER, header+", "+extension)
+	} else {
+		// insert
+		request.Header.Set(VIA_HEADER, extension)
+	}
+}
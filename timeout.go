@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseTimeout parses a duration like 2500ms or 2s, or a bare number of
+// milliseconds, as -a.timeout and -b.timeout used to take.
+func parseTimeout(value string) (time.Duration, error) {
+	if milliseconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(milliseconds) * time.Millisecond, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("expected a duration like 2s or a number of milliseconds, but found %q", value)
+	}
+	return timeout, nil
+}
+
+// timeoutValue is a time.Duration flag.Value that also takes a bare number
+// of milliseconds.
+type timeoutValue time.Duration
+
+func timeoutFlag(name string, value time.Duration, usage string) *time.Duration {
+	timeout := value
+	flag.Var((*timeoutValue)(&timeout), name, usage)
+	return &timeout
+}
+
+func (t *timeoutValue) String() string {
+	if t == nil {
+		return ""
+	}
+	return time.Duration(*t).String()
+}
+
+func (t *timeoutValue) Set(value string) error {
+	timeout, err := parseTimeout(value)
+	if err != nil {
+		return err
+	}
+	*t = timeoutValue(timeout)
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"2500":   2500 * time.Millisecond,
+		"0":      0,
+		"2500ms": 2500 * time.Millisecond,
+		"2s":     2 * time.Second,
+		"1m30s":  90 * time.Second,
+	} {
+		if timeout, err := parseTimeout(value); err != nil || timeout != expected {
+			t.Errorf("Expected %v for '%s', but received %v (%v)", expected, value, timeout, err)
+		}
+	}
+	for _, value := range []string{"", "fast", "2.5", "2 s"} {
+		if _, err := parseTimeout(value); err == nil {
+			t.Errorf("Expected an error for '%s'", value)
+		}
+	}
+}
+
+func TestTimeoutFlagTakesMilliseconds(t *testing.T) {
+	timeout := timeoutValue(time.Second)
+	if err := timeout.Set("250"); err != nil || time.Duration(timeout) != 250*time.Millisecond {
+		t.Errorf("Expected 250ms, but received %v (%v)", timeout.String(), err)
+	}
+	if err := timeout.Set("3s"); err != nil || timeout.String() != "3s" {
+		t.Errorf("Expected 3s, but received %v (%v)", timeout.String(), err)
+	}
+}
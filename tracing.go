@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TRACEPARENT_HEADER = "Traceparent"
+
+// traceBatchSize is the number of spans sent to the collector at once, and
+// traceInterval the longest a span waits for its batch.
+const (
+	traceBatchSize = 512
+	traceInterval  = 5 * time.Second
+)
+
+// Span kinds of OTLP.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// traceContext is the W3C trace context of a span, as carried by the
+// traceparent header.
+type traceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// parseTraceparent parses a traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(value string) (traceContext, bool) {
+	var tc traceContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil || tc.TraceID == [16]byte{} {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil || tc.SpanID == [8]byte{} {
+		return tc, false
+	}
+	tc.Sampled = flags[0]&1 == 1
+	return tc, true
+}
+
+func (tc traceContext) String() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", tc.TraceID, tc.SpanID, flags)
+}
+
+// span is one operation of a trace: an inbound request or a backend call.
+type span struct {
+	Context    traceContext
+	Parent     [8]byte // zero for a root span
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{} // string or int values
+	Failed     bool
+}
+
+// Child starts a span for an operation within s.
+func (s *span) Child(name string, kind int) *span {
+	child := &span{
+		Context:    traceContext{TraceID: s.Context.TraceID, Sampled: s.Context.Sampled},
+		Parent:     s.Context.SpanID,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+	rand.Read(child.Context.SpanID[:])
+	return child
+}
+
+// SetResponse records the status of response, or the failure without one.
+func (s *span) SetResponse(response *http.Response) {
+	if s == nil {
+		return
+	}
+	if response == nil {
+		s.Failed = true
+		return
+	}
+	s.Attributes["http.response.status_code"] = response.StatusCode
+	s.Failed = response.StatusCode >= 500
+}
+
+// tracer exports spans to an OpenTelemetry collector over OTLP/HTTP with
+// JSON encoding, in batches in the background. Spans that do not fit in the
+// queue are dropped. A nil *tracer traces nothing.
+type tracer struct {
+	Endpoint string // the URL spans are posted to
+	Client   *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	spans  chan *span
+	done   chan struct{}
+}
+
+// newTracer exports to the collector at endpoint, e.g. http://localhost:4318.
+func newTracer(endpoint string) *tracer {
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	t := &tracer{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: traceInterval},
+		spans:    make(chan *span, 4*traceBatchSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+type spanContextKey struct{}
+
+// StartRequest starts the server span of req, continuing the trace of its
+// traceparent header if it has one, and returns req with the span in its
+// context.
+func (t *tracer) StartRequest(req *http.Request) (*http.Request, *span) {
+	if t == nil {
+		return req, nil
+	}
+	root := &span{}
+	if parent, ok := parseTraceparent(req.Header.Get(TRACEPARENT_HEADER)); ok {
+		root.Context = parent
+	} else {
+		rand.Read(root.Context.TraceID[:])
+		root.Context.Sampled = true
+	}
+	// Without a parent, the root has no span ID and the child no parent.
+	s := root.Child(req.Method, spanKindServer)
+	s.Attributes["http.request.method"] = req.Method
+	s.Attributes["url.path"] = req.URL.Path
+	return req.WithContext(context.WithValue(req.Context(), spanContextKey{}, s)), s
+}
+
+// StartBackend starts the client span of the call of origin to target made
+// for req, and sets the traceparent header of request to it.
+func (t *tracer) StartBackend(req, request *http.Request, origin, target string) *span {
+	if t == nil {
+		return nil
+	}
+	parent, _ := req.Context().Value(spanContextKey{}).(*span)
+	if parent == nil {
+		return nil
+	}
+	s := parent.Child(origin+" "+request.Method, spanKindClient)
+	s.Attributes["teeproxy.origin"] = origin
+	s.Attributes["server.address"] = target
+	s.Attributes["http.request.method"] = request.Method
+	request.Header.Set(TRACEPARENT_HEADER, s.Context.String())
+	return s
+}
+
+// End ends s and queues it for export, unless its trace is not sampled.
+func (t *tracer) End(s *span) {
+	if t == nil || s == nil || !s.Context.Sampled {
+		return
+	}
+	s.End = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// Close exports the queued spans. Spans ended after Close are discarded.
+func (t *tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	<-t.done
+}
+
+func (t *tracer) export(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, _ := json.Marshal(otlpTraces(batch))
+	response, err := t.Client.Post(t.Endpoint, "application/json", bytes.NewReader(body))
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector answered %s", response.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("[%v] %v Failed to export %d spans: %v", "X", time.Now().UTC(), len(batch), err)
+	}
+}
+
+// otlpTraces turns spans into an OTLP ExportTraceServiceRequest in its JSON
+// encoding.
+func otlpTraces(spans []*span) map[string]interface{} {
+	var encoded []map[string]interface{}
+	for _, s := range spans {
+		var attributes []map[string]interface{}
+		for key, value := range s.Attributes {
+			switch value := value.(type) {
+			case int:
+				attributes = append(attributes, map[string]interface{}{"key": key, "value": map[string]string{"intValue": strconv.Itoa(value)}})
+			default:
+				attributes = append(attributes, map[string]interface{}{"key": key, "value": map[string]string{"stringValue": fmt.Sprint(value)}})
+			}
+		}
+		status := 1 // OK
+		if s.Failed {
+			status = 2 // ERROR
+		}
+		span := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.Context.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.Context.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            map[string]int{"code": status},
+		}
+		if s.Parent != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.Parent[:])
+		}
+		encoded = append(encoded, span)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{"key": "service.name", "value": map[string]string{"stringValue": "teeproxy"}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "teeproxy"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
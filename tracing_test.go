@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// otlpSpan is the part of an exported span the tests look at.
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+// newTestCollector collects the spans posted to it.
+func newTestCollector(t *testing.T) (*httptest.Server, func() []otlpSpan) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			http.NotFound(w, req)
+			return
+		}
+		var export struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		body, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &export); err != nil {
+			t.Errorf("Expected OTLP JSON, but received '%s'", body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, resource := range export.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	return collector, func() []otlpSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func TestTraceIsPropagatedAndExported(t *testing.T) {
+	collector, spans := newTestCollector(t)
+	production := newTestBackend(t, http.StatusOK, "")
+	alternate := newTestBackend(t, http.StatusInternalServerError, "")
+	h := newTestHandler(production, alternate)
+	h.Tracer = newTracer(collector.URL)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serve(t, h, req)
+	h.Tracer.Close()
+
+	byName := make(map[string]otlpSpan)
+	for _, span := range spans() {
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected the trace of the client, but received '%s'", span.TraceID)
+		}
+		byName[span.Name] = span
+	}
+	server, a, b := byName["GET"], byName["A GET"], byName["B GET"]
+	if len(byName) != 3 || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Fatalf("Expected a server span below the client span and two backend spans, but received %+v", byName)
+	}
+	if a.ParentSpanID != server.SpanID || b.ParentSpanID != server.SpanID || a.Kind != spanKindClient {
+		t.Errorf("Expected the backend spans below '%s', but received %+v and %+v", server.SpanID, a, b)
+	}
+	if a.Status.Code != 1 || b.Status.Code != 2 {
+		t.Errorf("Expected A to be OK and B to fail, but received %d and %d", a.Status.Code, b.Status.Code)
+	}
+	for _, backend := range []struct {
+		received *testBackend
+		span     otlpSpan
+	}{{production, a}, {alternate, b}} {
+		expectation := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + backend.span.SpanID + "-01"
+		if received := backend.received.Requests()[0].Header.Get(TRACEPARENT_HEADER); received != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, received)
+		}
+	}
+}
+
+func TestUnsampledTraceIsNotExported(t *testing.T) {
+	collector, spans := newTestCollector(t)
+	production := newTestBackend(t, http.StatusOK, "")
+	h := newTestHandler(production)
+	h.Tracer = newTracer(collector.URL)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	serve(t, h, req)
+	h.Tracer.Close()
+
+	if len(spans()) != 0 {
+		t.Errorf("Expected no spans, but received %+v", spans())
+	}
+	if received := production.Requests()[0].Header.Get(TRACEPARENT_HEADER); !strings.HasPrefix(received, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(received, "-00") {
+		t.Errorf("Expected the unsampled trace to be propagated, but received '%s'", received)
+	}
+}
+
+func TestTraceparentIsUntouchedWithoutTracer(t *testing.T) {
+	production := newTestBackend(t, http.StatusOK, "")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	serve(t, newTestHandler(production), req)
+	if received := production.Requests()[0].Header.Get(TRACEPARENT_HEADER); received != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the traceparent of the client, but received '%s'", received)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":  false,
+		"garbage": false,
+	} {
+		if _, ok := parseTraceparent(value); ok != valid {
+			t.Errorf("Expected '%s' to be valid: %v", value, valid)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func benchmarkHandleRequest(b *testing.B, transportPerRequest bool) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	shared := newTransport(time.Second, nil, nil)
+	defer shared.CloseIdleConnections()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport := shared
+		if transportPerRequest {
+			transport = newTransport(time.Second, nil, nil)
+		}
+		request, _ := http.NewRequest("GET", backend.URL, nil)
+		response := handleRequest("A", request, transport, 0, false)
+		if response == nil {
+			b.Fatal("Expected a response")
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if transportPerRequest {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// Compare with -bench . -benchmem: the shared transport reuses its
+// connection, while a transport per request dials every time.
+func BenchmarkSharedTransport(b *testing.B) {
+	benchmarkHandleRequest(b, false)
+}
+
+func BenchmarkTransportPerRequest(b *testing.B) {
+	benchmarkHandleRequest(b, true)
+}
+
+func TestTransportReusesConnections(t *testing.T) {
+	var connections atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	transport := newTransport(time.Second, nil, nil)
+	for i := 0; i < 5; i++ {
+		request, _ := http.NewRequest("GET", backend.URL, nil)
+		response := handleRequest("A", request, transport, 0, false)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+	if connections.Load() != 1 {
+		t.Errorf("Expected 1 connection for 5 sequential requests, but received %d", connections.Load())
+	}
+}
+
+func TestTransportPoolFlags(t *testing.T) {
+	defer func(idle int, timeout time.Duration) { *maxIdleConnsPerHost, *idleConnTimeout = idle, timeout }(*maxIdleConnsPerHost, *idleConnTimeout)
+	*maxIdleConnsPerHost, *idleConnTimeout = 7, time.Minute
+
+	transport := newTransport(time.Second, nil, nil)
+	if transport.MaxIdleConnsPerHost != 7 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Expected 7 idle connections for %v, but received %d for %v", time.Minute, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestDialerKeepAliveIsIndependentOfTimeout(t *testing.T) {
+	defer func(keepAlive time.Duration) { *tcpKeepAlive = keepAlive }(*tcpKeepAlive)
+	*tcpKeepAlive = 45 * time.Second
+
+	for _, timeout := range []time.Duration{time.Millisecond, 2500 * time.Millisecond} {
+		if dialer := newDialer(timeout, nil); dialer.Timeout != timeout || dialer.KeepAlive != 45*time.Second {
+			t.Errorf("Expected a keep-alive of %v with a timeout of %v, but received %v and %v", 45*time.Second, timeout, dialer.KeepAlive, dialer.Timeout)
+		}
+	}
+}
+
+func TestDeadlineCutsOffSlowBackend(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	transport := withDeadline(&http.Transport{}, 50*time.Millisecond)
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	start := time.Now()
+	if response := handleRequest("A", request, transport, 0, false); response != nil {
+		t.Errorf("Expected the request to time out, but received status %d", response.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to be cut off after 50ms, but took %v", elapsed)
+	}
+}
+
+func TestDeadlineCoversResponseBody(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	transport := withDeadline(&http.Transport{}, 50*time.Millisecond)
+	request, _ := http.NewRequest("GET", backend.URL, nil)
+	response := handleRequest("A", request, transport, 0, false)
+	if response == nil {
+		t.Fatal("Expected the response headers in time")
+	}
+	defer response.Body.Close()
+	if _, err := io.ReadAll(response.Body); err == nil {
+		t.Errorf("Expected reading the stalled body to fail at the deadline")
+	}
+}
+
+func TestAlternateConnectionsUseLocalAddr(t *testing.T) {
+	// remoteHost returns a backend and the host each of its connections
+	// came from.
+	remoteHost := func() (*httptest.Server, chan string) {
+		hosts := make(chan string, 1)
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				hosts <- host
+			}
+		}
+		backend.Start()
+		return backend, hosts
+	}
+	production, productionHosts := remoteHost()
+	defer production.Close()
+	alternate, alternateHosts := remoteHost()
+	defer alternate.Close()
+	h, err := NewHandler(HandlerConfig{
+		Production:   production.Listener.Addr().String(),
+		Alternatives: []string{alternate.Listener.Addr().String()},
+		AltLocalAddr: net.ParseIP("127.0.0.2"),
+		Seed:         1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve(t, h, httptest.NewRequest("GET", "/", nil))
+	if host := <-alternateHosts; host != "127.0.0.2" {
+		t.Errorf("Expected the alternate connection from 127.0.0.2, but received %s", host)
+	}
+	if host := <-productionHosts; host != "127.0.0.1" {
+		t.Errorf("Expected the production connection from 127.0.0.1, but received %s", host)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// unixSocketPrefix marks a backend as the path of a Unix domain socket, as
+// in unix:/run/app.sock.
+const unixSocketPrefix = "unix:"
+
+// unixSocketDomain ends the host names that stand for Unix sockets in
+// request URLs. RFC 6761 reserves .invalid, so no real host can clash.
+const unixSocketDomain = ".unix.invalid"
+
+// targetHost returns the host of the request URLs for target. The path of a
+// Unix socket is encoded into a host name that unixSocketDialer recognizes,
+// so that each socket gets its own connection pool.
+func targetHost(target string) string {
+	if u, ok := targetURL(target); ok {
+		return targetAddress(u)
+	}
+	if path, ok := strings.CutPrefix(target, unixSocketPrefix); ok {
+		return hex.EncodeToString([]byte(path)) + unixSocketDomain
+	}
+	return target
+}
+
+// rewrittenHost returns the Host header of requests to target with
+// -a.rewrite or -b.rewrite. Unix sockets have no host name, so they get
+// localhost.
+func rewrittenHost(target string) string {
+	if u, ok := targetURL(target); ok {
+		return u.Host
+	}
+	if strings.HasPrefix(target, unixSocketPrefix) {
+		return "localhost"
+	}
+	return target
+}
+
+// unixSocketPath returns the path of the Unix socket that address, made by
+// targetHost and with or without a port, stands for.
+func unixSocketPath(address string) (string, bool) {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	encoded, ok := strings.CutSuffix(host, unixSocketDomain)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(encoded)
+	return string(path), err == nil
+}
+
+// unixSocketDialer dials with dialer, connecting to a Unix socket for the
+// addresses made by targetHost. The local TCP address of dialer, if any,
+// does not apply to Unix sockets.
+func unixSocketDialer(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if path, ok := unixSocketPath(address); ok {
+			unix := *dialer
+			unix.LocalAddr = nil
+			return unix.DialContext(ctx, "unix", path)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// newUnixSocketBackend starts a backend on a Unix socket and returns its
+// address as given to -a and -b.
+func newUnixSocketBackend(t *testing.T, body string) (string, chan *http.Request) {
+	path := filepath.Join(t.TempDir(), "backend.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 10)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req
+		io.WriteString(w, body)
+	})}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return unixSocketPrefix + path, requests
+}
+
+func TestUnixSocketBackends(t *testing.T) {
+	defer func(rewrite bool) { *alternateHostRewrite = rewrite }(*alternateHostRewrite)
+	*alternateHostRewrite = true
+	production, productionRequests := newUnixSocketBackend(t, "production")
+	alternate, alternateRequests := newUnixSocketBackend(t, "alternate")
+	h := newTestHandlerFor(production, alternate)
+
+	req := httptest.NewRequest("GET", "/path?q=1", nil)
+	req.Host = "example.com"
+	recorder := serve(t, h, req)
+	if recorder.Body.String() != "production" {
+		t.Errorf("Expected the production response, but received '%s'", recorder.Body.String())
+	}
+	if req := <-productionRequests; req.Host != "example.com" || req.URL.String() != "/path?q=1" {
+		t.Errorf("Expected the request for example.com/path?q=1 on the production socket, but received %s%s", req.Host, req.URL)
+	}
+	if req := <-alternateRequests; req.Host != "localhost" {
+		t.Errorf("Expected the rewritten host 'localhost' on the alternate socket, but received '%s'", req.Host)
+	}
+}
+
+func TestUnixSocketPath(t *testing.T) {
+	host := targetHost("unix:/run/app.sock")
+	for _, address := range []string{host, host + ":80"} {
+		if path, ok := unixSocketPath(address); !ok || path != "/run/app.sock" {
+			t.Errorf("Expected '/run/app.sock' for '%s', but received '%s'", address, path)
+		}
+	}
+	if _, ok := unixSocketPath("localhost:80"); ok {
+		t.Errorf("Expected no Unix socket for 'localhost:80'")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgrade reports whether req asks to switch protocols, as WebSocket
+// clients do.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade connects the client of req directly to production and copies
+// bytes in both directions until either side closes. Upgraded connections
+// are never sent to the alternates, since a duplicated stream cannot be
+// kept in step with the client.
+func (h *handler) serveUpgrade(w http.ResponseWriter, req *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Protocol upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backend, err := h.dialProduction(req)
+	if err != nil {
+		log.Printf("[%v] Upgrade failed: [%v]", "A", err)
+		productionError(w)
+		return
+	}
+	defer backend.Close()
+
+	outbound := req.Clone(req.Context())
+	addPathPrefix(outbound, *productionPathPrefix)
+	addPathPrefix(outbound, targetBasePath(h.productionTarget(req)))
+	h.AddHeaders.Apply(outbound.Header)
+	setBasicAuth(outbound, *productionBasicAuth)
+	if *productionHostRewrite {
+		outbound.Host = rewrittenHost(h.productionTarget(req))
+	}
+	if err := outbound.Write(backend); err != nil {
+		log.Printf("[%v] Upgrade failed: [%v]", "A", err)
+		productionError(w)
+		return
+	}
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("[%v] Upgrade failed: [%v]", "A", err)
+		return
+	}
+	defer client.Close()
+	// The upgraded connection may stay open for longer than -read-timeout
+	// and -write-timeout.
+	client.SetDeadline(time.Time{})
+	if *debug {
+		log.Printf("[%v] %v Upgraded %v %v to %v", "A", time.Now().UTC(), req.RemoteAddr, req.RequestURI, req.Header.Get("Upgrade"))
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		// Bytes the client sent after the request may already be buffered.
+		io.Copy(backend, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dialProduction opens a connection to production for req, with TLS if
+// -a.https is set.
+func (h *handler) dialProduction(req *http.Request) (net.Conn, error) {
+	timeout := *productionTimeout
+	ctx := req.Context()
+	if *proxyProtocol {
+		ctx = withProxyHeader(req, req).Context()
+	}
+	dial := proxyProtocolDialer(backendDNS.Dialer(unixSocketDialer(newDialer(timeout, nil))))
+	target := h.productionTarget(req)
+	conn, err := dial(ctx, "tcp", targetHost(target))
+	if err != nil || (!*productionHostSchemeHTTPS && targetScheme(target) != "https") {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if productionTLSConfig != nil {
+		config = productionTLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(targetHost(target))
+	}
+	// Only HTTP/1.1 can be upgraded.
+	config.NextProtos = nil
+	tlsConn := tls.Client(conn, config)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newEchoBackend starts a backend that switches to an echo protocol on
+// upgrade requests.
+func newEchoBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, buffered)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestUpgradeIsProxiedToProductionOnly(t *testing.T) {
+	production := newEchoBackend(t)
+	alternate := newTestBackend(t, http.StatusOK, "")
+	proxy := httptest.NewServer(newTestHandlerFor(strings.TrimPrefix(production.URL, "http://"), alternate.Address()))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/socket", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status %d, but received %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	conn := resp.Body.(io.ReadWriter)
+	io.WriteString(conn, "hello\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("Expected the echo 'hello', but received '%s' (%v)", line, err)
+	}
+	if requests := alternate.Requests(); len(requests) != 0 {
+		t.Errorf("Expected no requests to the alternate, but received %d", len(requests))
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	for connection, expectation := range map[string]bool{"Upgrade": true, "keep-alive, upgrade": true, "keep-alive": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Connection", connection)
+		req.Header.Set("Upgrade", "websocket")
+		if isUpgrade(req) != expectation {
+			t.Errorf("Expected %v for Connection '%s', but received %v", expectation, connection, !expectation)
+		}
+	}
+}
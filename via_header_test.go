@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNoViaHeaderProvided(t *testing.T) {
+	request, _ := http.NewRequest("GET", "ad1/test", nil)
+	insertOrExtendViaHeader(request, "teeproxy")
+	if expectation := "1.1 teeproxy"; request.Header.Get("Via") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, request.Header.Get("Via"))
+	}
+}
+
+func TestViaHeaderProvided(t *testing.T) {
+	request, _ := http.NewRequest("GET", "ad1/test", nil)
+	request.Header.Add("Via", "1.0 fred, 1.1 example.com")
+	request.Header.Add("Via", "1.1 cache")
+	insertOrExtendViaHeader(request, "shadow")
+	if expectation := "1.0 fred, 1.1 example.com, 1.1 cache, 1.1 shadow"; request.Header.Get("Via") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, request.Header.Get("Via"))
+	}
+}
+
+func TestViaHeaderForHTTP2(t *testing.T) {
+	request, _ := http.NewRequest("GET", "ad1/test", nil)
+	request.ProtoMajor, request.ProtoMinor = 2, 0
+	insertOrExtendViaHeader(request, "teeproxy")
+	if expectation := "2 teeproxy"; request.Header.Get("Via") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, request.Header.Get("Via"))
+	}
+}
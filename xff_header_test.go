@@ -80,3 +80,28 @@ func TestBothProvidedWithMoreProxies(t *testing.T) {
 		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
 	}
 }
+
+func TestIPv6RemoteAddr(t *testing.T) {
+	adserverRequest, _ := http.NewRequest("GET", "ad1/test", nil)
+	adserverRequest.RemoteAddr = "[2001:db8::1]:80"
+	updateForwardedHeaders(adserverRequest)
+	var xffHeader = adserverRequest.Header.Get("X-FORWARDED-FOR")
+	var forwardedHeader = adserverRequest.Header.Get("FORWARDED")
+	if expectation := "2001:db8::1"; xffHeader != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, xffHeader)
+	}
+	if expectation := `for="[2001:db8::1]"`; forwardedHeader != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
+	}
+}
+
+func TestRemoteAddrWithoutPort(t *testing.T) {
+	for remoteAddr, expectation := range map[string]string{"192.168.0.1": "192.168.0.1", "[::1]": "::1", "::1": "::1"} {
+		adserverRequest, _ := http.NewRequest("GET", "ad1/test", nil)
+		adserverRequest.RemoteAddr = remoteAddr
+		updateForwardedHeaders(adserverRequest)
+		if xffHeader := adserverRequest.Header.Get("X-FORWARDED-FOR"); xffHeader != expectation {
+			t.Errorf("Expected '%s' for '%s', but received '%s'", expectation, remoteAddr, xffHeader)
+		}
+	}
+}